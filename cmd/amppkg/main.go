@@ -18,13 +18,19 @@
 package main
 
 import (
+	"crypto"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"path"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/WICG/webpackage/go/signedexchange"
@@ -36,6 +42,7 @@ import (
 	"github.com/ampproject/amppackager/packager/util"
 	"github.com/ampproject/amppackager/packager/validitymap"
 	"github.com/ampproject/amppackager/packager/rtv"
+	rpb "github.com/ampproject/amppackager/transformer/request"
 )
 
 var flagConfig = flag.String("config", "amppkg.toml", "Path to the config toml file.")
@@ -56,6 +63,75 @@ func (this logIntercept) ServeHTTP(resp http.ResponseWriter, req *http.Request)
 	// TODO(twifkak): Separate the typical weblog from the detailed error log.
 }
 
+// Reads the cert chain and key in the given files.
+func readCertAndKey(certFile, keyFile string) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	// TODO(twifkak): Document what cert/key storage formats this accepts.
+	certPem, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "reading %s", certFile)
+	}
+	keyPem, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "reading %s", keyFile)
+	}
+
+	certs, err := signedexchange.ParseCertificates(certPem)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "parsing %s", certFile)
+	}
+	if certs == nil || len(certs) == 0 {
+		return nil, nil, errors.Errorf("no cert found in %s", certFile)
+	}
+	if !*flagDevelopment && !util.CanSignHttpExchanges(certs[0]) {
+		return nil, nil, errors.New("cert is missing CanSignHttpExchanges extension")
+	}
+	// signer.New and Signer.ReloadCert verify that certs[0] covers the signing
+	// domains in the config (see RequireCertCoverage below).
+
+	key, err := util.ParsePrivateKey(keyPem)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "parsing %s", keyFile)
+	}
+	// TODO(twifkak): Verify that key matches certs[0].
+	return certs, key, nil
+}
+
+// Re-reads the cert chain and key, and switches both the cert cache and the
+// packager to them, so that a renewed cert may be deployed without a restart.
+// On error, the old cert remains in use.
+func reloadCert(config *util.Config, certCache *certcache.Reloadable, packager *signer.Signer, oldCerts []*x509.Certificate) ([]*x509.Certificate, error) {
+	certs, key, err := readCertAndKey(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	// Serve the new cert chain before signing with it, so that its cert URL
+	// never 404s.
+	if err := certCache.Load(certs); err != nil {
+		return nil, errors.Wrap(err, "loading cert cache")
+	}
+	if err := packager.ReloadCert(certs, key); err != nil {
+		if revertErr := certCache.Load(oldCerts); revertErr != nil {
+			log.Println("Error reverting cert cache:", revertErr)
+		}
+		return nil, errors.Wrap(err, "reloading packager")
+	}
+	return certs, nil
+}
+
+// Returns a handler serving the requested cert chain from whichever of the
+// cert caches serves it, or a 404 (from the first) if none does.
+func serveCerts(certCaches []*certcache.Reloadable) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		for _, certCache := range certCaches {
+			if certCache.Serves(params.ByName("certName")) {
+				certCache.ServeHTTP(resp, req, params)
+				return
+			}
+		}
+		certCaches[0].ServeHTTP(resp, req, params)
+	}
+}
+
 // Exposes an HTTP server. Don't run this on the open internet, for at least two reasons:
 //  - It exposes an API that allows people to sign any URL as any other URL.
 //  - It is in cleartext.
@@ -73,44 +149,51 @@ func main() {
 		die(errors.Wrapf(err, "parsing config at %s", *flagConfig))
 	}
 
-	// TODO(twifkak): Document what cert/key storage formats this accepts.
-	certPem, err := ioutil.ReadFile(config.CertFile)
+	certs, key, err := readCertAndKey(config.CertFile, config.KeyFile)
 	if err != nil {
-		die(errors.Wrapf(err, "reading %s", config.CertFile))
+		die(err)
 	}
-	keyPem, err := ioutil.ReadFile(config.KeyFile)
-	if err != nil {
-		die(errors.Wrapf(err, "reading %s", config.KeyFile))
-	}
-
-	certs, err := signedexchange.ParseCertificates(certPem)
-	if err != nil {
-		die(errors.Wrapf(err, "parsing %s", config.CertFile))
-	}
-	if certs == nil || len(certs) == 0 {
-		die(fmt.Sprintf("no cert found in %s", config.CertFile))
-	}
-	if !*flagDevelopment && !util.CanSignHttpExchanges(certs[0]) {
-		die("cert is missing CanSignHttpExchanges extension")
-	}
-	// TODO(twifkak): Verify that certs[0] covers all the signing domains in the config.
-
-	key, err := util.ParsePrivateKey(keyPem)
-	if err != nil {
-		die(errors.Wrapf(err, "parsing %s", config.KeyFile))
-	}
-	// TODO(twifkak): Verify that key matches certs[0].
 
 	validityMap, err := validitymap.New()
 	if err != nil {
 		die(errors.Wrap(err, "building validity map"))
 	}
 
-	certCache := certcache.New(certs, config.OCSPCache)
-	if err = certCache.Init(nil); err != nil {
+	certCache := certcache.NewReloadable(config.OCSPCache, config.CertURLVersion)
+	if err = certCache.Load(certs); err != nil {
 		die(errors.Wrap(err, "building cert cache"))
 	}
-	rtvCache, err := rtv.New()
+	// Each extra cert's chain is served (and its OCSP response maintained)
+	// by a cert cache of its own.
+	certCaches := []*certcache.Reloadable{certCache}
+	var extraCerts []signer.SigningCert
+	for i, extra := range config.ExtraCert {
+		extraChain, extraKey, err := readCertAndKey(extra.CertFile, extra.KeyFile)
+		if err != nil {
+			die(errors.Wrapf(err, "reading ExtraCert.%d", i))
+		}
+		extraCache := certcache.NewReloadable(extra.OCSPCache, config.CertURLVersion)
+		if err = extraCache.Load(extraChain); err != nil {
+			die(errors.Wrapf(err, "building cert cache for ExtraCert.%d", i))
+		}
+		certCaches = append(certCaches, extraCache)
+		extraCerts = append(extraCerts, signer.SigningCert{Cert: extraChain[0], Key: extraKey, Priority: extra.Priority})
+	}
+	isOCSPHealthy := func() bool {
+		for _, certCache := range certCaches {
+			if !certCache.IsHealthy() {
+				return false
+			}
+		}
+		return true
+	}
+	rtvCache, err := rtv.New(rtv.Options{
+		RefreshInterval: time.Duration(config.RTVRefreshIntervalSeconds) * time.Second,
+		StaleWhileError: config.RTVStaleWhileError,
+		PinnedRTV:       config.PinnedRTV,
+		AllowColdStart:  config.RTVAllowColdStart,
+		MaxAge:          time.Duration(config.RTVMaxAgeSeconds) * time.Second,
+	})
 	if err != nil {
 		die(errors.Wrap(err, "initializing rtv cache"))
 	}
@@ -125,8 +208,89 @@ func main() {
 		}
 	}
 
-	packager, err := signer.New(certs[0], key, config.URLSet, rtvCache, certCache.IsHealthy,
-		overrideBaseURL, /*requireHeaders=*/!*flagDevelopment)
+	signerOptions := signer.Options{
+		WarnOnMissingViewport:        config.WarnOnMissingViewport,
+		ErrorOnMissingViewport:       config.ErrorOnMissingViewport,
+		ErrorOnGETWithBody:           config.ErrorOnGETWithBody,
+		DebugSignedBytesToken:        config.DebugSignedBytesToken,
+		DebugOriginalDigest:          config.DebugOriginalDigest,
+		CertURLVersion:               config.CertURLVersion,
+		ErrorOnUnsatisfiableAccept:   config.ErrorOnUnsatisfiableAccept,
+		ErrorOnNonNosniff:            config.ErrorOnNonNosniff,
+		ErrorOnUnsupportedVary:       config.ErrorOnUnsupportedVary,
+		ExcludeRuntimePreload:        config.ExcludeRuntimePreload,
+		Versions:                     config.SXGVersions,
+		ErrorOnContentLengthMismatch: config.ErrorOnContentLengthMismatch,
+		PreloadDataFetches:           config.PreloadDataFetches,
+		ErrorOnMissingDoctype:        config.ErrorOnMissingDoctype,
+		FetchRetries:                 config.FetchRetries,
+		FetchRetryBackoff:            time.Duration(config.FetchRetryBackoffMillis) * time.Millisecond,
+		MergeUpstreamLinkHeaders:     config.MergeUpstreamLinkHeaders,
+		FetchTimeout:                 time.Duration(config.FetchTimeoutMillis) * time.Millisecond,
+		DefaultTransformVersion:      config.DefaultTransformVersion,
+		MaxDecompressedBodyBytes:     config.MaxDecompressedBodyBytes,
+		TransformIdentities:          config.TransformIdentities,
+		MaxBodyBytes:                 config.MaxBodyBytes,
+		ProxyOversizedBody:           config.ProxyOversizedBody,
+		NormalizeCharset:             config.NormalizeCharset,
+		NotFoundOnExtraPathSegments:  config.NotFoundOnExtraPathSegments,
+		ForwardedHeaders:             config.ForwardedHeaders,
+		TransformerHeaders:           config.TransformerHeaders,
+		DuplicateParams:              config.DuplicateParams,
+		MaxTransformedBodyBytes:      config.MaxTransformedBodyBytes,
+		RequireSCT:                   config.RequireSCT,
+		OverrideUpstreamCSP:          config.OverrideUpstreamCSP,
+		MaxInlineDataBytes:           config.MaxInlineDataBytes,
+		DebugEnabled:                 config.DebugEnabled,
+		HonorDeadlineHeader:          config.HonorDeadlineHeader,
+		NotFoundOnSignPathMismatch:   config.NotFoundOnSignPathMismatch,
+		ErrorOnRefreshHeader:         config.ErrorOnRefreshHeader,
+		MaxPreloads:                  config.MaxPreloads,
+		ExtendedPreloads:             config.ExtendedPreloads,
+		VerifyMIPayload:              config.VerifyMIPayload,
+		RTVUnavailable:               config.RTVUnavailable,
+		RTVWaitTimeout:               time.Duration(config.RTVWaitTimeoutMillis) * time.Millisecond,
+		FallbackRTV:                  config.FallbackRTV,
+		FetchUserAgent:               config.FetchUserAgent,
+		PreloadMedia:                 config.PreloadMedia,
+		SignPostedDocuments:          config.SignPostedDocuments,
+		UpgradeSignURLScheme:         config.UpgradeSignURLScheme,
+		CanonicalLinkHeader:          config.CanonicalLinkHeader,
+		LastModified:                 config.LastModified,
+		MaxConcurrentFetches:         config.MaxConcurrentFetches,
+		QueueFetches:                 config.QueueFetches,
+		ProxyOnTransientSigningError: config.ProxyOnTransientSigningError,
+		PreloadHeroSrcset:            config.PreloadHeroSrcset,
+		PreferBOMCharset:             config.PreferBOMCharset,
+		FetchUnixSocket:              config.FetchUnixSocket,
+		SignatureAlg:                 config.SignatureAlg,
+		ErrorOnAmbiguousSignURL:      config.ErrorOnAmbiguousSignURL,
+		RequireCertCoverage:          !*flagDevelopment,
+		DeniedExtensionSrcs:          config.DeniedExtensionSrcs,
+		AcceptXHTML:                  config.AcceptXHTML,
+		MinBodyBytes:                 config.MinBodyBytes,
+		ValidityURLPath:              config.ValidityURLPath,
+		LogNoPreloads:                config.LogNoPreloads,
+		SecurityHeaders:              config.SecurityHeaders,
+		HSTS:                         config.HSTS,
+		ExtraCerts:                   extraCerts,
+	}
+	for _, name := range config.AllowedFormats {
+		format, ok := rpb.Request_HtmlFormat_value[strings.ToUpper(name)]
+		if !ok {
+			die(errors.Errorf("unknown AllowedFormats entry %q", name))
+		}
+		signerOptions.AllowedFormats = append(signerOptions.AllowedFormats, rpb.Request_HtmlFormat(format))
+	}
+	if config.SXGCacheMaxEntries > 0 {
+		signerOptions.Cache = signer.NewLRUCache(config.SXGCacheMaxEntries, config.SXGCacheMaxBytes)
+	}
+	if config.KillSwitchFile != "" {
+		signerOptions.KillSwitch = util.NewKillSwitch(config.KillSwitchFile, time.Second)
+	}
+	packager, err := signer.New(certs[0], key, config.URLSet, rtvCache, signer.IgnoreRequest(isOCSPHealthy),
+		overrideBaseURL, /*requireHeaders=*/!*flagDevelopment, config.RecordSize,
+		time.Duration(config.SignatureExpirySeconds)*time.Second, signerOptions)
 	if err != nil {
 		die(errors.Wrap(err, "building packager"))
 	}
@@ -135,10 +299,36 @@ func main() {
 	mux := httprouter.New()
 	mux.RedirectTrailingSlash = false
 	mux.RedirectFixedPath = false
-	mux.GET(util.ValidityMapPath, validityMap.ServeHTTP)
+	validityHandler, certHandler := validityMap.ServeHTTP, serveCerts(certCaches)
+	if len(config.CacheIPAllowlist) > 0 {
+		allowlist, err := util.NewIPAllowlist(config.CacheIPAllowlist)
+		if err != nil {
+			die(errors.Wrap(err, "building cache IP allowlist"))
+		}
+		validityHandler, certHandler = allowlist.Wrap(validityHandler), allowlist.Wrap(certHandler)
+	}
+	mux.GET(util.ValidityMapPath, validityHandler)
 	mux.GET("/priv/doc", packager.ServeHTTP)
 	mux.GET("/priv/doc/*signURL", packager.ServeHTTP)
-	mux.GET(path.Join(util.CertURLPrefix, ":certName"), certCache.ServeHTTP)
+	mux.POST("/priv/sign", packager.ServeSignDocument)
+	mux.GET(path.Join(util.CertURLPrefix, ":certName"), certHandler)
+	mux.Handler("GET", "/healthz", packager.Healthz(isOCSPHealthy))
+
+	// Reload the cert and key on SIGHUP, e.g. after renewal. ExtraCerts are
+	// read only at startup.
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			newCerts, err := reloadCert(config, certCache, packager, certs)
+			if err != nil {
+				log.Printf("Error reloading cert; continuing to use the old one: %+v\n", err)
+				continue
+			}
+			certs = newCerts
+			log.Println("Reloaded cert", util.CertName(certs[0]))
+		}
+	}()
 	addr := ""
 	if config.LocalOnly {
 		addr = "localhost"
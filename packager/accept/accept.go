@@ -7,22 +7,34 @@ import (
 	"github.com/ampproject/amppackager/packager/util"
 )
 
-// The SXG version that packager can produce. In the future, it may need to be
-// able to produce multiple versions.
+// The SXG version that packager produces by default.
 const AcceptedSxgVersion = "b3"
 
-// The Content-Type for the SXG version that the signer produces.
+// The Content-Type for the SXG version that the signer produces by default.
 const SxgContentType = "application/signed-exchange;v=" + AcceptedSxgVersion
 
-// The enum of the SXG version that the signer produces, for passing to the
-// signedexchange library.
+// The enum of the SXG version that the signer produces by default, for
+// passing to the signedexchange library.
 var SxgVersion = version.Version1b3
 
-// True if the given Accept header is one that the packager can satisfy. It
-// must contain application/signed-exchange;v=$V so that the packager knows
-// whether or not it can supply the correct version. "" and "*/*" are not
-// satisfiable, for this reason.
-func CanSatisfy(accept string) bool {
+// The SXG versions that packager can produce, mapped to their enums for the
+// signedexchange library. b1 is excluded, as it uses a different MI encoding.
+var SupportedSxgVersions = map[string]version.Version{
+	"b2": version.Version1b2,
+	"b3": version.Version1b3,
+}
+
+// The Content-Type for the given SXG version (e.g. "b3").
+func ContentType(sxgVersion string) string {
+	return "application/signed-exchange;v=" + sxgVersion
+}
+
+// Returns the highest of the given SXG versions that is listed in the given
+// Accept header, or "" if none are. The Accept header must contain
+// application/signed-exchange;v=$V so that the packager knows whether or not it
+// can supply the correct version. "" and "*/*" are not satisfiable, for this
+// reason.
+func Negotiate(accept string, sxgVersions []string) string {
 	// There is an edge case on which this comma-splitting fails:
 	//   Accept: application/signed-exchange;junk="some,thing";v=b2
 	// However, in practice, browsers don't send media types with quoted
@@ -30,12 +42,26 @@ func CanSatisfy(accept string) bool {
 	//   https://developer.mozilla.org/en-US/docs/Web/HTTP/Content_negotiation/List_of_default_Accept_values
 	// So we'll live with this deficiency for the sake of not forking
 	// mime.ParseMediaType.
+	accepted := map[string]bool{}
 	types := util.Comma.Split(accept, -1)
 	for _, mediaRange := range types {
 		mediatype, params, err := mime.ParseMediaType(mediaRange)
-		if err == nil && mediatype == "application/signed-exchange" && params["v"] == AcceptedSxgVersion {
-			return true
+		if err == nil && mediatype == "application/signed-exchange" {
+			accepted[params["v"]] = true
 		}
 	}
-	return false
+	best := ""
+	for _, v := range sxgVersions {
+		// Versions are of the form b1, b2, etc., so compare lexically.
+		if accepted[v] && v > best {
+			best = v
+		}
+	}
+	return best
+}
+
+// True if the given Accept header is one that the packager can satisfy with
+// the default SXG version. See Negotiate.
+func CanSatisfy(accept string) bool {
+	return Negotiate(accept, []string{AcceptedSxgVersion}) != ""
 }
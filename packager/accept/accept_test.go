@@ -24,3 +24,16 @@ func TestCanSatisfy(t *testing.T) {
 	// This is the same bug, though one which won't occur in practice:
 	assert.True(t, CanSatisfy(`application/signed-exchange;x="y,application/signed-exchange;v=b3,z";v=b1`))
 }
+
+func TestNegotiate(t *testing.T) {
+	assert.Equal(t, "", Negotiate("", []string{"b3"}))
+	assert.Equal(t, "", Negotiate("*/*", []string{"b2", "b3"}))
+	assert.Equal(t, "", Negotiate(`application/signed-exchange;v=b2`, []string{"b3"}))
+	assert.Equal(t, "", Negotiate(`application/signed-exchange;v=b3`, nil))
+
+	assert.Equal(t, "b2", Negotiate(`application/signed-exchange;v=b2`, []string{"b2", "b3"}))
+	assert.Equal(t, "b3", Negotiate(`application/signed-exchange;v=b3`, []string{"b2", "b3"}))
+	assert.Equal(t, "b3", Negotiate(`application/signed-exchange;v=b2,application/signed-exchange;v=b3`, []string{"b2", "b3"}))
+	assert.Equal(t, "b3", Negotiate(`application/signed-exchange;v=b3;q=0.8,application/signed-exchange;v=b2`, []string{"b3", "b2"}))
+	assert.Equal(t, "b2", Negotiate(`application/signed-exchange;v=b2,application/signed-exchange;v=b3`, []string{"b2"}))
+}
@@ -21,7 +21,15 @@ import (
 // https://tools.ietf.org/html/draft-ietf-httpbis-header-structure-07#section-3.3
 type parameterisedIdentifier struct {
 	id     string
-	params map[string]string
+	params map[string]paramValue
+}
+
+// The value of a param. Only string values are interpreted; others are
+// retained as their raw text, so that unknown params of any type can be
+// ignored rather than failing the parse.
+type paramValue struct {
+	value    string
+	isString bool
 }
 
 // https://tools.ietf.org/html/rfc7230#appendix-B (OWS = "optional whitespace")
@@ -87,9 +95,10 @@ func parseParameterisedIdentifier(reader *strings.Reader) (*parameterisedIdentif
 		return nil, errors.Wrap(err, "parsing primary identifier")
 	}
 	// NOTE: The current version of AMP-Cache-Transform only uses
-	// string-valued parameters. Future versions of the spec may require
-	// parsing other Item types.
-	params := map[string]string{}
+	// string-valued parameters. Other values are parsed leniently (see
+	// parseBareValue), so that clients may send params this packager
+	// doesn't know about.
+	params := map[string]paramValue{}
 	for {
 		if err := discardOWS(reader); err != nil {
 			return nil, errors.Wrap(err, "discarding OWS")
@@ -129,10 +138,13 @@ func parseParameterisedIdentifier(reader *strings.Reader) (*parameterisedIdentif
 		} else if char != parameterValueSeparator {
 			return nil, errors.Errorf("expected '%c'", parameterValueSeparator)
 		}
-		// NOTE: In the future, this may need to be parseItem() to
-		// support other Item types:
-		// https://tools.ietf.org/html/draft-ietf-httpbis-header-structure-07#section-4.2.5
-		value, err := parseString(reader)
+		var value paramValue
+		if reader.Len() > 0 && peekByte(reader) == stringDelimiter {
+			value.value, err = parseString(reader)
+			value.isString = true
+		} else {
+			value.value, err = parseBareValue(reader)
+		}
 		if err != nil {
 			return nil, errors.Wrapf(err, "parsing value for param %s", name)
 		}
@@ -147,6 +159,42 @@ const (
 	stringEscape = '\\'
 )
 
+// Returns the next byte without consuming it. reader must be non-empty.
+func peekByte(reader *strings.Reader) byte {
+	char, _ := reader.ReadByte()
+	reader.UnreadByte()
+	return char
+}
+
+// Parses a non-string param value (e.g. an integer, boolean, or token) as
+// its raw text, up to the next whitespace, separator, or end of input. This
+// is looser than the Item grammar in
+// https://tools.ietf.org/html/draft-ietf-httpbis-header-structure-07#section-4.2.5,
+// as such values are never interpreted.
+func parseBareValue(reader *strings.Reader) (string, error) {
+	var value strings.Builder
+	for reader.Len() > 0 {
+		char, err := reader.ReadByte()
+		if err != nil {
+			return "", errors.Wrap(err, "reading char")
+		}
+		if char == ' ' || char == '\t' || char == parameterSeparator || char == parameterisedListSeparator {
+			if err := reader.UnreadByte(); err != nil {
+				return "", errors.Wrap(err, "unreading char")
+			}
+			break
+		}
+		if char == stringDelimiter || invalidStringChar(char) {
+			return "", errors.Errorf("invalid char %d", char)
+		}
+		value.WriteByte(char)
+	}
+	if value.Len() == 0 {
+		return "", errors.New("expected param value")
+	}
+	return value.String(), nil
+}
+
 func invalidStringChar(char byte) bool {
 	return char <= 0x1f || char == 0x7f
 }
@@ -261,10 +309,18 @@ func parseVersions(vSpec string) ([]*rpb.VersionRange, error) {
 	return ret, nil
 }
 
-// The valid set of "destination AMP cache" identifiers for which this packager
-// can serve a request. Eventually, this should be parsed from caches.json
-// (issue #156).
-var validIdentifiers = map[string]bool {"any": true, "google": true}
+// The default set of "destination AMP cache" identifiers for which this
+// packager can serve a request. Eventually, this should be parsed from
+// caches.json (issue #156).
+var DefaultIdentifiers = []string{"any", "google"}
+
+// Returns true if id is syntactically valid as a "destination AMP cache"
+// identifier.
+func IsValidIdentifier(id string) bool {
+	reader := strings.NewReader(id)
+	parsed, err := parseIdentifier(reader)
+	return err == nil && parsed == id
+}
 
 const versionParamName = "v"
 
@@ -273,26 +329,41 @@ const versionParamName = "v"
 // it should send, plus the transform version it should use. Else, returns
 // empty string.
 func ShouldSendSXG(header_value string) (string, int64) {
+	return ShouldSendSXGFor(header_value, DefaultIdentifiers, 0)
+}
+
+// Like ShouldSendSXG, but only satisfies the given identifiers, and if the
+// selected identifier lacks a v param, assumes the client requested
+// defaultVersion. If defaultVersion is 0, assumes the highest supported
+// version. Identifiers are tried in the order the client lists them.
+func ShouldSendSXGFor(header_value string, validIdentifiers []string, defaultVersion int64) (string, int64) {
 	reader := strings.NewReader(header_value)
 	identifiers, err := parseParameterisedList(reader)
 	if err != nil {
 		log.Printf("Failed to parse AMP-Cache-Transform %q with error %v\n", header_value, err)
 		return "", 0
 	}
+	for _, identifier := range identifiers {
+		if value, ok := identifier.params[versionParamName]; ok && !value.isString {
+			log.Printf("Failed to parse AMP-Cache-Transform %q with error non-string v param\n", header_value)
+			return "", 0
+		}
+	}
 
 IdentifierLoop:
 	for _, identifier := range identifiers {
-		if _, ok := validIdentifiers[identifier.id]; ok {
+		if contains(validIdentifiers, identifier.id) {
 			var requested []*rpb.VersionRange
-			for name, value := range identifier.params {
-				if name == versionParamName {
-					requested, err = parseVersions(value)
-					if err != nil {
-						log.Printf("Failed to parse versions from %q with error %v\n", header_value, err)
-						continue IdentifierLoop
-					}
-				} else {
-					log.Printf("Invalid param name %q in %q\n", name, header_value)
+			if defaultVersion != 0 {
+				requested = []*rpb.VersionRange{{Min: defaultVersion, Max: defaultVersion}}
+			}
+			// Params other than v are ignored, so that clients (or
+			// future versions of the spec) can add them without
+			// breaking negotiation.
+			if value, ok := identifier.params[versionParamName]; ok {
+				requested, err = parseVersions(value.value)
+				if err != nil {
+					log.Printf("Failed to parse versions from %q with error %v\n", header_value, err)
 					continue IdentifierLoop
 				}
 			}
@@ -306,3 +377,12 @@ IdentifierLoop:
 	}
 	return "", 0
 }
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -55,6 +55,13 @@ func TestShouldSendSXG(t *testing.T) {
 	assert.Equal(t, `google;v="1"`, header(ShouldSendSXG(`google;v="1,2..3,5"`)))
 	assert.Equal(t, `google;v="1"`, header(ShouldSendSXG(`google ; v="1"`)))
 
+	// Unknown params are ignored.
+	assert.Equal(t, `google;v="1"`, header(ShouldSendSXG(`google;foo=bar`)))
+	assert.Equal(t, `google;v="1"`, header(ShouldSendSXG(`google;x="1",any`)))
+	assert.Equal(t, `google;v="1"`, header(ShouldSendSXG(`google;foo=bar;v="1"`)))
+	assert.Equal(t, `google;v="1"`, header(ShouldSendSXG(`google;v="1..2";foo=12;bar=?1, any`)))
+	assert.Equal(t, "", header(ShouldSendSXG(`google;foo=bar;v="2"`)))
+
 	// Version spec parse failure.
 	assert.Equal(t, "", header(ShouldSendSXG(`google;`)))
 	assert.Equal(t, "", header(ShouldSendSXG(`google;v=`)))
@@ -72,6 +79,10 @@ func TestShouldSendSXG(t *testing.T) {
 	assert.Equal(t, "", header(ShouldSendSXG(`google;v="\a",any`)))
 	assert.Equal(t, "", header(ShouldSendSXG(`google;v="\1",any`)))
 	assert.Equal(t, "", header(ShouldSendSXG("google;v=\"\t\",any")))
+	assert.Equal(t, "", header(ShouldSendSXG(`google;foo=`)))
+	assert.Equal(t, "", header(ShouldSendSXG(`google;foo=b"ar`)))
+	assert.Equal(t, "", header(ShouldSendSXG(`google;foo`)))
+	assert.Equal(t, "", header(ShouldSendSXG(`foo;v=1, google`)))
 
 	// Version spec semantic failure or mismatch.
 	assert.Equal(t, "", header(ShouldSendSXG(`google;v="2"`)))
@@ -81,7 +92,6 @@ func TestShouldSendSXG(t *testing.T) {
 	assert.Equal(t, `any;v="1"`, header(ShouldSendSXG(`google;v="1,-1",any`)))
 	assert.Equal(t, `any;v="1"`, header(ShouldSendSXG(`google;v="1..2,2..3",any`)))
 	assert.Equal(t, `any;v="1"`, header(ShouldSendSXG(`google;v="1..\"2",any`)))
-	assert.Equal(t, `any;v="1"`, header(ShouldSendSXG(`google;x="1",any`)))
 	assert.Equal(t, `google;v="1"`, header(ShouldSendSXG(`google;v="2",google`)))
 }
 
@@ -93,3 +103,39 @@ func TestShouldSendSXG_Version(t *testing.T) {
 	assert.Equal(t, int64(1), version(ShouldSendSXG(`google;v="1"`)))
 	assert.Equal(t, int64(2), version(ShouldSendSXG(`google;v="2"`)))
 }
+
+func TestShouldSendSXGFor_DefaultVersion(t *testing.T) {
+	orig := transformer.SupportedVersions
+	defer func() { transformer.SupportedVersions = orig }()
+	transformer.SupportedVersions = []*rpb.VersionRange{{Max: 2, Min: 1}}
+
+	assert.Equal(t, `google;v="2"`, header(ShouldSendSXGFor("google", DefaultIdentifiers, 0)))
+	assert.Equal(t, `google;v="1"`, header(ShouldSendSXGFor("google", DefaultIdentifiers, 1)))
+	assert.Equal(t, `any;v="1"`, header(ShouldSendSXGFor("any", DefaultIdentifiers, 1)))
+	// An explicit v param overrides the default.
+	assert.Equal(t, `google;v="2"`, header(ShouldSendSXGFor(`google;v="2"`, DefaultIdentifiers, 1)))
+	// An unsupported default is treated like an unsupported v param.
+	assert.Equal(t, "", header(ShouldSendSXGFor("google", DefaultIdentifiers, 3)))
+}
+
+func TestShouldSendSXGFor_Identifiers(t *testing.T) {
+	orig := transformer.SupportedVersions
+	defer func() { transformer.SupportedVersions = orig }()
+	transformer.SupportedVersions = []*rpb.VersionRange{{Max: 1, Min: 1}}
+
+	ids := []string{"bing", "google"}
+	assert.Equal(t, `bing;v="1"`, header(ShouldSendSXGFor("bing", ids, 0)))
+	assert.Equal(t, `google;v="1"`, header(ShouldSendSXGFor("foo, google, bing", ids, 0)))
+	assert.Equal(t, `bing;v="1"`, header(ShouldSendSXGFor(`google;v="2", bing`, ids, 0)))
+	assert.Equal(t, "", header(ShouldSendSXGFor("any", ids, 0)))
+	assert.Equal(t, "", header(ShouldSendSXGFor("foo, cloudflare", ids, 0)))
+	assert.Equal(t, "", header(ShouldSendSXGFor("bing", nil, 0)))
+}
+
+func TestIsValidIdentifier(t *testing.T) {
+	assert.True(t, IsValidIdentifier("google"))
+	assert.True(t, IsValidIdentifier("a*b-c_d/e"))
+	assert.False(t, IsValidIdentifier(""))
+	assert.False(t, IsValidIdentifier("Google"))
+	assert.False(t, IsValidIdentifier("google bing"))
+}
@@ -55,6 +55,8 @@ type CertCache struct {
 	// TODO(twifkak): Support multiple cert chains (for different domains, for different roots).
 	certName          string
 	certs             []*x509.Certificate
+	// If non-empty, the required value of the cert URL's version param.
+	urlVersion        string
 	ocspUpdateAfterMu sync.RWMutex
 	ocspUpdateAfter   time.Time
 	// TODO(twifkak): Implement a registry of Updateable instances which can be configured in the toml.
@@ -103,6 +105,13 @@ func New(certs []*x509.Certificate, ocspCache string) *CertCache {
 	}
 }
 
+// Sets the version that cert URLs carry (see signer.Options.CertURLVersion).
+// Requests for the cert with a different version get a 404. Must be called
+// before serving.
+func (this *CertCache) SetURLVersion(version string) {
+	this.urlVersion = version
+}
+
 func (this *CertCache) Init(stop chan struct{}) error {
 	// Prime the OCSP disk and memory cache, so we can start serving immediately.
 	_, _, err := this.readOCSP()
@@ -145,7 +154,10 @@ func (this *CertCache) ocspMidpoint(bytes []byte, issuer *x509.Certificate) (tim
 }
 
 func (this *CertCache) ServeHTTP(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if params.ByName("certName") == this.certName {
+	if version := req.URL.Query().Get(util.CertURLVersionParam); this.urlVersion != "" && version != this.urlVersion {
+		// As below, the version may be bumped to this one.
+		util.NewHTTPError(http.StatusNotFound, "Unknown cert version: ", version).LogAndRespond(resp)
+	} else if params.ByName("certName") == this.certName {
 		// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-3.3
 		// This content-type is not standard, but included to reduce
 		// the chance that faulty user agents employ content sniffing.
@@ -162,6 +174,10 @@ func (this *CertCache) ServeHTTP(resp http.ResponseWriter, req *http.Request, pa
 			util.NewHTTPError(http.StatusInternalServerError, "Error computing OCSP midpoint: ", err).LogAndRespond(resp)
 			return
 		}
+		// Nor should it be cached past the cert's own expiry.
+		if notAfter := this.certs[0].NotAfter; notAfter.Before(midpoint) {
+			midpoint = notAfter
+		}
 		// int is large enough to represent 24855 days in seconds.
 		expiry := int(midpoint.Sub(time.Now()).Seconds())
 		if expiry < 0 {
@@ -177,7 +193,9 @@ func (this *CertCache) ServeHTTP(resp http.ResponseWriter, req *http.Request, pa
 		}
 		http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(cbor))
 	} else {
-		http.NotFound(resp, req)
+		// Don't let intermediaries cache the 404, as the cert may be
+		// rotated to one with this name.
+		util.NewHTTPError(http.StatusNotFound, "Unknown cert name: ", params.ByName("certName")).LogAndRespond(resp)
 	}
 }
 
@@ -190,8 +208,12 @@ func (this *CertCache) ServeHTTP(resp http.ResponseWriter, req *http.Request, pa
 //    What happens when it's been 7 days, no new OCSP response can be obtained,
 //    and the current response is about to expire?
 func (this *CertCache) IsHealthy() bool {
-	ocsp, _, err := this.readOCSP()
-	return err != nil || this.isHealthy(ocsp)
+	// readOCSP fails if the OCSP response is missing or fails isHealthy.
+	if _, _, err := this.readOCSP(); err != nil {
+		log.Println("CertCache is unhealthy:", err)
+		return false
+	}
+	return true
 }
 
 func (this *CertCache) isHealthy(ocspResp []byte) bool {
@@ -428,3 +450,76 @@ func (this *CertCache) fetchOCSP(orig []byte, ocspUpdateAfter *time.Time) []byte
 	}
 	return respBytes
 }
+
+// Reloadable serves the cert chain of a CertCache that may be replaced while
+// running, e.g. when the cert is renewed. The previous chain continues to be
+// served at its cert URL, as exchanges signed with it remain valid until they
+// expire.
+type Reloadable struct {
+	ocspCache  string
+	urlVersion string
+
+	mu       sync.RWMutex
+	current  *CertCache
+	previous *CertCache
+	// Stops the OCSP maintenance of current and previous, respectively.
+	currentStop, previousStop chan struct{}
+
+	// "Virtual method", exposed for testing. Returns an uninitialized
+	// CertCache for the given chain.
+	newCertCache func(certs []*x509.Certificate, ocspCache string) *CertCache
+}
+
+// Must call Load() on the returned Reloadable before you can use it. The
+// ocspCache and urlVersion are as for New and SetURLVersion.
+func NewReloadable(ocspCache string, urlVersion string) *Reloadable {
+	return &Reloadable{ocspCache: ocspCache, urlVersion: urlVersion, newCertCache: New}
+}
+
+// Load initializes a CertCache for the given chain (fetching its OCSP response
+// if necessary), and begins serving it. On error, the chain in use (if any)
+// remains so.
+func (this *Reloadable) Load(certs []*x509.Certificate) error {
+	next := this.newCertCache(certs, this.ocspCache)
+	next.SetURLVersion(this.urlVersion)
+	stop := make(chan struct{})
+	if err := next.Init(stop); err != nil {
+		close(stop)
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.previousStop != nil {
+		close(this.previousStop)
+	}
+	this.previous, this.previousStop = this.current, this.currentStop
+	this.current, this.currentStop = next, stop
+	return nil
+}
+
+// IsHealthy is as CertCache.IsHealthy, for the current chain.
+func (this *Reloadable) IsHealthy() bool {
+	this.mu.RLock()
+	certCache := this.current
+	this.mu.RUnlock()
+	return certCache.IsHealthy()
+}
+
+// Serves returns true if the given cert name (see util.CertName) is that of the
+// current or previous chain, i.e. if ServeHTTP would serve it.
+func (this *Reloadable) Serves(certName string) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.current.certName == certName || (this.previous != nil && this.previous.certName == certName)
+}
+
+func (this *Reloadable) ServeHTTP(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	this.mu.RLock()
+	certCache := this.current
+	if this.previous != nil && params.ByName("certName") == this.previous.certName {
+		certCache = this.previous
+	}
+	this.mu.RUnlock()
+	certCache.ServeHTTP(resp, req, params)
+}
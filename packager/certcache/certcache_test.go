@@ -15,15 +15,22 @@
 package certcache
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -49,9 +56,13 @@ var caKey = func() *rsa.PrivateKey {
 }()
 
 func FakeOCSPResponse(thisUpdate time.Time) ([]byte, error) {
+	return fakeOCSPResponseFor(pkgt.Certs[0], thisUpdate)
+}
+
+func fakeOCSPResponseFor(cert *x509.Certificate, thisUpdate time.Time) ([]byte, error) {
 	template := ocsp.Response{
 		Status:           ocsp.Good,
-		SerialNumber:     pkgt.Certs[0].SerialNumber,
+		SerialNumber:     cert.SerialNumber,
 		ThisUpdate:       thisUpdate,
 		NextUpdate:       thisUpdate.Add(7 * 24 * time.Hour),
 		RevokedAt:        thisUpdate.AddDate( /*years=*/ 0 /*months=*/, 0 /*days=*/, 365),
@@ -74,7 +85,14 @@ type CertCacheSuite struct {
 
 func (this *CertCacheSuite) New() (*CertCache, error) {
 	// TODO(twifkak): Stop the old CertCache's goroutine.
-	certCache := New(pkgt.Certs, filepath.Join(this.tempDir, "ocsp"))
+	certCache := this.newCertCache(pkgt.Certs, filepath.Join(this.tempDir, "ocsp"))
+	err := certCache.Init(this.stop)
+	return certCache, err
+}
+
+// Returns an uninitialized CertCache that fetches OCSP from the fake server.
+func (this *CertCacheSuite) newCertCache(certs []*x509.Certificate, ocspCache string) *CertCache {
+	certCache := New(certs, ocspCache)
 	certCache.extractOCSPServer = func(*x509.Certificate) (string, error) {
 		return this.ocspServer.URL, nil
 	}
@@ -86,8 +104,27 @@ func (this *CertCacheSuite) New() (*CertCache, error) {
 			return defaultHttpExpiry(req, resp)
 		}
 	}
-	err := certCache.Init(this.stop)
-	return certCache, err
+	return certCache
+}
+
+// Returns a new leaf cert issued by caCert.
+func (this *CertCacheSuite) newLeafCert() *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	this.Require().NoError(err, "generating key")
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	this.Require().NoError(err, "generating serial number")
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: "amppackageexample.com"},
+		DNSNames:     []string{"amppackageexample.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, caCert, &key.PublicKey, caKey)
+	this.Require().NoError(err, "creating cert")
+	cert, err := x509.ParseCertificate(der)
+	this.Require().NoError(err, "parsing cert")
+	return cert
 }
 
 func (this *CertCacheSuite) SetupSuite() {
@@ -170,6 +207,9 @@ func (this *CertCacheSuite) DecodeCBOR(r io.Reader) map[string][]byte {
 func (this *CertCacheSuite) TestServesCertificate() {
 	resp := pkgt.GetP(this.T(), this.handler, "/amppkg/cert/"+pkgt.CertName, httprouter.Params{httprouter.Param{"certName", pkgt.CertName}})
 	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/cert-chain+cbor", resp.Header.Get("Content-Type"))
+	this.Assert().Regexp(`^public, max-age=\d+$`, resp.Header.Get("Cache-Control"))
+	this.Assert().Equal(`"`+pkgt.CertName+`"`, resp.Header.Get("ETag"))
 	this.Assert().Equal("nosniff", resp.Header.Get("X-Content-Type-Options"))
 	cbor := this.DecodeCBOR(resp.Body)
 	this.Assert().Contains(cbor, "cert")
@@ -180,11 +220,29 @@ func (this *CertCacheSuite) TestServesCertificate() {
 func (this *CertCacheSuite) TestServes404OnMissingCertificate() {
 	resp := pkgt.GetP(this.T(), this.handler, "/amppkg/cert/lalala", httprouter.Params{httprouter.Param{"certName", "lalala"}})
 	this.Assert().Equal(http.StatusNotFound, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+	this.Assert().NotEqual("application/cert-chain+cbor", resp.Header.Get("Content-Type"))
 	body, _ := ioutil.ReadAll(resp.Body)
 	// Small enough not to fit a cert or key:
 	this.Assert().Condition(func() bool { return len(body) <= 20 }, "body too large: %q", body)
 }
 
+func (this *CertCacheSuite) TestURLVersion() {
+	this.handler.SetURLVersion("2 b")
+	params := httprouter.Params{httprouter.Param{"certName", pkgt.CertName}}
+
+	resp := pkgt.GetP(this.T(), this.handler, "/amppkg/cert/"+pkgt.CertName+"?v=2+b", params)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	cbor := this.DecodeCBOR(resp.Body)
+	this.Assert().Contains(cbor, "cert")
+
+	for _, target := range []string{"/amppkg/cert/" + pkgt.CertName, "/amppkg/cert/" + pkgt.CertName + "?v=1"} {
+		resp = pkgt.GetP(this.T(), this.handler, target, params)
+		this.Assert().Equal(http.StatusNotFound, resp.StatusCode, "incorrect status for %s: %#v", target, resp)
+		this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+	}
+}
+
 func (this *CertCacheSuite) TestOCSP() {
 	// Verify it gets included in the cert-chain+cbor payload.
 	resp := pkgt.GetP(this.T(), this.handler, "/amppkg/cert/"+pkgt.CertName, httprouter.Params{httprouter.Param{"certName", pkgt.CertName}})
@@ -301,6 +359,88 @@ func (this *CertCacheSuite) TestOCSPIgnoreInvalidUpdate() {
 	this.Assert().Equal(staleOCSP, ocsp)
 }
 
+func (this *CertCacheSuite) TestIsHealthy() {
+	this.Assert().True(this.handler.IsHealthy())
+
+	// Fail closed when the only available OCSP response has expired.
+	err := os.Remove(filepath.Join(this.tempDir, "ocsp"))
+	this.Require().NoError(err, "deleting OCSP tempfile")
+	this.fakeOCSP, err = FakeOCSPResponse(time.Now().Add(-8 * 24 * time.Hour))
+	this.Require().NoError(err, "creating expired OCSP response")
+	this.handler, err = this.New()
+	this.Require().Error(err, "reinstantiating CertCache")
+	this.Assert().False(this.handler.IsHealthy())
+
+	// ... or when the OCSP responder gives junk.
+	this.ocspHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("junk"))
+	}
+	this.Assert().False(this.handler.IsHealthy())
+
+	// Recover once a valid response is available.
+	this.fakeOCSP, err = FakeOCSPResponse(time.Now())
+	this.Require().NoError(err, "creating fresh OCSP response")
+	this.ocspHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write(this.fakeOCSP)
+	}
+	this.Assert().True(this.handler.IsHealthy())
+}
+
+func (this *CertCacheSuite) TestReloadable() {
+	reloadable := NewReloadable(filepath.Join(this.tempDir, "ocsp"), "")
+	reloadable.newCertCache = this.newCertCache
+	this.Require().NoError(reloadable.Load(pkgt.Certs))
+	get := func(certName string) *http.Response {
+		return pkgt.GetP(this.T(), reloadable, "/amppkg/cert/"+certName, httprouter.Params{httprouter.Param{"certName", certName}})
+	}
+
+	newCerts := []*x509.Certificate{this.newLeafCert(), caCert}
+	newCertName := util.CertName(newCerts[0])
+	resp := get(newCertName)
+	this.Assert().Equal(http.StatusNotFound, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().True(reloadable.Serves(pkgt.CertName))
+	this.Assert().False(reloadable.Serves(newCertName))
+
+	// Respond with OCSP for whichever cert is requested.
+	this.ocspHandler = func(resp http.ResponseWriter, req *http.Request) {
+		reqBytes, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.URL.Path, "/"))
+		this.Require().NoError(err, "decoding OCSP request")
+		ocspReq, err := ocsp.ParseRequest(reqBytes)
+		this.Require().NoError(err, "parsing OCSP request")
+		cert := pkgt.Certs[0]
+		if ocspReq.SerialNumber.Cmp(newCerts[0].SerialNumber) == 0 {
+			cert = newCerts[0]
+		}
+		ocspResp, err := fakeOCSPResponseFor(cert, time.Now())
+		this.Require().NoError(err, "creating fake OCSP response")
+		resp.Write(ocspResp)
+	}
+	this.Require().NoError(reloadable.Load(newCerts))
+	this.Assert().True(reloadable.IsHealthy())
+	resp = get(newCertName)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	cbor := this.DecodeCBOR(resp.Body)
+	this.Assert().Equal(newCerts[0].Raw, cbor["cert"])
+	_, err := ocsp.ParseResponseForCert(cbor["ocsp"], newCerts[0], caCert)
+	this.Assert().NoError(err)
+
+	// The previous chain is still served, for exchanges signed with it.
+	this.Assert().True(reloadable.Serves(newCertName))
+	this.Assert().True(reloadable.Serves(pkgt.CertName))
+	resp = get(pkgt.CertName)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(pkgt.Certs[0].Raw, this.DecodeCBOR(resp.Body)["cert"])
+
+	// A chain whose OCSP can't be fetched is rejected, leaving the current one
+	// in use.
+	this.ocspHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("junk"))
+	}
+	this.Assert().Error(reloadable.Load([]*x509.Certificate{this.newLeafCert(), caCert}))
+	resp = get(newCertName)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
 func TestCertCacheSuite(t *testing.T) {
 	suite.Run(t, new(CertCacheSuite))
 }
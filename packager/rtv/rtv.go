@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"regexp"
 	"sync"
 	"time"
 
@@ -20,6 +21,9 @@ const (
 // not a const for testing purposes
 var rtvHost = "https://cdn.ampproject.org"
 
+// The format of an AMP runtime version, e.g. 011907311947510.
+var rtvFormat = regexp.MustCompile(`^[0-9]{15}$`)
+
 // rtvData stores the AMP runtime version number and the CSS for that version
 // Note: fields must be exported for json unmarshaling.
 type rtvData struct {
@@ -28,28 +32,89 @@ type rtvData struct {
 	CanaryPercentage, CSS string
 }
 
+// Options configures an RTVCache.
+type Options struct {
+	// How often the cron job re-fills the cache. Defaults to hourly.
+	RefreshInterval time.Duration
+	// If true, the cache remains healthy after a failed refresh, serving
+	// the last good values. Otherwise, the last good values are still
+	// served, but IsHealthy returns false until a refresh succeeds.
+	StaleWhileError bool
+	// If non-empty, the AMP runtime version to always use, e.g. to
+	// reproduce signed exchanges. Its CSS is fetched once, on
+	// construction, and the cache is never refreshed.
+	PinnedRTV string
+	// If true, New succeeds even if the initial refresh fails, leaving the
+	// cache unpopulated (see IsPopulated) until a later refresh succeeds.
+	// Otherwise, New returns the error.
+	AllowColdStart bool
+	// If positive, the cached values are refreshed synchronously by the
+	// first GetRTV or GetCSS after they are this old (since the last
+	// successful refresh), in case the cron job has fallen behind or keeps
+	// failing. If that refresh fails, the stale values are still served.
+	// Ignored with PinnedRTV.
+	MaxAge time.Duration
+}
+
 type RTVCache struct {
 	d  *rtvData
 	c  http.Client
 	lk sync.Mutex
 	stop chan struct{}
+
+	options Options
+	// The error from the last poll, guarded by lk.
+	lastErr error
+	// If non-nil, closed when the in-flight poll started by WaitPopulated
+	// completes. Guarded by lk.
+	polling chan struct{}
+	// When the last poll succeeded, guarded by lk.
+	refreshed time.Time
+	// Serializes the synchronous refreshes enforced by MaxAge.
+	refreshLk sync.Mutex
+	nowFunc   func() time.Time
 }
 
 // New returns a new cache for storing AMP runtime values, or an
 // error if there was a problem initializing. To have it auto-refresh,
 // call StartCron().
-func New() (*RTVCache, error) {
-	r := &RTVCache{c: http.Client{Timeout: defaultHTTPTimeout}, d: &rtvData{}, stop: make(chan struct{})}
+func New(options Options) (*RTVCache, error) {
+	if options.RefreshInterval == 0 {
+		options.RefreshInterval = defaultPollInterval
+	} else if options.RefreshInterval < 0 {
+		return nil, errors.Errorf("refresh interval %s is negative", options.RefreshInterval)
+	}
+	if options.MaxAge < 0 {
+		return nil, errors.Errorf("max age %s is negative", options.MaxAge)
+	}
+	r := &RTVCache{c: http.Client{Timeout: defaultHTTPTimeout}, d: &rtvData{}, stop: make(chan struct{}), options: options, nowFunc: time.Now}
+	if options.PinnedRTV != "" {
+		if !rtvFormat.MatchString(options.PinnedRTV) {
+			return nil, errors.Errorf("pinned RTV %q is not 15 digits", options.PinnedRTV)
+		}
+		d := &rtvData{RTV: options.PinnedRTV, CSSURL: rtvHost + "/rtv/" + options.PinnedRTV + "/v0.css"}
+		b, err := getRTVBody(r.c, d.CSSURL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching CSS for pinned RTV %s", options.PinnedRTV)
+		}
+		d.CSS = string(b)
+		r.d = d
+		return r, nil
+	}
 	if err := r.poll(); err != nil {
-		return nil, err
+		if !options.AllowColdStart {
+			return nil, err
+		}
+		log.Println("Starting with an empty RTV cache:", err)
 	}
 	return r, nil
 }
 
-// StartCron starts a cron job to re-fill the RTVCache hourly.
+// StartCron starts a cron job to re-fill the RTVCache every
+// RefreshInterval.
 func (r *RTVCache) StartCron() {
 	go func() {
-		ticker := time.NewTicker(defaultPollInterval)
+		ticker := time.NewTicker(r.options.RefreshInterval)
 
 		for {
 			select {
@@ -75,19 +140,98 @@ func (r *RTVCache) getRTVData() *rtvData {
 	return r.d
 }
 
+// getFreshRTVData returns the cached rtvData, first refreshing it if it's
+// older than MaxAge.
+func (r *RTVCache) getFreshRTVData() *rtvData {
+	if r.options.MaxAge > 0 && r.options.PinnedRTV == "" && r.IsPopulated() {
+		r.refreshLk.Lock()
+		// Concurrent callers may have refreshed it while this one waited.
+		if r.isExpired() {
+			if err := r.poll(); err != nil {
+				log.Println("Serving stale RTV after failed refresh:", err)
+			}
+		}
+		r.refreshLk.Unlock()
+	}
+	return r.getRTVData()
+}
+
+// isExpired returns true if the last successful refresh was at least MaxAge
+// ago.
+func (r *RTVCache) isExpired() bool {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.nowFunc().Sub(r.refreshed) >= r.options.MaxAge
+}
+
 // GetRTV returns the cached value for the runtime version.
 func (r *RTVCache) GetRTV() string {
-	return r.getRTVData().RTV
+	return r.getFreshRTVData().RTV
 }
 
 // GetCSS returns the cached value for the inline CSS.
 func (r *RTVCache) GetCSS() string {
-	return r.getRTVData().CSS
+	return r.getFreshRTVData().CSS
+}
+
+// IsPopulated returns true if the cache holds a runtime version, i.e. it has
+// been successfully polled at least once.
+func (r *RTVCache) IsPopulated() bool {
+	d := r.getRTVData()
+	return d != nil && d.RTV != ""
+}
+
+// WaitPopulated returns true if the cache is populated. If it isn't, and
+// timeout is positive, it refreshes the cache, waiting at most timeout for the
+// refresh to succeed. Concurrent callers share a single refresh, which
+// continues in the background after a timeout.
+func (r *RTVCache) WaitPopulated(timeout time.Duration) bool {
+	if r.IsPopulated() || timeout <= 0 {
+		return r.IsPopulated()
+	}
+	r.lk.Lock()
+	if r.polling == nil {
+		done := make(chan struct{})
+		r.polling = done
+		go func() {
+			r.poll() // Ignores error return.
+			r.lk.Lock()
+			r.polling = nil
+			r.lk.Unlock()
+			close(done)
+		}()
+	}
+	done := r.polling
+	r.lk.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+	return r.IsPopulated()
+}
+
+// IsHealthy returns true if the cache is populated and, unless
+// StaleWhileError is set, its last refresh succeeded.
+func (r *RTVCache) IsHealthy() bool {
+	r.lk.Lock()
+	lastErr := r.lastErr
+	r.lk.Unlock()
+	return r.IsPopulated() && (r.options.StaleWhileError || lastErr == nil)
 }
 
 // poll attempts to re-populate the RTVCache, returning an error if there
-// were any problems.
-func (r *RTVCache) poll() error {
+// were any problems. The error is recorded for IsHealthy.
+func (r *RTVCache) poll() (err error) {
+	defer func() {
+		r.lk.Lock()
+		defer r.lk.Unlock()
+		r.lastErr = err
+	}()
+	if r.options.PinnedRTV != "" {
+		return nil
+	}
 	// Fetch the runtime metadata
 	d, err := getMetadata(r)
 	if err != nil {
@@ -95,7 +239,10 @@ func (r *RTVCache) poll() error {
 	}
 
 	// If the value is unchanged, skip CSS call
-	if d.RTV == r.GetRTV() {
+	if d.RTV == r.getRTVData().RTV {
+		r.lk.Lock()
+		defer r.lk.Unlock()
+		r.refreshed = r.nowFunc()
 		return nil
 	}
 
@@ -111,6 +258,7 @@ func (r *RTVCache) poll() error {
 	r.lk.Lock()
 	defer r.lk.Unlock()
 	r.d = d
+	r.refreshed = r.nowFunc()
 	return nil
 }
 
@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -73,14 +74,19 @@ func TestRTVTestSuite(t *testing.T) {
 }
 
 func (t *RTVTestSuite) TestNew() {
-	r, err := New()
+	r, err := New(Options{})
 	assert.NoError(t.T(), err)
 	assert.Equal(t.T(), rtv, r.GetRTV())
 	assert.Equal(t.T(), css, r.GetCSS())
+	assert.True(t.T(), r.IsPopulated())
+}
+
+func (t *RTVTestSuite) TestIsPopulated() {
+	assert.False(t.T(), (&RTVCache{}).IsPopulated())
 }
 
 func (t *RTVTestSuite) TestRTVPollSameValue() {
-	r, err := New()
+	r, err := New(Options{})
 	assert.NoError(t.T(), err)
 
 	err = r.poll()
@@ -96,12 +102,33 @@ func (t *RTVTestSuite) TestRTVPollErrorOnInit() {
 		w.WriteHeader(500)
 	}
 
-	_, err := New()
+	_, err := New(Options{})
 	assert.Error(t.T(), err)
 }
 
+func (t *RTVTestSuite) TestAllowColdStart() {
+	t.f.rtvHandler = func(f *fakeServer, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}
+
+	r, err := New(Options{AllowColdStart: true})
+	assert.NoError(t.T(), err)
+	assert.False(t.T(), r.IsPopulated())
+	assert.Equal(t.T(), "", r.GetRTV())
+
+	// Without a timeout, the cache isn't refreshed.
+	assert.False(t.T(), r.WaitPopulated(0))
+	assert.Equal(t.T(), 1, t.f.rtvCalls)
+
+	t.f.rtvHandler = defaultRTVHandler
+	assert.True(t.T(), r.WaitPopulated(10*time.Second))
+	assert.Equal(t.T(), rtv, r.GetRTV())
+	assert.Equal(t.T(), css, r.GetCSS())
+	assert.Equal(t.T(), 2, t.f.rtvCalls)
+}
+
 func (t *RTVTestSuite) TestRTVPollSkipsCSSOnError() {
-	r, err := New()
+	r, err := New(Options{})
 	assert.NoError(t.T(), err)
 
 	// Set up the next call to error out.
@@ -120,7 +147,7 @@ func (t *RTVTestSuite) TestRTVPollSkipsCSSOnError() {
 }
 
 func (t *RTVTestSuite) TestRTVPollRollback() {
-	r, err := New()
+	r, err := New(Options{})
 	assert.NoError(t.T(), err)
 
 	t.f.rtvHandler = func(f *fakeServer, w http.ResponseWriter, r *http.Request) {
@@ -141,8 +168,105 @@ func (t *RTVTestSuite) TestRTVPollRollback() {
 	assert.Equal(t.T(), 2, t.f.cssCalls)
 }
 
+func (t *RTVTestSuite) TestRefreshFailure() {
+	for _, staleWhileError := range []bool{false, true} {
+		t.f.rtvHandler = defaultRTVHandler
+		r, err := New(Options{StaleWhileError: staleWhileError})
+		assert.NoError(t.T(), err)
+		assert.True(t.T(), r.IsHealthy())
+
+		t.f.rtvHandler = func(f *fakeServer, w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(500)
+		}
+		assert.Error(t.T(), r.poll())
+		// The last good values are served either way.
+		assert.Equal(t.T(), rtv, r.GetRTV())
+		assert.Equal(t.T(), css, r.GetCSS())
+		assert.Equal(t.T(), staleWhileError, r.IsHealthy(), "StaleWhileError=%t", staleWhileError)
+
+		// A successful refresh restores health.
+		t.f.rtvHandler = defaultRTVHandler
+		assert.NoError(t.T(), r.poll())
+		assert.True(t.T(), r.IsHealthy())
+	}
+}
+
+func (t *RTVTestSuite) TestRefreshInterval() {
+	_, err := New(Options{RefreshInterval: -time.Second})
+	assert.Error(t.T(), err)
+
+	r, err := New(Options{RefreshInterval: 10 * time.Millisecond})
+	assert.NoError(t.T(), err)
+	r.StartCron()
+	time.Sleep(100 * time.Millisecond)
+	r.StopCron()
+	assert.True(t.T(), t.f.rtvCalls > 2, "polled %d times", t.f.rtvCalls)
+}
+
+func (t *RTVTestSuite) TestMaxAge() {
+	_, err := New(Options{MaxAge: -time.Second})
+	assert.Error(t.T(), err)
+
+	r, err := New(Options{MaxAge: time.Hour})
+	assert.NoError(t.T(), err)
+	now := time.Now()
+	r.nowFunc = func() time.Time { return now }
+	assert.Equal(t.T(), 1, t.f.rtvCalls)
+
+	// Within the max age, the cached values are served as is.
+	now = now.Add(59 * time.Minute)
+	assert.Equal(t.T(), rtv, r.GetRTV())
+	assert.Equal(t.T(), css, r.GetCSS())
+	assert.Equal(t.T(), 1, t.f.rtvCalls)
+
+	// Past it, they're refreshed before use.
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t.T(), rtv, r.GetRTV())
+	assert.Equal(t.T(), 2, t.f.rtvCalls)
+	// The refresh resets the age.
+	assert.Equal(t.T(), css, r.GetCSS())
+	assert.Equal(t.T(), 2, t.f.rtvCalls)
+
+	// A failed refresh still serves the stale values, and is retried on
+	// the next use.
+	t.f.rtvHandler = func(f *fakeServer, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}
+	now = now.Add(2 * time.Hour)
+	assert.Equal(t.T(), rtv, r.GetRTV())
+	assert.Equal(t.T(), 3, t.f.rtvCalls)
+	assert.Equal(t.T(), css, r.GetCSS())
+	assert.Equal(t.T(), 4, t.f.rtvCalls)
+}
+
+func (t *RTVTestSuite) TestPinnedRTV() {
+	const pinned = "011907311947510"
+	var cssPath string
+	t.f.cssHandler = func(f *fakeServer, w http.ResponseWriter, r *http.Request) {
+		cssPath = r.URL.Path
+		fmt.Fprint(w, "pinned css")
+	}
+	r, err := New(Options{PinnedRTV: pinned})
+	assert.NoError(t.T(), err)
+	assert.Equal(t.T(), pinned, r.GetRTV())
+	assert.Equal(t.T(), "pinned css", r.GetCSS())
+	assert.Equal(t.T(), "/rtv/"+pinned+"/v0.css", cssPath)
+
+	// Refreshes don't hit the network.
+	assert.NoError(t.T(), r.poll())
+	assert.Equal(t.T(), pinned, r.GetRTV())
+	assert.Equal(t.T(), 0, t.f.rtvCalls)
+	assert.Equal(t.T(), 1, t.f.cssCalls)
+	assert.True(t.T(), r.IsHealthy())
+
+	for _, malformed := range []string{"1234", "01190731194751a", "0119073119475100"} {
+		_, err := New(Options{PinnedRTV: malformed})
+		assert.EqualError(t.T(), err, fmt.Sprintf("pinned RTV %q is not 15 digits", malformed))
+	}
+}
+
 func (t *RTVTestSuite) TestBadJSON() {
-	r, err := New()
+	r, err := New(Options{})
 	assert.NoError(t.T(), err)
 
 	tests := []struct {
@@ -0,0 +1,101 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache stores serialized signed exchanges, so that repeated requests for the
+// same document needn't re-fetch, re-transform, and re-sign it.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	// Returns the value stored under key, if present and unexpired.
+	Get(key string) ([]byte, bool)
+	// Stores val under key, until expiry.
+	Put(key string, val []byte, expiry time.Time)
+}
+
+type lruEntry struct {
+	key    string
+	val    []byte
+	expiry time.Time
+}
+
+// LRUCache is an in-memory Cache that evicts the least recently used entries
+// once it exceeds its max entry count or max total bytes.
+type LRUCache struct {
+	maxEntries int
+	maxBytes   int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	bytes   int
+	order   *list.List // Most recently used first.
+	entries map[string]*list.Element
+}
+
+// NewLRUCache returns an LRUCache holding at most maxEntries entries. If
+// maxBytes is positive, it additionally holds at most maxBytes of values.
+func NewLRUCache(maxEntries, maxBytes int) *LRUCache {
+	return &LRUCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		now:        time.Now,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+func (this *LRUCache) Get(key string) ([]byte, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	elem, ok := this.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if !this.now().Before(entry.expiry) {
+		this.remove(elem)
+		return nil, false
+	}
+	this.order.MoveToFront(elem)
+	return entry.val, true
+}
+
+func (this *LRUCache) Put(key string, val []byte, expiry time.Time) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if elem, ok := this.entries[key]; ok {
+		this.remove(elem)
+	}
+	if this.maxEntries <= 0 || (this.maxBytes > 0 && len(val) > this.maxBytes) {
+		return
+	}
+	this.entries[key] = this.order.PushFront(&lruEntry{key, val, expiry})
+	this.bytes += len(val)
+	for this.order.Len() > this.maxEntries || (this.maxBytes > 0 && this.bytes > this.maxBytes) {
+		this.remove(this.order.Back())
+	}
+}
+
+// Must be called with this.mu held.
+func (this *LRUCache) remove(elem *list.Element) {
+	entry := this.order.Remove(elem).(*lruEntry)
+	delete(this.entries, entry.key)
+	this.bytes -= len(entry.val)
+}
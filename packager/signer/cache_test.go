@@ -0,0 +1,82 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUCacheEvictsByCount(t *testing.T) {
+	cache := NewLRUCache(2, 0)
+	expiry := time.Now().Add(time.Hour)
+	cache.Put("a", []byte("1"), expiry)
+	cache.Put("b", []byte("2"), expiry)
+	_, ok := cache.Get("a") // Now b is least recently used.
+	assert.True(t, ok)
+	cache.Put("c", []byte("3"), expiry)
+
+	_, ok = cache.Get("b")
+	assert.False(t, ok)
+	val, ok := cache.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), val)
+	val, ok = cache.Get("c")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("3"), val)
+}
+
+func TestLRUCacheEvictsByBytes(t *testing.T) {
+	cache := NewLRUCache(10, 5)
+	expiry := time.Now().Add(time.Hour)
+	cache.Put("a", []byte("12"), expiry)
+	cache.Put("b", []byte("34"), expiry)
+	cache.Put("c", []byte("56"), expiry)
+	_, ok := cache.Get("a")
+	assert.False(t, ok)
+	_, ok = cache.Get("b")
+	assert.True(t, ok)
+
+	// Values larger than maxBytes aren't stored, and don't evict others.
+	cache.Put("d", []byte("123456"), expiry)
+	_, ok = cache.Get("d")
+	assert.False(t, ok)
+	_, ok = cache.Get("c")
+	assert.True(t, ok)
+
+	// Replacing a value updates the byte count.
+	cache.Put("b", []byte("3"), expiry)
+	cache.Put("e", []byte("7"), expiry)
+	for _, key := range []string{"b", "c", "e"} {
+		_, ok = cache.Get(key)
+		assert.True(t, ok, key)
+	}
+}
+
+func TestLRUCacheExpires(t *testing.T) {
+	now := time.Now()
+	cache := NewLRUCache(10, 0)
+	cache.now = func() time.Time { return now }
+	cache.Put("a", []byte("1"), now.Add(time.Minute))
+	_, ok := cache.Get("a")
+	assert.True(t, ok)
+
+	now = now.Add(time.Minute)
+	_, ok = cache.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.bytes)
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// debugExchange describes the exchange that would be produced for a dry-run
+// request (see Options.DebugEnabled). It must never include key material.
+type debugExchange struct {
+	FetchURL        string              `json:"fetch_url"`
+	SignURL         string              `json:"sign_url"`
+	RTV             string              `json:"rtv"`
+	SXGVersion      string              `json:"sxg_version"`
+	Link            string              `json:"link,omitempty"`
+	ResponseHeaders map[string][]string `json:"response_headers"`
+	StrippedHeaders []string            `json:"stripped_headers"`
+	Signature       debugSignature      `json:"signature"`
+
+	// The names of the upstream response headers, before any were
+	// stripped.
+	upstreamHeaders []string
+}
+
+type debugSignature struct {
+	Date        time.Time `json:"date"`
+	Expires     time.Time `json:"expires"`
+	CertURL     string    `json:"cert_url"`
+	ValidityURL string    `json:"validity_url"`
+	// The Signature header of the exchange, which is public.
+	Header string `json:"header"`
+}
+
+// Returns the names of the given headers, sorted.
+func sortedHeaderNames(header http.Header) []string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Sets StrippedHeaders to those upstream headers missing from
+// ResponseHeaders.
+func (this *debugExchange) computeStrippedHeaders() {
+	this.StrippedHeaders = []string{}
+	for _, name := range this.upstreamHeaders {
+		if _, ok := this.ResponseHeaders[name]; !ok {
+			this.StrippedHeaders = append(this.StrippedHeaders, name)
+		}
+	}
+}
+
+func writeDebugExchange(resp http.ResponseWriter, debug *debugExchange) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	if err := json.NewEncoder(resp).Encode(debug); err != nil {
+		log.Println("Error writing debug response:", err)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/rtv"
+)
+
+// Returns true if the RTV cache is healthy. A var so that tests, which use an
+// empty RTVCache, may stub it out.
+var isRTVHealthy = func(r *rtv.RTVCache) bool {
+	return r.IsHealthy()
+}
+
+type healthzStatus struct {
+	Healthy    bool      `json:"healthy"`
+	CertExpiry time.Time `json:"cert_expiry"`
+	Problems   []string  `json:"problems,omitempty"`
+}
+
+// Healthz returns a handler reporting whether the Signer can currently
+// produce valid signed exchanges: its certs (including Options.ExtraCerts)
+// must be unexpired, isOCSPHealthy
+// (e.g. CertCache.IsHealthy) must return true, and the RTV cache must be
+// healthy. It responds 200 if so, else 503, with a JSON status body
+// either way. Suitable for load balancer health checks.
+func (this *Signer) Healthz(isOCSPHealthy func() bool) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var status healthzStatus
+		now := this.nowFunc()
+		for i, cert := range this.certs() {
+			name := "cert"
+			if i > 0 {
+				name = fmt.Sprintf("extra cert %d", i-1)
+			}
+			// Report the earliest expiry, as that's when signing
+			// will first fail.
+			if i == 0 || cert.NotAfter.Before(status.CertExpiry) {
+				status.CertExpiry = cert.NotAfter
+			}
+			if now.Before(cert.NotBefore) {
+				status.Problems = append(status.Problems, name+" is not yet valid")
+			}
+			if !now.Before(cert.NotAfter) {
+				status.Problems = append(status.Problems, name+" is expired")
+			}
+		}
+		if !isOCSPHealthy() {
+			status.Problems = append(status.Problems, "OCSP response is missing or stale")
+		}
+		if !isRTVHealthy(this.rtvCache) {
+			status.Problems = append(status.Problems, "AMP runtime version is unknown or failed to refresh")
+		}
+		status.Healthy = len(status.Problems) == 0
+
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Header().Set("Cache-Control", "no-store")
+		if status.Healthy {
+			resp.WriteHeader(http.StatusOK)
+		} else {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(resp).Encode(status); err != nil {
+			log.Println("Error writing healthz response:", err)
+		}
+	})
+}
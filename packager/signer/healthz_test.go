@@ -0,0 +1,72 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/rtv"
+	pkgt "github.com/ampproject/amppackager/packager/testing"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getHealthz(t *testing.T, handler http.Handler) (*http.Response, healthzStatus) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	resp := rec.Result()
+	var status healthzStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	return resp, status
+}
+
+func TestHealthz(t *testing.T) {
+	defer func(orig func(*rtv.RTVCache) bool) { isRTVHealthy = orig }(isRTVHealthy)
+	rtvHealthy := true
+	isRTVHealthy = func(*rtv.RTVCache) bool { return rtvHealthy }
+	ocspHealthy := true
+
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", "example.com", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	signer, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{})
+	require.NoError(t, err)
+	// Within the test cert's validity.
+	signer.nowFunc = func() time.Time { return pkgt.Certs[0].NotBefore.Add(time.Hour) }
+	handler := signer.Healthz(func() bool { return ocspHealthy })
+
+	resp, status := getHealthz(t, handler)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.True(t, status.Healthy)
+	assert.Empty(t, status.Problems)
+	assert.True(t, pkgt.Certs[0].NotAfter.Equal(status.CertExpiry))
+
+	signer.nowFunc = func() time.Time { return pkgt.Certs[0].NotAfter.Add(time.Second) }
+	resp, status = getHealthz(t, handler)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.False(t, status.Healthy)
+	assert.Equal(t, []string{"cert is expired"}, status.Problems)
+
+	signer.nowFunc = func() time.Time { return pkgt.Certs[0].NotBefore.Add(time.Hour) }
+	ocspHealthy, rtvHealthy = false, false
+	resp, status = getHealthz(t, handler)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, []string{"OCSP response is missing or stale", "AMP runtime version is unknown or failed to refresh"}, status.Problems)
+}
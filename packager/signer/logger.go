@@ -0,0 +1,73 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Logger receives structured logs of the outcome of requests to the Signer,
+// e.g. for shipping to a log aggregator. Each kv is a list of alternating
+// string keys and values. Implementations must be safe for concurrent use.
+//
+// The Signer never passes request bodies or header values (such as cookies).
+type Logger interface {
+	Info(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// JSONLogger is a Logger that writes each entry as a JSON object to the
+// standard logger.
+type JSONLogger struct{}
+
+func (JSONLogger) Info(msg string, kv ...interface{}) {
+	logJSON("info", msg, kv)
+}
+
+func (JSONLogger) Error(msg string, kv ...interface{}) {
+	logJSON("error", msg, kv)
+}
+
+func logJSON(level, msg string, kv []interface{}) {
+	entry := map[string]interface{}{"level": level, "msg": msg}
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		var value interface{}
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		}
+		entry[key] = value
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding log entry %q: %v\n", msg, err)
+		return
+	}
+	log.Println(string(line))
+}
+
+// Returns the milliseconds elapsed since start, for logging latency.
+func millisSince(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
@@ -0,0 +1,387 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"crypto"
+	"crypto/x509"
+	"net/http"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange/mice"
+	"github.com/ampproject/amppackager/packager/util"
+	rpb "github.com/ampproject/amppackager/transformer/request"
+)
+
+// Options configures optional Signer behavior. The zero value of each field
+// preserves the default behavior, so callers need only set the fields they
+// care about.
+type Options struct {
+	// If true, log a warning when the fetched document lacks a
+	// <meta name=viewport>, which AMP requires.
+	WarnOnMissingViewport bool
+	// If true, proxy the document unsigned when it lacks a <meta
+	// name=viewport>, as it is likely invalid AMP.
+	ErrorOnMissingViewport bool
+	// If true, respond 400 to GET requests that carry a body, as these are
+	// malformed. Otherwise, the body is ignored, and the fetch/sign params
+	// are read only from the URL.
+	ErrorOnGETWithBody bool
+	// If non-empty, a request whose AMPPKG-Debug-Signed-Bytes header equals
+	// this secret causes the exact payload bytes (before MI encoding) and
+	// the Digest of its exchange to be passed to SignedBytesSink. This is for
+	// forensic debugging; the header should be stripped by any frontend
+	// accessible to untrusted clients.
+	DebugSignedBytesToken string
+	// Receives the payload and digest for debug requests (see
+	// DebugSignedBytesToken). Defaults to logging them.
+	SignedBytesSink func(signURL string, payload []byte, digest string)
+	// If true, respond 406 without fetching the document when the client's
+	// Accept header can't be satisfied with an SXG (e.g. it lists only
+	// text/html). Otherwise, the document is fetched and proxied unsigned,
+	// without being transformed. Only applies if headers are required.
+	ErrorOnUnsatisfiableAccept bool
+	// If true, proxy the document unsigned when the upstream sets
+	// X-Content-Type-Options to a value other than nosniff. Otherwise, the
+	// value is normalized to nosniff in the exchange.
+	ErrorOnNonNosniff bool
+	// If true, proxy the document unsigned when the upstream response
+	// varies on a request header not reflected in the exchange (e.g. Vary:
+	// Cookie), as the signed content may be wrong for some clients.
+	ErrorOnUnsupportedVary bool
+	// The MI encoding of the payload, from which the signature's integrity
+	// reference is derived. Defaults to mi-sha256-03, which is currently the
+	// only supported value.
+	MIEncoding mice.Encoding
+	// If true, omit the AMP runtime script (v0.js) from the Link preload
+	// header, e.g. because the AMP Cache serving the exchange preloads it
+	// specially.
+	ExcludeRuntimePreload bool
+	// The SXG versions (e.g. "b3") that may be produced. When the client
+	// accepts several of them, the highest is used. Defaults to
+	// accept.AcceptedSxgVersion.
+	Versions []string
+	// If non-nil, signed exchanges are stored here, keyed by the cert, the
+	// fetch and sign URLs, the AMP runtime version, the SXG and transform
+	// versions, and the values of any ForwardedHeaders. Requests for a
+	// cached exchange are served without fetching, though shouldPackage is
+	// still consulted. As the key includes the cert, exchanges signed with
+	// a cert replaced by ReloadCert are no longer served. Conditional
+	// requests (e.g. with If-None-Match) bypass the cache, as they're
+	// forwarded to the origin, which may respond 304.
+	Cache Cache
+	// If true, proxy the document unsigned (as much of it as was read) when
+	// the upstream body ends before its Content-Length, as the document is
+	// likely truncated. Otherwise, this results in a 502. A body longer than
+	// its Content-Length is always truncated to it, as http.Client discards
+	// the excess before it can be detected.
+	ErrorOnContentLengthMismatch bool
+	// If true, add as=fetch preloads to the Link header for the JSON
+	// endpoints of <amp-list> and <amp-state> elements.
+	PreloadDataFetches bool
+	// If true, proxy the document unsigned when it doesn't begin with
+	// <!doctype html>, even if it has an AMP attribute, as it is likely
+	// invalid AMP. Otherwise, only the AMP attribute is required.
+	ErrorOnMissingDoctype bool
+	// The number of times to retry the upstream fetch after a connection
+	// error or 5xx response. 4xx responses are never retried.
+	FetchRetries int
+	// The delay before the first retry. Each subsequent retry doubles it,
+	// with random jitter.
+	FetchRetryBackoff time.Duration
+	// If true, merge the upstream Link header into the generated one,
+	// skipping any links to URLs that are already preloaded. Otherwise, it
+	// is dropped, as it could contain privacy-violating preloads. Only
+	// enable this if the upstream's Link headers are trusted.
+	MergeUpstreamLinkHeaders bool
+	// If positive, the upstream fetch (including any retries and reading
+	// the body) must complete within this duration. Otherwise, the
+	// response is a 504.
+	FetchTimeout time.Duration
+	// The transform version assumed when the AMP-Cache-Transform header
+	// doesn't specify one (e.g. a bare "google"), or when headers aren't
+	// required. Defaults to the highest supported version.
+	DefaultTransformVersion int64
+	// If positive, the document isn't signed when the upstream sent it
+	// compressed and it decompresses to more than this many bytes, as it may
+	// be a decompression bomb. As with MaxBodyBytes, this results in a 502,
+	// unless ProxyOversizedBody is set. Otherwise, decompressed bodies are
+	// limited only by MaxBodyBytes.
+	MaxDecompressedBodyBytes int
+	// The AMP-Cache-Transform identifiers (e.g. "google") of the AMP caches
+	// for which documents may be transformed and signed. The first one the
+	// client lists is echoed back. Include "any" to satisfy clients that
+	// accept any cache's transforms. Defaults to
+	// amp_cache_transform.DefaultIdentifiers.
+	TransformIdentities []string
+	// The max number of bytes of the upstream body to read into memory for
+	// signing. Defaults to 4MB.
+	MaxBodyBytes int64
+	// If true, proxy the document unsigned when its body exceeds
+	// MaxBodyBytes (or MaxDecompressedBodyBytes), streaming the part that
+	// wasn't read. Otherwise, this results in a 502.
+	ProxyOversizedBody bool
+	// If true, lowercase the charset param of the Content-Type in the
+	// exchange (e.g. charset=UTF-8 becomes charset=utf-8), reformatting the
+	// header canonically. Otherwise, the upstream's value is preserved.
+	// Either way, the charset is matched case-insensitively when validating.
+	NormalizeCharset bool
+	// If true, respond 404 to requests for /priv/doc/ followed by something
+	// other than an absolute URL (e.g. /priv/doc/foo/bar), as they match no
+	// route. Otherwise, the remainder is parsed as a sign URL, resulting in
+	// a 400.
+	NotFoundOnExtraPathSegments bool
+	// The headers of the request to the packager to copy onto the upstream
+	// fetch (e.g. Accept-Language), for origins that vary on them. They are
+	// added to the Vary response header. Hop-by-hop and stateful headers
+	// (e.g. Cookie) are disallowed.
+	ForwardedHeaders []string
+	// The upstream response headers to pass to the transformer, for
+	// transforms that depend on them. Stateful headers are stripped
+	// beforehand, so can't be passed.
+	TransformerHeaders []string
+	// Receives structured logs of fetch failures, transform failures, URL
+	// and fetch validation rejections, and successes, each with the sign
+	// URL, outcome, and latency. Defaults to JSONLogger.
+	Logger Logger
+	// If true, signed responses carry an AMPPKG-Debug-Original-Digest header
+	// with the SHA-256 of the upstream body before transformation, for
+	// verifying that the transform didn't corrupt content. Responses served
+	// from the Cache lack it.
+	DebugOriginalDigest bool
+	// How to handle a request with more than one fetch or sign param. If
+	// "first" or "last", that value is used (taking params in the POST body
+	// before those in the URL). Otherwise, the response is a 400.
+	DuplicateParams string
+	// If positive, proxy the document unsigned when the output of the
+	// transformer exceeds this many bytes. This is independent of
+	// MaxBodyBytes, as transforms may grow the document.
+	MaxTransformedBodyBytes int
+	// If non-empty, cert URLs in signatures carry this as their v query
+	// param (e.g. /amppkg/cert/<name>?v=2), so that caches keyed by URL
+	// refetch the cert chain when it's bumped, e.g. during rotation. The
+	// CertCache serving them must be given the same version.
+	CertURLVersion string
+
+	// If true, New returns an error if the cert lacks embedded SCTs
+	// (Signed Certificate Timestamps), without which Chrome rejects its
+	// signed exchanges. Otherwise, only a warning is logged, e.g. to allow
+	// testing with a self-signed cert.
+	RequireSCT bool
+	// If true, the upstream Content-Security-Policy is dropped, and the
+	// exchange carries only the signer's CSP. Otherwise, the directives
+	// listed at MutateFetchedContentSecurityPolicy are merged into it.
+	OverrideUpstreamCSP bool
+	// If positive, proxy the document unsigned when the data: URIs in its
+	// attributes and <style> elements (e.g. inline base64 images) total more
+	// than this many bytes, as they bloat the signed payload.
+	MaxInlineDataBytes int
+	// If true, a request to /priv/doc with a debug=1 param (alongside
+	// sign=) gets a JSON description of the exchange that would be
+	// produced, including its URLs, RTV, headers, and signature params,
+	// instead of the exchange itself. Documents that wouldn't be signed are
+	// still proxied. Off by default, as it exposes upstream headers.
+	DebugEnabled bool
+	// If true, a request's X-Amppkg-Deadline header (a positive number of
+	// milliseconds) sets the deadline for the upstream fetch, as with
+	// FetchTimeout, which (if positive) bounds it. Only enable this if the
+	// header is stripped from untrusted requests.
+	HonorDeadlineHeader bool
+	// If true, respond 404 rather than 400 when the sign URL's domain
+	// matches a URLSet but its path doesn't match the PathRE, as the
+	// document isn't one the packager serves.
+	NotFoundOnSignPathMismatch bool
+	// If true, proxy the document unsigned when the upstream response has
+	// a Refresh header, as it implies a redirect (or periodic reload) that
+	// would be frozen into the exchange.
+	ErrorOnRefreshHeader bool
+	// The max number of preloads in the generated Link header, after
+	// removing duplicate URLs. When trimming, stylesheets and scripts are
+	// kept in preference to other types. Links merged from the upstream
+	// (see MergeUpstreamLinkHeaders) don't count. Defaults to 20.
+	MaxPreloads int
+	// If true, add the author's resource hints to the Link header:
+	// as=font preloads for <link rel=preload as=font>, as=image preloads for
+	// <amp-img data-hero> hero images, and rel=preconnect links (up to 5)
+	// for <link rel=preconnect>. Only https URLs are included, and the
+	// preloads count toward MaxPreloads. Off by default, as not all AMP
+	// Caches accept these in the Link header.
+	ExtendedPreloads bool
+	// If true, decode the MI-encoded payload of each exchange and verify it
+	// against its Digest (including the termination of the final record)
+	// before signing, responding 500 if it doesn't match the transformed
+	// document. This guards against encoder bugs, at the cost of hashing
+	// the payload twice.
+	VerifyMIPayload bool
+	// How to handle a request while the RTV cache is unpopulated (see
+	// rtv.Options.AllowColdStart). If "wait", wait up to RTVWaitTimeout for
+	// it to be refreshed, and proxy the document unsigned if it isn't. If
+	// "proxy", proxy the document unsigned. Otherwise ("fallback"),
+	// transform with FallbackRTV and no inlined runtime CSS. Exchanges
+	// produced without the RTV cache are never cached.
+	RTVUnavailable string
+	// The max time to wait for the RTV cache when RTVUnavailable is "wait".
+	// Defaults to 5s.
+	RTVWaitTimeout time.Duration
+	// The runtime version to annotate documents with when RTVUnavailable is
+	// "fallback". If empty, the transformer annotates them with "latest".
+	FallbackRTV string
+	// The User-Agent of upstream fetches, e.g. so that the origin can
+	// identify them in its logs or rate limits. Defaults to a mobile Chrome
+	// UA that identifies amppackager.
+	FetchUserAgent string
+	// If true, preloads of elements with a media attribute (e.g. <link
+	// rel=stylesheet media=print>) carry it as a media param in the Link
+	// header, so that the browser only preloads them when it matches. Off
+	// by default, as not all AMP Caches accept the param.
+	PreloadMedia bool
+	// If true, ServeSignDocument signs documents POSTed to it, without
+	// fetching them. Only enable this if the endpoint is inaccessible to
+	// untrusted clients, as they could otherwise sign arbitrary content for
+	// any URL matching a URLSet.
+	SignPostedDocuments bool
+	// If non-nil, documents are validated as AMP before being signed, and
+	// proxied unsigned if invalid.
+	Validator Validator
+	// If true, a sign URL with the http scheme is upgraded to https (which
+	// signed exchanges require) before being matched against the URLSets.
+	// If it has no fetch URL, the document is then fetched over https.
+	// Otherwise, such sign URLs are rejected with a 400.
+	UpgradeSignURLScheme bool
+	// The AMP formats (e.g. AMP4ADS) that may be signed, as declared by the
+	// document's html amp attribute (e.g. <html amp4ads>). Documents of
+	// other formats are proxied unsigned. Defaults to AMP.
+	AllowedFormats []rpb.Request_HtmlFormat
+	// If true, add a rel=canonical link to the sign URL to the Link header of
+	// the exchange, after the preloads, for caches that look for one.
+	CanonicalLinkHeader bool
+	// If true, the upstream Last-Modified header is carried into the
+	// exchange, reformatted as an IMF-fixdate (or dropped if unparseable),
+	// for caches that use it for freshness. Otherwise, it is dropped.
+	LastModified bool
+	// The transport for upstream fetches, e.g. to route them through a proxy
+	// or tune connection pooling. Redirects are still not followed. Defaults
+	// to http.DefaultTransport.
+	Transport http.RoundTripper
+	// If positive, at most this many upstream fetches are in flight at once
+	// (from the request until its body is closed), to protect fragile
+	// origins. Excess requests are handled per QueueFetches. Cached
+	// exchanges needn't be fetched, so aren't limited.
+	MaxConcurrentFetches int
+	// If true, a request in excess of MaxConcurrentFetches waits for a fetch
+	// to complete, responding 503 if none does within FetchTimeout (if
+	// positive) or before the request is canceled. Otherwise, it is failed
+	// immediately with a 503.
+	QueueFetches bool
+	// If true, proxy the document unsigned when signing fails with a
+	// temporary error (one with a Temporary method returning true, like
+	// net.Error), e.g. because a remote key is briefly unavailable.
+	// Otherwise, such failures result in a 503, distinguishing them from
+	// permanent failures, which result in a 500.
+	ProxyOnTransientSigningError bool
+	// If true, the preloads of hero images with a srcset (see
+	// ExtendedPreloads) carry it and their sizes as imagesrcset and
+	// imagesizes params in the Link header, so that the browser preloads the
+	// same candidate it selects for the image, rather than the src. Off by
+	// default, as not all AMP Caches accept the params.
+	PreloadHeroSrcset bool
+	// If true, a UTF byte order mark at the start of the upstream body takes
+	// precedence over a conflicting Content-Type charset, as it does in
+	// browsers: a UTF-16 body is transcoded to UTF-8, and the exchange's
+	// charset is set to utf-8. Otherwise, such a conflict results in an
+	// unsigned response.
+	PreferBOMCharset bool
+	// If set, upstream fetches are sent over plain HTTP to the Unix socket
+	// at this path, regardless of the fetch URL's scheme and host, e.g. for
+	// an origin running alongside amppackager. The fetch URL still
+	// determines the request path and Host header. Mutually exclusive with
+	// Transport.
+	FetchUnixSocket string
+	// If set, the signature algorithm the key must sign with, named as in
+	// TLS 1.3: "ecdsa_secp256r1_sha256" (required by the SXG spec) or
+	// "ecdsa_secp384r1_sha384". New and ReloadCert return an error if the
+	// key doesn't match it. Otherwise, the algorithm is inferred from the
+	// key.
+	SignatureAlg string
+	// If true, respond 400 to a request with the sign URL in its path (e.g.
+	// /priv/doc/https://example.com/a) whose query has a sign or fetch
+	// param, as it's ambiguous which sign URL the client intended.
+	// Otherwise, the path takes precedence, and the query is that of the
+	// sign URL (e.g. https://example.com/a?sign=...), params and all.
+	ErrorOnAmbiguousSignURL bool
+	// If true, New returns an error if the certs (including ExtraCerts)
+	// cover none of the URLSet Sign domains (and logs a warning for each
+	// one they don't cover), and requests to sign a URL whose host the
+	// certs don't cover get a 400,
+	// as caches would reject the exchange. Otherwise, such exchanges are
+	// signed regardless, e.g. for testing with a self-signed cert.
+	RequireCertCoverage bool
+	// The srcs of AMP extension scripts (e.g.
+	// "https://cdn.ampproject.org/v0/amp-bind-0.1.js") that may not be
+	// signed, by policy. A document that loads any of them is proxied
+	// unsigned. The srcs are matched exactly, so each version of an
+	// extension must be listed.
+	DeniedExtensionSrcs []string
+	// If true, upstream responses with a Content-Type of
+	// application/xhtml+xml are signed like text/html, and labeled as such
+	// in the exchange, as the transforms parse and output them as HTML.
+	// As for any document, they are only signed if they declare themselves
+	// AMP (e.g. <html amp xmlns="http://www.w3.org/1999/xhtml">).
+	// Otherwise, they are proxied unsigned.
+	AcceptXHTML bool
+	// If positive, upstream bodies shorter than this many bytes are proxied
+	// unsigned, as an exchange of a near-empty document (e.g. an error page
+	// or placeholder that is nonetheless valid AMP) costs a signature but
+	// gains nothing from prefetching.
+	MinBodyBytes int
+	// The path of the validity URL in signatures, resolved against the sign
+	// URL. Defaults to /amppkg/validity, the path amppkg serves it at;
+	// override it if a frontend maps a different path there, e.g. to mount
+	// amppkg under a path prefix. Must be an absolute path.
+	ValidityURLPath string
+	// If true, log (via Logger, at info level) each signed document that
+	// yields no preload links, e.g. to find documents whose performance
+	// could be improved by preloading their resources.
+	LogNoPreloads bool
+	// If true, documents proxied unsigned get X-Content-Type-Options:
+	// nosniff, as signed exchanges do, regardless of the upstream value.
+	SecurityHeaders bool
+	// If SecurityHeaders is true and this is non-empty, it's the value of
+	// the Strict-Transport-Security header (e.g. "max-age=31536000") added
+	// to documents proxied unsigned that lack one.
+	HSTS string
+	// Certs to sign with besides the one passed to New, e.g. for sign
+	// domains it doesn't cover. Each request is signed with the cert
+	// covering its sign URL host that has the highest Priority; the cert
+	// passed to New has priority 0, and wins ties, followed by ExtraCerts
+	// in order. Each is subject to SignatureAlg and RequireSCT, and its key
+	// must match it. ReloadCert replaces only the cert passed to New.
+	ExtraCerts []SigningCert
+	// If non-nil, documents are proxied unsigned (and cached exchanges
+	// aren't served) while it's engaged, as when shouldPackage returns
+	// false, so that operators may disable signing during an incident
+	// without a restart.
+	KillSwitch *util.KillSwitch
+}
+
+// SigningCert is a cert with which a Signer may sign; see
+// Options.ExtraCerts.
+type SigningCert struct {
+	Cert *x509.Certificate
+	Key  crypto.PrivateKey
+	// Of the certs covering a sign URL host, the one with the highest
+	// Priority signs it.
+	Priority int
+}
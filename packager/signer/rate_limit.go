@@ -0,0 +1,75 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+)
+
+// A token bucket, holding at most burst tokens, and refilled at rate tokens
+// per second. Each request takes a token, if there is one.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Returns a full rateLimiter, or nil if rate isn't positive.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// Takes a token and returns true, or returns false if there are none as of
+// now. A nil rateLimiter always returns true.
+func (this *rateLimiter) allow(now time.Time) bool {
+	if this == nil {
+		return true
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if elapsed := now.Sub(this.last); elapsed > 0 {
+		this.tokens = math.Min(this.burst, this.tokens+elapsed.Seconds()*this.rate)
+		this.last = now
+	}
+	if this.tokens < 1 {
+		return false
+	}
+	this.tokens--
+	return true
+}
+
+// Returns a rateLimiter for each of the given URLSets that has a RateLimit,
+// keyed by its address in the slice, as matched by parseURLs.
+func newRateLimiters(urlSets []util.URLSet) map[*util.URLSet]*rateLimiter {
+	limiters := map[*util.URLSet]*rateLimiter{}
+	for i := range urlSets {
+		if limiter := newRateLimiter(urlSets[i].RateLimit, urlSets[i].RateLimitBurst); limiter != nil {
+			limiters[&urlSets[i]] = limiter
+		}
+	}
+	return limiters
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert.Nil(t, newRateLimiter(0, 5))
+	assert.True(t, newRateLimiter(0, 5).allow(time.Now()))
+
+	limiter := newRateLimiter(2, 3)
+	now := time.Now()
+	// The bucket starts full.
+	assert.True(t, limiter.allow(now))
+	assert.True(t, limiter.allow(now))
+	assert.True(t, limiter.allow(now))
+	assert.False(t, limiter.allow(now))
+
+	// It refills at the rate.
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, limiter.allow(now))
+	assert.False(t, limiter.allow(now))
+
+	// But only up to the burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.allow(now), "request %d", i)
+	}
+	assert.False(t, limiter.allow(now))
+
+	// Time going backwards doesn't drain it.
+	assert.False(t, limiter.allow(now.Add(-time.Second)))
+	assert.True(t, limiter.allow(now.Add(time.Second)))
+}
+
+func TestRateLimiterDefaultBurst(t *testing.T) {
+	limiter := newRateLimiter(1.5, 0)
+	now := time.Now()
+	assert.True(t, limiter.allow(now))
+	assert.True(t, limiter.allow(now))
+	assert.False(t, limiter.allow(now))
+}
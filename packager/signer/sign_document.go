@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/accept"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/ampproject/amppackager/transformer"
+	"github.com/julienschmidt/httprouter"
+)
+
+// ServeSignDocument signs the AMP document in the body of a POST request,
+// with the Content-Type of the request, for the sign URL given in the sign
+// query param, instead of fetching it from the origin. The sign URL must
+// match one of the URLSets' Sign patterns. The document is transformed at the
+// default transform version. As with ServeHTTP, documents that can't be
+// signed (e.g. invalid AMP) are returned unsigned. Responds 404 unless
+// Options.SignPostedDocuments is set.
+func (this *Signer) ServeSignDocument(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	start := time.Now()
+	if !this.options.SignPostedDocuments {
+		util.NewHTTPError(http.StatusNotFound, "Signing posted documents is disabled").LogAndRespond(resp)
+		return
+	}
+	if req.Method != http.MethodPost {
+		resp.Header().Set("Allow", http.MethodPost)
+		util.NewHTTPError(http.StatusMethodNotAllowed, "Method must be POST, not ", req.Method).LogAndRespond(resp)
+		return
+	}
+	// The body is the document, so params are read only from the URL.
+	query := req.URL.Query()
+	if len(query["sign"]) != 1 {
+		util.NewHTTPError(http.StatusBadRequest, "Not exactly 1 sign param").LogAndRespond(resp)
+		return
+	}
+	sign := query.Get("sign")
+	if this.options.UpgradeSignURLScheme {
+		sign = upgradeScheme(sign)
+	}
+	signURL, httpErr := parseURL(sign, "sign")
+	if httpErr != nil {
+		httpErr.LogAndRespond(resp)
+		return
+	}
+	var urlSet *util.URLSet
+	var reasons []string
+	for i := range this.urlSets {
+		err := signURLMatches(signURL, this.urlSets[i].Sign)
+		if err == nil {
+			urlSet = &this.urlSets[i]
+			break
+		}
+		reasons = append(reasons, err.Error())
+	}
+	if urlSet == nil {
+		this.options.Logger.Info("Rejected URL", "url", signURL, "outcome", "error", "latency_ms", millisSince(start))
+		util.NewHTTPError(http.StatusBadRequest, "sign URL matches no URLSet: ", strings.Join(reasons, "; ")).LogAndRespond(resp)
+		return
+	}
+	cert, key := this.signingCert(signURL.Hostname())
+	if httpErr := this.checkSignURLCoverage(cert, signURL); httpErr != nil {
+		this.options.Logger.Info("Rejected URL", "url", signURL, "outcome", "error", "latency_ms", millisSince(start))
+		httpErr.LogAndRespond(resp)
+		return
+	}
+	if !this.rateLimiters[urlSet].allow(this.nowFunc()) {
+		this.options.Logger.Info("Rate limited", "url", signURL, "outcome", "error", "latency_ms", millisSince(start))
+		util.NewHTTPError(http.StatusTooManyRequests, "URLSet rate limit exceeded for ", signURL).LogAndRespond(resp)
+		return
+	}
+
+	contentType := req.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "text/html" {
+		util.NewHTTPError(http.StatusUnsupportedMediaType, "Content-Type must be text/html, not ", contentType).LogAndRespond(resp)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, this.options.MaxBodyBytes+1))
+	if err != nil {
+		util.NewHTTPError(http.StatusBadRequest, "Error reading body: ", err).LogAndRespond(resp)
+		return
+	}
+	if int64(len(body)) > this.options.MaxBodyBytes {
+		util.NewHTTPError(http.StatusRequestEntityTooLarge, "Body exceeds max length of ", this.options.MaxBodyBytes, " bytes").LogAndRespond(resp)
+		return
+	}
+	if !this.shouldPackage(req) {
+		util.NewHTTPError(http.StatusServiceUnavailable, "Signing is disabled (e.g. server is unhealthy); see above log statements").LogAndRespond(resp)
+		return
+	}
+
+	sxgVersion := this.options.Versions[0]
+	if accepted := GetJoined(req.Header, "Accept"); accepted != "" {
+		if sxgVersion = accept.Negotiate(accepted, this.options.Versions); sxgVersion == "" {
+			util.NewHTTPError(http.StatusNotAcceptable, "Accept request header lacks application/signed-exchange with v in ", this.options.Versions).LogAndRespond(resp)
+			return
+		}
+	}
+	transformVersion, err := transformer.SelectVersion(defaultTransformVersions(this.options.DefaultTransformVersion))
+	if err != nil {
+		util.NewHTTPError(http.StatusInternalServerError, "Error selecting transform version: ", err).LogAndRespond(resp)
+		return
+	}
+
+	// Stand in for the upstream response. The document carries no
+	// upstream headers, so the exchange gets only the signer's CSP.
+	docResp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {contentType}, "Content-Security-Policy": {MutateFetchedContentSecurityPolicy("")}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	// Posted documents aren't cached, as they may differ for the same URL.
+	this.serveSignedExchange(resp, req, docResp, signURL, urlSet, sxgVersion, transformVersion, "", cert, key, start, nil)
+}
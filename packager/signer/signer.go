@@ -15,21 +15,37 @@
 package signer
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/mice"
 	"github.com/ampproject/amppackager/packager/accept"
 	"github.com/ampproject/amppackager/packager/amp_cache_transform"
 	"github.com/ampproject/amppackager/packager/rtv"
@@ -38,6 +54,7 @@ import (
 	rpb "github.com/ampproject/amppackager/transformer/request"
 	"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
+	"golang.org/x/net/html"
 )
 
 // The Content-Security-Policy in use by the AMP Cache today. Specifying here
@@ -46,7 +63,8 @@ import (
 // value will likely be versioned along with the transforms.
 var contentSecurityPolicy = "default-src * blob: data:; script-src blob: https://cdn.ampproject.org/rtv/ https://cdn.ampproject.org/v0.js https://cdn.ampproject.org/v0/ https://cdn.ampproject.org/viewer/; object-src 'none'; style-src 'unsafe-inline' https://cdn.ampproject.org/rtv/ https://cdn.materialdesignicons.com https://cloud.typography.com https://fast.fonts.net https://fonts.googleapis.com https://maxcdn.bootstrapcdn.com https://p.typekit.net https://pro.fontawesome.com https://use.fontawesome.com https://use.typekit.net; report-uri https://csp-collector.appspot.com/csp/amp"
 
-// The user agent to send when issuing fetches. Should look like a mobile device.
+// The default user agent to send when issuing fetches (see
+// Options.FetchUserAgent). Should look like a mobile device.
 const userAgent = "Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) " +
 	"AppleWebKit/537.36 (KHTML, like Gecko) Chrome/41.0.2272.96 Mobile " +
 	"Safari/537.36 (compatible; amppackager/0.0.0; +https://github.com/ampproject/amppackager)"
@@ -61,6 +79,29 @@ var conditionalRequestHeaders = map[string]bool{
 	"If-Range":            true,
 }
 
+// Returns true if the request has any conditional headers.
+func isConditional(req *http.Request) bool {
+	for header := range conditionalRequestHeaders {
+		if GetJoined(req.Header, header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Hop-by-hop request headers, which may not be forwarded to the origin, per
+// https://tools.ietf.org/html/rfc7230#section-6.1. Additionally, any headers
+// named in the Connection header are hop-by-hop.
+var hopByHopRequestHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
 // Advised against, per
 // https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-4.1
 // and blocked in http://crrev.com/c/958945.
@@ -97,20 +138,65 @@ var statusNotModifiedHeaders = map[string]bool{
 // (https://tools.ietf.org/html/draft-thomson-http-mice-03#section-2.1).
 // In an HTTP reverse proxy, this could be done using range requests, but would
 // be inefficient. Therefore, the signer requires the whole payload in memory.
-// To prevent DoS, a memory limit is set. This limit is mostly arbitrary,
-// though there's no benefit to having a limit greater than that of AMP Caches.
+// To prevent DoS, a memory limit is set (configurable via
+// Options.MaxBodyBytes). This default is mostly arbitrary, though there's no
+// benefit to having a limit greater than that of AMP Caches.
 const maxBodyLength = 4 * 1 << 20
 
 // The current maximum is defined at:
 // https://cs.chromium.org/chromium/src/content/browser/loader/merkle_integrity_source_stream.cc?l=18&rcl=591949795043a818e50aba8a539094c321a4220c
 // The maximum is cheapest in terms of network usage, and probably CPU on both
-// server and client. The memory usage difference is negligible.
+// server and client. The memory usage difference is negligible. This is the
+// default; it may be overridden by the RecordSize config.
 const miRecordSize = 16 << 10
 
+// Expires - Date must be <= 604800 seconds, per
+// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-3.5.
+// This is also the default.
+const maxSignatureExpiry = 7 * 24 * time.Hour
+
+// Returns the value of the signature's integrity parameter for a payload
+// encoded with the given MI encoding, per
+// https://wicg.github.io/webpackage/draft-yasskin-httpbis-origin-signed-exchanges-impl.html#signature-validity.
+func integrityReference(enc mice.Encoding) string {
+	if enc == mice.Draft02Encoding {
+		// The b1 format predates the digest/ prefix.
+		return "mi-draft2"
+	}
+	return "digest/" + enc.ContentEncoding()
+}
+
+// Returns true if the RTV cache is populated, waiting up to wait for it to be
+// refreshed if not. A var so that tests, which use an empty RTVCache, may stub
+// it out.
+var isRTVPopulated = func(r *rtv.RTVCache, wait time.Duration) bool {
+	return r.WaitPopulated(wait)
+}
+
+// Returns the AMP runtime version, e.g. for the cache key. A var so that tests,
+// which use an empty RTVCache, may stub it out.
+var getRTV = func(r *rtv.RTVCache) string {
+	return r.GetRTV()
+}
+
+// The default max time to wait for the RTV cache (see Options.RTVWaitTimeout).
+const defaultRTVWaitTimeout = 5 * time.Second
+
+// The source of randomness for signatures. If nil, crypto/rand is used.
 // Overrideable for testing.
-var getTransformerRequest = func(r *rtv.RTVCache, s, u string) *rpb.Request {
+var signingRand io.Reader
+
+// Returns true if the given error reports itself as temporary, in the manner
+// of net.Error, e.g. because a remote key is briefly unavailable.
+func isTransient(err error) bool {
+	temporary, ok := errors.Cause(err).(interface{ Temporary() bool })
+	return ok && temporary.Temporary()
+}
+
+// Overrideable for testing.
+var getTransformerRequest = func(r *rtv.RTVCache, s, u string, formats []rpb.Request_HtmlFormat) *rpb.Request {
 	return &rpb.Request{Html: string(s), DocumentUrl: u, Rtv: r.GetRTV(), Css: r.GetCSS(),
-		AllowedFormats: []rpb.Request_HtmlFormat{rpb.Request_AMP}}
+		AllowedFormats: formats}
 }
 
 // Roughly matches the protocol grammar
@@ -171,28 +257,539 @@ type Signer struct {
 	client          *http.Client
 	urlSets         []util.URLSet
 	rtvCache        *rtv.RTVCache
-	shouldPackage   func() bool
+	shouldPackage   func(*http.Request) bool
 	overrideBaseURL *url.URL
 	requireHeaders  bool
+	recordSize      int
+	signatureExpiry time.Duration
+	// Returns the current time, from which signature timestamps are
+	// derived. Overridable for tests.
+	nowFunc func() time.Time
+	options Options
+	// Guards cert and key, which ReloadCert may replace.
+	certMu sync.RWMutex
+	// Holds a value per in-flight upstream fetch, if
+	// Options.MaxConcurrentFetches is positive. Otherwise, nil.
+	fetchSlots chan struct{}
+	// The rate limiter of each URLSet with a RateLimit.
+	rateLimiters map[*util.URLSet]*rateLimiter
+	// The client for each URLSet FetchNetwork, whose dialer is restricted
+	// to it. URLSets without one use client.
+	networkClients map[string]*http.Client
 }
 
 func noRedirects(req *http.Request, via []*http.Request) error {
 	return http.ErrUseLastResponse
 }
 
+// The request header that triggers dumping of the signed bytes. See
+// Options.DebugSignedBytesToken.
+const debugSignedBytesHeader = "AMPPKG-Debug-Signed-Bytes"
+
+// The response header carrying the digest of the untransformed body. See
+// Options.DebugOriginalDigest.
+const debugOriginalDigestHeader = "AMPPKG-Debug-Original-Digest"
+
+// The request header by which a trusted client may shorten the fetch
+// deadline. See Options.HonorDeadlineHeader.
+const deadlineHeader = "X-Amppkg-Deadline"
+
+func logSignedBytes(signURL string, payload []byte, digest string) {
+	log.Printf("Signed bytes for %q: digest=%q payload=%s\n", signURL, digest, base64.StdEncoding.EncodeToString(payload))
+}
+
+// IgnoreRequest adapts a shouldPackage func that doesn't depend on the
+// request (e.g. a health check) for use with New.
+func IgnoreRequest(shouldPackage func() bool) func(*http.Request) bool {
+	return func(*http.Request) bool { return shouldPackage() }
+}
+
+// Returns a transport that sends every request over plain HTTP to the Unix
+// socket at the given path, regardless of the URL's scheme and host. (The
+// URL still determines the request path and Host header.)
+func unixSocketTransport(path string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", path)
+	}
+	transport.DialContext = dial
+	// The returned conn is used as-is for https URLs, i.e. without TLS.
+	transport.DialTLSContext = dial
+	return transport
+}
+
+// Returns a copy of client for each FetchNetwork of the given URLSets, with
+// a transport whose dialer is restricted to that network. Each has its own
+// transport, so that pooled connections aren't shared across networks.
+func newNetworkClients(client http.Client, urlSets []util.URLSet, options Options) (map[string]*http.Client, error) {
+	clients := map[string]*http.Client{}
+	for _, urlSet := range urlSets {
+		network := urlSet.FetchNetwork
+		if network == "" || clients[network] != nil {
+			continue
+		}
+		if options.FetchUnixSocket != "" {
+			return nil, errors.New("FetchNetwork and FetchUnixSocket are mutually exclusive")
+		}
+		base := http.DefaultTransport
+		if options.Transport != nil {
+			base = options.Transport
+		}
+		transport, ok := base.(*http.Transport)
+		if !ok || transport.DialTLSContext != nil || transport.DialTLS != nil {
+			return nil, errors.New("FetchNetwork requires a Transport that is an *http.Transport without a custom TLS dialer")
+		}
+		transport = transport.Clone()
+		dial := transport.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		}
+		networkClient := client
+		networkClient.Transport = transport
+		clients[network] = &networkClient
+	}
+	return clients, nil
+}
+
+// The curves of the ECDSA keys that sign with each supported signature
+// algorithm, named as in https://tools.ietf.org/html/rfc8446#section-4.2.3.
+// These are what the signedexchange library supports; the SXG spec requires
+// ecdsa_secp256r1_sha256 of certs used for signed exchanges.
+var signatureAlgCurves = map[string]elliptic.Curve{
+	"ecdsa_secp256r1_sha256": elliptic.P256(),
+	"ecdsa_secp384r1_sha384": elliptic.P384(),
+}
+
+// Returns an error if the given key can't sign with the given signature
+// algorithm (see Options.SignatureAlg). An empty alg matches any key.
+func checkSignatureAlg(alg string, key crypto.PrivateKey) error {
+	if alg == "" {
+		return nil
+	}
+	curve, ok := signatureAlgCurves[alg]
+	if !ok {
+		return errors.Errorf("unsupported signature algorithm %q", alg)
+	}
+	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.Errorf("signature algorithm %s requires an ECDSA key, not %T", alg, key)
+	}
+	if ecdsaKey.Curve != curve {
+		return errors.Errorf("signature algorithm %s requires a %s key, not %s", alg, curve.Params().Name, ecdsaKey.Curve.Params().Name)
+	}
+	return nil
+}
+
+// Returns the given URL host without its port, if any, for matching against
+// the names in a cert.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// Returns true if the cert covers the given URLSet Sign domain or, if it's a
+// wildcard, any of the hosts it matches. (Coverage of the specific host is
+// then checked per request; see checkSignURLCoverage.)
+func certCoversDomain(cert *x509.Certificate, domain string) bool {
+	domain = stripPort(domain)
+	if !strings.HasPrefix(domain, "*.") {
+		return cert.VerifyHostname(domain) == nil
+	}
+	for _, name := range cert.DNSNames {
+		if util.DomainMatches(domain, strings.ToLower(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if any of the certs covers the given URLSet Sign domain (see
+// certCoversDomain).
+func certsCoverDomain(certs []*x509.Certificate, domain string) bool {
+	for _, cert := range certs {
+		if certCoversDomain(cert, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error if the certs cover none of the Sign domains of the given
+// URLSets, as they couldn't sign any valid exchanges. A warning is logged for
+// each uncovered domain otherwise, as requests for them are rejected (see
+// Options.RequireCertCoverage).
+func checkCertCoverage(certs []*x509.Certificate, urlSets []util.URLSet) error {
+	var covered, uncovered []string
+	for _, urlSet := range urlSets {
+		if urlSet.Sign == nil || urlSet.Sign.Domain == "" {
+			continue
+		}
+		if certsCoverDomain(certs, urlSet.Sign.Domain) {
+			covered = append(covered, urlSet.Sign.Domain)
+		} else {
+			uncovered = append(uncovered, urlSet.Sign.Domain)
+		}
+	}
+	if len(covered) == 0 && len(uncovered) > 0 {
+		return errors.Errorf("cert covers none of the URLSet Sign domains: %s", strings.Join(uncovered, ", "))
+	}
+	for _, domain := range uncovered {
+		log.Printf("Warning: cert doesn't cover URLSet Sign domain %s, so requests to sign its URLs will be rejected.\n", domain)
+	}
+	return nil
+}
+
+// Returns an error if the key's public key isn't that of the cert, as its
+// signatures wouldn't verify.
+func checkKeyMatchesCert(key crypto.PrivateKey, cert *x509.Certificate) error {
+	keySigner, ok := key.(crypto.Signer)
+	if !ok {
+		return errors.Errorf("unsupported key type %T", key)
+	}
+	keyPub, err := x509.MarshalPKIXPublicKey(keySigner.Public())
+	if err != nil {
+		return errors.Wrap(err, "marshaling key's public key")
+	}
+	certPub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return errors.Wrap(err, "marshaling cert's public key")
+	}
+	if !bytes.Equal(keyPub, certPub) {
+		return errors.New("key doesn't match cert")
+	}
+	return nil
+}
+
+// Returns an error if the cert lacks embedded SCTs and required is true (see
+// Options.RequireSCT). Otherwise, a warning is logged if it lacks them.
+func checkSCTs(cert *x509.Certificate, required bool) error {
+	if !util.HasSCTs(cert) {
+		if required {
+			return errors.New("cert lacks embedded SCTs, so its signed exchanges will be rejected by Chrome")
+		}
+		log.Println("Warning: cert lacks embedded SCTs, so its signed exchanges will be rejected by Chrome.")
+	}
+	return nil
+}
+
+// Returns the given cert followed by those of the extra certs, in order.
+func withExtraCerts(cert *x509.Certificate, extraCerts []SigningCert) []*x509.Certificate {
+	certs := []*x509.Certificate{cert}
+	for _, extra := range extraCerts {
+		certs = append(certs, extra.Cert)
+	}
+	return certs
+}
+
+// Returns a 400 if Options.RequireCertCoverage is set and the cert doesn't
+// cover the host of the sign URL, as caches would reject the exchange.
+func (this *Signer) checkSignURLCoverage(cert *x509.Certificate, signURL *url.URL) *util.HTTPError {
+	if !this.options.RequireCertCoverage {
+		return nil
+	}
+	if err := cert.VerifyHostname(signURL.Hostname()); err != nil {
+		return util.NewHTTPError(http.StatusBadRequest, "Cert doesn't cover sign URL host: ", err)
+	}
+	return nil
+}
+
+// New returns a Signer. shouldPackage is called for each request (after its
+// fetch and sign params have been parsed), and may return false to proxy the
+// document unsigned, e.g. because the server is unhealthy, or to exclude
+// certain paths or experiment buckets from signing.
 func New(cert *x509.Certificate, key crypto.PrivateKey, urlSets []util.URLSet,
-	rtvCache *rtv.RTVCache, shouldPackage func() bool, overrideBaseURL *url.URL,
-	requireHeaders bool) (*Signer, error) {
+	rtvCache *rtv.RTVCache, shouldPackage func(*http.Request) bool, overrideBaseURL *url.URL,
+	requireHeaders bool, recordSize int, signatureExpiry time.Duration, options Options) (*Signer, error) {
+	if options.FetchUnixSocket != "" {
+		if options.Transport != nil {
+			return nil, errors.New("FetchUnixSocket and Transport are mutually exclusive")
+		}
+		options.Transport = unixSocketTransport(options.FetchUnixSocket)
+	}
 	client := http.Client{
+		// If nil, http.DefaultTransport is used.
+		Transport:     options.Transport,
 		CheckRedirect: noRedirects,
 		// TODO(twifkak): Load-test and see if default transport settings are okay.
 		Timeout: 60 * time.Second,
 	}
+	networkClients, err := newNetworkClients(client, urlSets, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if recordSize == 0 {
+		recordSize = miRecordSize
+	} else if err := util.ValidateRecordSize(recordSize); err != nil {
+		return nil, err
+	}
+	if signatureExpiry == 0 {
+		signatureExpiry = maxSignatureExpiry
+	} else if signatureExpiry < 0 || signatureExpiry > maxSignatureExpiry {
+		return nil, errors.Errorf("signature expiry %s must be positive and at most %s", signatureExpiry, maxSignatureExpiry)
+	}
+	if err := checkSignatureAlg(options.SignatureAlg, key); err != nil {
+		return nil, err
+	}
+	if err := checkSCTs(cert, options.RequireSCT); err != nil {
+		return nil, err
+	}
+	options.ExtraCerts = append([]SigningCert{}, options.ExtraCerts...)
+	for i, extra := range options.ExtraCerts {
+		if extra.Cert == nil || extra.Key == nil {
+			return nil, errors.Errorf("extra cert %d lacks a cert or key", i)
+		}
+		if err := checkKeyMatchesCert(extra.Key, extra.Cert); err != nil {
+			return nil, errors.Wrapf(err, "extra cert %d", i)
+		}
+		if err := checkSignatureAlg(options.SignatureAlg, extra.Key); err != nil {
+			return nil, errors.Wrapf(err, "extra cert %d", i)
+		}
+		if err := checkSCTs(extra.Cert, options.RequireSCT); err != nil {
+			return nil, errors.Wrapf(err, "extra cert %d", i)
+		}
+	}
+	if options.RequireCertCoverage {
+		if err := checkCertCoverage(withExtraCerts(cert, options.ExtraCerts), urlSets); err != nil {
+			return nil, err
+		}
+	}
+	if killSwitch := options.KillSwitch; killSwitch != nil {
+		shouldPackageUnlessKilled := shouldPackage
+		shouldPackage = func(req *http.Request) bool {
+			return !killSwitch.Engaged() && shouldPackageUnlessKilled(req)
+		}
+	}
+	if options.SignedBytesSink == nil {
+		options.SignedBytesSink = logSignedBytes
+	}
+	if len(options.Versions) == 0 {
+		options.Versions = []string{accept.AcceptedSxgVersion}
+	}
+	for _, v := range options.Versions {
+		if _, ok := accept.SupportedSxgVersions[v]; !ok {
+			return nil, errors.Errorf("unsupported SXG version %q", v)
+		}
+	}
+	// Sort highest first, for use when headers aren't required.
+	options.Versions = append([]string{}, options.Versions...)
+	sort.Sort(sort.Reverse(sort.StringSlice(options.Versions)))
+	if options.Logger == nil {
+		options.Logger = JSONLogger{}
+	}
+	if options.FetchUserAgent == "" {
+		options.FetchUserAgent = userAgent
+	} else if strings.ContainsAny(options.FetchUserAgent, "\r\n") {
+		return nil, errors.Errorf("fetch User-Agent %q contains a newline", options.FetchUserAgent)
+	}
+	if strings.ContainsAny(options.HSTS, "\r\n") {
+		return nil, errors.Errorf("HSTS %q contains a newline", options.HSTS)
+	}
+	if options.ValidityURLPath == "" {
+		options.ValidityURLPath = util.ValidityMapPath
+	} else if u, err := url.Parse(options.ValidityURLPath); err != nil || !strings.HasPrefix(options.ValidityURLPath, "/") || strings.HasPrefix(options.ValidityURLPath, "//") || u.RawQuery != "" || u.Fragment != "" {
+		return nil, errors.Errorf("validity URL path %q is not an absolute path", options.ValidityURLPath)
+	}
+	if len(options.AllowedFormats) == 0 {
+		options.AllowedFormats = []rpb.Request_HtmlFormat{rpb.Request_AMP}
+	}
+	for _, format := range options.AllowedFormats {
+		if !transformer.IsSupportedFormat(format) {
+			return nil, errors.Errorf("unsupported AMP format %s", format)
+		}
+	}
+	switch options.RTVUnavailable {
+	case "", "fallback", "proxy":
+	case "wait":
+		if options.RTVWaitTimeout == 0 {
+			options.RTVWaitTimeout = defaultRTVWaitTimeout
+		} else if options.RTVWaitTimeout < 0 {
+			return nil, errors.Errorf("RTV wait timeout %s is negative", options.RTVWaitTimeout)
+		}
+	default:
+		return nil, errors.Errorf("RTV unavailable behavior %q is not one of \"fallback\", \"wait\", or \"proxy\"", options.RTVUnavailable)
+	}
+	if options.MaxPreloads == 0 {
+		options.MaxPreloads = defaultMaxPreloads
+	} else if options.MaxPreloads < 0 {
+		return nil, errors.Errorf("max preloads %d is negative", options.MaxPreloads)
+	}
+	if options.MaxBodyBytes == 0 {
+		options.MaxBodyBytes = maxBodyLength
+	} else if options.MaxBodyBytes < 0 {
+		return nil, errors.Errorf("max body bytes %d is negative", options.MaxBodyBytes)
+	}
+	if options.MIEncoding == "" {
+		options.MIEncoding = mice.Draft03Encoding
+	}
+	// The signedexchange library chooses the encoding based on the SXG
+	// version, and only mi-sha256-03 is supported by the versions we emit.
+	if options.MIEncoding != mice.Draft03Encoding {
+		return nil, errors.Errorf("MI encoding %q is unsupported by SXG versions %v", options.MIEncoding, options.Versions)
+	}
+	if len(options.TransformIdentities) == 0 {
+		options.TransformIdentities = amp_cache_transform.DefaultIdentifiers
+	}
+	for _, id := range options.TransformIdentities {
+		if !amp_cache_transform.IsValidIdentifier(id) {
+			return nil, errors.Errorf("invalid AMP-Cache-Transform identifier %q", id)
+		}
+	}
+	forwardedHeaders := make([]string, len(options.ForwardedHeaders))
+	for i, header := range options.ForwardedHeaders {
+		forwardedHeaders[i] = http.CanonicalHeaderKey(header)
+		if hopByHopRequestHeaders[forwardedHeaders[i]] {
+			return nil, errors.Errorf("forwarded header %q is hop-by-hop", header)
+		}
+		if signedexchange.IsStatefulRequestHeader(header) {
+			return nil, errors.Errorf("forwarded header %q is stateful", header)
+		}
+	}
+	options.ForwardedHeaders = forwardedHeaders
+	transformerHeaders := make([]string, len(options.TransformerHeaders))
+	for i, header := range options.TransformerHeaders {
+		transformerHeaders[i] = http.CanonicalHeaderKey(header)
+	}
+	options.TransformerHeaders = transformerHeaders
+	switch options.DuplicateParams {
+	case "", "first", "last":
+	default:
+		return nil, errors.Errorf("duplicate params selection %q is not one of \"first\" or \"last\"", options.DuplicateParams)
+	}
+	if options.DefaultTransformVersion != 0 {
+		if _, err := transformer.SelectVersion(defaultTransformVersions(options.DefaultTransformVersion)); err != nil {
+			return nil, errors.Wrapf(err, "unsupported default transform version %d", options.DefaultTransformVersion)
+		}
+	}
+
+	var fetchSlots chan struct{}
+	if options.MaxConcurrentFetches > 0 {
+		fetchSlots = make(chan struct{}, options.MaxConcurrentFetches)
+	} else if options.MaxConcurrentFetches < 0 {
+		return nil, errors.Errorf("max concurrent fetches %d is negative", options.MaxConcurrentFetches)
+	}
+
+	return &Signer{cert, key, &client, urlSets, rtvCache, shouldPackage, overrideBaseURL, requireHeaders, recordSize, signatureExpiry, time.Now, options, sync.RWMutex{}, fetchSlots, newRateLimiters(urlSets), networkClients}, nil
+}
+
+// ReloadCert replaces the cert and key used for subsequent signatures, e.g.
+// with a renewed cert, without restarting. Options.ExtraCerts remain in use.
+// As in New, the key must match Options.SignatureAlg, and the cert must carry
+// SCTs if Options.RequireSCT is set and, along with the extra certs, cover at
+// least one URLSet Sign domain if Options.RequireCertCoverage is set. The key
+// must also match the first cert of the chain. Otherwise, an
+// error is returned and the old cert remains in use. Exchanges already signed
+// with the old cert remain valid (though the Cache no longer serves them), so
+// the old cert should continue to be served at its cert URL until they expire
+// (see certcache.Reloadable).
+func (this *Signer) ReloadCert(certs []*x509.Certificate, key crypto.PrivateKey) error {
+	if len(certs) == 0 {
+		return errors.New("no certs")
+	}
+	cert := certs[0]
+	if err := checkKeyMatchesCert(key, cert); err != nil {
+		return err
+	}
+	if err := checkSignatureAlg(this.options.SignatureAlg, key); err != nil {
+		return err
+	}
+	if this.options.RequireCertCoverage {
+		if err := checkCertCoverage(withExtraCerts(cert, this.options.ExtraCerts), this.urlSets); err != nil {
+			return err
+		}
+	}
+	if err := checkSCTs(cert, this.options.RequireSCT); err != nil {
+		return err
+	}
+
+	this.certMu.Lock()
+	defer this.certMu.Unlock()
+	this.cert, this.key = cert, key
+	return nil
+}
+
+// Returns the cert and key with which to sign for the given host: of the
+// current cert and Options.ExtraCerts, the one covering the host with the
+// highest Priority, ties going to the current cert and then to the earliest
+// extra cert. If none covers the host, the current cert is returned (and
+// rejected by checkSignURLCoverage, if Options.RequireCertCoverage is set).
+// Each request should call this once, so that its signature's cert-url and
+// cert-sha256 are consistent.
+func (this *Signer) signingCert(host string) (*x509.Certificate, crypto.PrivateKey) {
+	this.certMu.RLock()
+	best := SigningCert{Cert: this.cert, Key: this.key}
+	this.certMu.RUnlock()
+	covered := best.Cert.VerifyHostname(host) == nil
+	for _, extra := range this.options.ExtraCerts {
+		if extra.Cert.VerifyHostname(host) != nil {
+			continue
+		}
+		if !covered || extra.Priority > best.Priority {
+			best, covered = extra, true
+		}
+	}
+	return best.Cert, best.Key
+}
+
+// Returns the current cert followed by those of Options.ExtraCerts.
+func (this *Signer) certs() []*x509.Certificate {
+	this.certMu.RLock()
+	defer this.certMu.RUnlock()
+	return withExtraCerts(this.cert, this.options.ExtraCerts)
+}
+
+// CanSignDocs returns true if a request to sign the given URL would pass the
+// URLSet matching (and cert coverage; see Options.RequireCertCoverage), e.g.
+// so that a frontend may skip the round-trip to /priv/doc for URLs that
+// would be rejected. It performs no fetch, so the document may still be
+// served unsigned, e.g. if it's invalid AMP.
+func (this *Signer) CanSignDocs(signURL *url.URL) bool {
+	// Normalize it as if it were a sign param.
+	parsed, httpErr := parseURL(signURL.String(), "sign")
+	if httpErr != nil {
+		return false
+	}
+	cert, _ := this.signingCert(parsed.Hostname())
+	if this.checkSignURLCoverage(cert, parsed) != nil {
+		return false
+	}
+	for _, urlSet := range this.urlSets {
+		if urlSet.Sign != nil && signURLMatches(parsed, urlSet.Sign) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the value of a form param, given all its values, as selected by
+// Options.DuplicateParams.
+func selectParam(values []string, selection string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	if selection == "last" {
+		return values[len(values)-1]
+	}
+	return values[0]
+}
 
-	return &Signer{cert, key, &client, urlSets, rtvCache, shouldPackage, overrideBaseURL, requireHeaders}, nil
+// Returns the requested version ranges equivalent to the given default
+// transform version, where 0 means no preference.
+func defaultTransformVersions(version int64) []*rpb.VersionRange {
+	if version == 0 {
+		return nil
+	}
+	return []*rpb.VersionRange{{Min: version, Max: version}}
 }
 
-func (this *Signer) fetchURL(fetch *url.URL, serveHTTPReq *http.Request) (*http.Request, *http.Response, *util.HTTPError) {
+func (this *Signer) fetchURL(fetch *url.URL, serveHTTPReq *http.Request, urlSet *util.URLSet) (_ *http.Request, resp *http.Response, _ *util.HTTPError) {
 	ampURL := fetch.String()
 
 	log.Printf("Fetching URL: %q\n", ampURL)
@@ -200,7 +797,53 @@ func (this *Signer) fetchURL(fetch *url.URL, serveHTTPReq *http.Request) (*http.
 	if err != nil {
 		return nil, nil, util.NewHTTPError(http.StatusInternalServerError, "Error building request: ", err)
 	}
-	req.Header.Set("User-Agent", userAgent)
+	ctx := serveHTTPReq.Context()
+	timeout := this.options.FetchTimeout
+	if this.options.HonorDeadlineHeader {
+		timeout = this.requestedTimeout(serveHTTPReq, timeout)
+	}
+	if timeout > 0 {
+		// The deadline covers all attempts, as well as reading the
+		// body, so it is canceled when the body is closed.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer func() {
+			if resp == nil {
+				cancel()
+			} else {
+				resp.Body = cancelOnClose{resp.Body, cancel}
+			}
+		}()
+	}
+	// Abort the fetch if the client disconnects.
+	req = req.WithContext(ctx)
+	if this.fetchSlots != nil {
+		if httpErr := this.acquireFetchSlot(ctx); httpErr != nil {
+			return nil, nil, httpErr
+		}
+		// The fetch is in flight until its body is closed.
+		var once sync.Once
+		release := func() { once.Do(func() { <-this.fetchSlots }) }
+		defer func() {
+			if resp == nil {
+				release()
+			} else {
+				resp.Body = cancelOnClose{resp.Body, release}
+			}
+		}()
+	}
+	// Copy the allowed headers from ServeHTTP's Request, except for any it
+	// declares hop-by-hop.
+	connectionHeaders := map[string]bool{}
+	for _, header := range util.Comma.Split(GetJoined(serveHTTPReq.Header, "Connection"), -1) {
+		connectionHeaders[http.CanonicalHeaderKey(header)] = true
+	}
+	for _, header := range this.options.ForwardedHeaders {
+		if values, ok := serveHTTPReq.Header[header]; ok && !connectionHeaders[header] {
+			req.Header[header] = values
+		}
+	}
+	req.Header.Set("User-Agent", this.options.FetchUserAgent)
 	// Golang's HTTP parser appears not to validate the protocol it parses
 	// from the request line, so we do so here.
 	if protocol.MatchString(serveHTTPReq.Proto) {
@@ -217,14 +860,148 @@ func (this *Signer) fetchURL(fetch *url.URL, serveHTTPReq *http.Request) (*http.
 			req.Header.Set(header, value)
 		}
 	}
-	resp, err := this.client.Do(req)
+	client := this.client
+	if urlSet.FetchNetwork != "" {
+		client = this.networkClients[urlSet.FetchNetwork]
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err = client.Do(req)
+		// Only connection errors and 5xx responses are considered
+		// transient. The request is a GET without body, so it is safe
+		// to retry.
+		if (err == nil && resp.StatusCode < 500) || attempt >= this.options.FetchRetries {
+			break
+		}
+		if err == nil {
+			log.Printf("Retrying fetch after status %d.\n", resp.StatusCode)
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBodyLength))
+			resp.Body.Close()
+		} else {
+			log.Println("Retrying fetch after error:", err)
+		}
+		if !sleepContext(ctx, retryBackoff(this.options.FetchRetryBackoff, attempt)) {
+			resp, err = nil, ctx.Err()
+			break
+		}
+	}
 	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, nil, util.NewHTTPError(http.StatusGatewayTimeout, "Timed out fetching: ", err)
+		}
 		return nil, nil, util.NewHTTPError(http.StatusBadGateway, "Error fetching: ", err)
 	}
+	canonicalizeHeaderNames(resp.Header)
 	removeHopByHopHeaders(resp)
 	return req, resp, nil
 }
 
+// Rewrites the names in the given header to their canonical form (e.g.
+// "content-type" to "Content-Type"), merging the values of names that
+// differ only by case. net/http canonicalizes the names it parses, but a
+// custom Transport may not. Otherwise, lookups like Get("Content-Type")
+// would miss such headers, and the exchange, which lowercases every name,
+// could repeat one.
+func canonicalizeHeaderNames(header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	// Sort for a deterministic order of merged values.
+	sort.Strings(names)
+	for _, name := range names {
+		canonical := http.CanonicalHeaderKey(strings.ToLower(name))
+		if canonical != name {
+			header[canonical] = append(header[canonical], header[name]...)
+			delete(header, name)
+		}
+	}
+}
+
+// Returns the timeout requested by the given request's deadline header, if
+// valid, bounded by the given max (or the client's timeout, if max is 0 and
+// the client has one). Otherwise, returns max.
+func (this *Signer) requestedTimeout(req *http.Request, max time.Duration) time.Duration {
+	value := req.Header.Get(deadlineHeader)
+	if value == "" {
+		return max
+	}
+	millis, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || millis <= 0 {
+		log.Printf("Ignoring invalid %s header: %q\n", deadlineHeader, value)
+		return max
+	}
+	bound := max
+	if bound <= 0 {
+		bound = this.client.Timeout
+	}
+	requested := time.Duration(millis) * time.Millisecond
+	if bound > 0 && bound < requested {
+		return bound
+	}
+	return requested
+}
+
+// Returns true, after logging, if the given request has been canceled (e.g.
+// the client disconnected), in which case there's no one to respond to.
+func (this *Signer) abortIfCanceled(req *http.Request, signURL *url.URL, start time.Time) bool {
+	err := req.Context().Err()
+	if err == nil {
+		return false
+	}
+	log.Println("Not packaging because the request was canceled:", err)
+	this.options.Logger.Info("Request canceled", "url", signURL, "outcome", "canceled", "error", err, "latency_ms", millisSince(start))
+	return true
+}
+
+// Reserves one of this.fetchSlots, per Options.QueueFetches.
+func (this *Signer) acquireFetchSlot(ctx context.Context) *util.HTTPError {
+	if !this.options.QueueFetches {
+		select {
+		case this.fetchSlots <- struct{}{}:
+			return nil
+		default:
+			return util.NewHTTPError(http.StatusServiceUnavailable, "Too many concurrent fetches")
+		}
+	}
+	select {
+	case this.fetchSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return util.NewHTTPError(http.StatusServiceUnavailable, "Gave up waiting to fetch: ", ctx.Err())
+	}
+}
+
+// Cancels a fetch's context once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (this cancelOnClose) Close() error {
+	defer this.cancel()
+	return this.ReadCloser.Close()
+}
+
+// Returns the delay before the given retry (starting at 0): initial, doubled
+// for each subsequent retry, and jittered by up to ±50% to avoid synchronized
+// retries against the origin.
+func retryBackoff(initial time.Duration, attempt int) time.Duration {
+	backoff := float64(initial << uint(attempt))
+	return time.Duration(backoff * (0.5 + rand.Float64()))
+}
+
+// Sleeps for the given duration, returning false early if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // Some Content-Security-Policy (CSP) configurations have the ability to break
 // AMPHTML document functionality on the AMPHTML Cache if set on the document.
 // This method parses the publisher's provided CSP and mutates it to ensure
@@ -296,43 +1073,138 @@ func (this *Signer) genCertURL(cert *x509.Certificate, signURL *url.URL) (*url.U
 	if err != nil {
 		return nil, errors.Wrapf(err, "parsing cert URL %q", urlPath)
 	}
+	if this.options.CertURLVersion != "" {
+		certHRef.RawQuery = url.Values{util.CertURLVersionParam: {this.options.CertURLVersion}}.Encode()
+	}
 	ret := baseURL.ResolveReference(certHRef)
 	return ret, nil
 }
 
 func (this *Signer) ServeHTTP(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	start := time.Now()
 	resp.Header().Add("Vary", "Accept, AMP-Cache-Transform")
+	if len(this.options.ForwardedHeaders) > 0 {
+		// The origin may vary its response on these.
+		resp.Header().Add("Vary", strings.Join(this.options.ForwardedHeaders, ", "))
+	}
 
+	if req.Method == http.MethodGet && (req.ContentLength > 0 || len(req.TransferEncoding) > 0) {
+		if this.options.ErrorOnGETWithBody {
+			util.NewHTTPError(http.StatusBadRequest, "GET request has a body").LogAndRespond(resp)
+			return
+		}
+		// ParseForm ignores the body of a GET request, so the params
+		// are read from the URL only.
+		log.Println("Ignoring body of GET request.")
+	}
 	if err := req.ParseForm(); err != nil {
 		util.NewHTTPError(http.StatusBadRequest, "Form input parsing failed: ", err).LogAndRespond(resp)
 		return
 	}
 	var fetch, sign string
-	if inPathSignURL := params.ByName("signURL"); inPathSignURL != "" {
+	var debug bool
+	// A bare trailing slash (i.e. /priv/doc/?sign=...) is routed like
+	// /priv/doc.
+	if inPathSignURL := params.ByName("signURL"); inPathSignURL != "" && inPathSignURL != "/" {
 		sign = inPathSignURL[1:] // Strip leading "/" produced by httprouter.
+		if this.options.NotFoundOnExtraPathSegments && !isAbsoluteURL(sign) {
+			util.NewHTTPError(http.StatusNotFound, "Path is neither /priv/doc nor followed by an absolute URL: ", req.URL.Path).LogAndRespond(resp)
+			return
+		}
+		// The query belongs to the sign URL, even if it contains sign or
+		// fetch params, unless the client is deemed confused.
+		if query := req.URL.Query(); this.options.ErrorOnAmbiguousSignURL && (query["sign"] != nil || query["fetch"] != nil) {
+			util.NewHTTPError(http.StatusBadRequest, "Sign URL is in the path, but the query has a sign or fetch param").LogAndRespond(resp)
+			return
+		}
 		if req.URL.RawQuery != "" {
 			sign += "?" + req.URL.RawQuery
 		}
 	} else {
-		if len(req.Form["fetch"]) > 1 {
+		if len(req.Form["fetch"]) > 1 && this.options.DuplicateParams == "" {
 			util.NewHTTPError(http.StatusBadRequest, "More than 1 fetch param").LogAndRespond(resp)
 			return
 		}
-		if len(req.Form["sign"]) != 1 {
+		if len(req.Form["sign"]) == 0 || (len(req.Form["sign"]) > 1 && this.options.DuplicateParams == "") {
 			util.NewHTTPError(http.StatusBadRequest, "Not exactly 1 sign param").LogAndRespond(resp)
 			return
 		}
-		fetch = req.FormValue("fetch")
-		sign = req.FormValue("sign")
+		fetch = selectParam(req.Form["fetch"], this.options.DuplicateParams)
+		sign = selectParam(req.Form["sign"], this.options.DuplicateParams)
+		debug = this.options.DebugEnabled && req.FormValue("debug") == "1"
+	}
+	if this.options.UpgradeSignURLScheme {
+		sign = upgradeScheme(sign)
+	}
+	fetchURL, signURL, urlSet, httpErr := parseURLs(fetch, sign, this.urlSets, this.options.NotFoundOnSignPathMismatch)
+	var cert *x509.Certificate
+	var key crypto.PrivateKey
+	if httpErr == nil {
+		// Use a consistent cert and key for the whole request, even if
+		// ReloadCert is called concurrently.
+		cert, key = this.signingCert(signURL.Hostname())
+		httpErr = this.checkSignURLCoverage(cert, signURL)
 	}
-	fetchURL, signURL, errorOnStatefulHeaders, httpErr := parseURLs(fetch, sign, this.urlSets)
 	if httpErr != nil {
+		this.options.Logger.Info("Rejected URL", "url", sign, "outcome", "error", "error", httpErr, "latency_ms", millisSince(start))
 		httpErr.LogAndRespond(resp)
 		return
 	}
 
-	fetchReq, fetchResp, httpErr := this.fetchURL(fetchURL, req)
+	// Clients that don't accept SXGs (e.g. those that list only
+	// text/html) get the content unsigned. They are identified before the
+	// fetch, so that the work of transforming may be skipped.
+	sxgVersion := this.options.Versions[0]
+	if this.requireHeaders {
+		sxgVersion = accept.Negotiate(GetJoined(req.Header, "Accept"), this.options.Versions)
+	}
+	acceptsSXG := sxgVersion != ""
+	if !acceptsSXG && this.options.ErrorOnUnsatisfiableAccept {
+		util.NewHTTPError(http.StatusNotAcceptable, "Accept request header lacks application/signed-exchange with v in ", this.options.Versions).LogAndRespond(resp)
+		return
+	}
+
+	// The transform version is selected before the fetch, as it's part of
+	// the cache key.
+	var act string
+	var transformVersion int64
+	var transformVersionErr error
+	if this.requireHeaders {
+		act, transformVersion = amp_cache_transform.ShouldSendSXGFor(GetJoined(req.Header, "AMP-Cache-Transform"), this.options.TransformIdentities, this.options.DefaultTransformVersion)
+	} else {
+		transformVersion, transformVersionErr = transformer.SelectVersion(defaultTransformVersions(this.options.DefaultTransformVersion))
+	}
+
+	// Serve a previously signed exchange if possible. Debug requests
+	// bypass the cache, so that the signed bytes are dumped, or the
+	// exchange is described, as do conditional requests, so that the
+	// origin may respond to them.
+	var cacheKey string
+	if this.options.Cache != nil && acceptsSXG && (!this.requireHeaders || act != "") && transformVersionErr == nil && !this.shouldDumpSignedBytes(req) && !debug && !isConditional(req) {
+		keyParts := []string{util.CertName(cert), fetchURL.String(), signURL.String(), getRTV(this.rtvCache), sxgVersion, strconv.FormatInt(transformVersion, 10)}
+		for _, header := range this.options.ForwardedHeaders {
+			keyParts = append(keyParts, strconv.Quote(GetJoined(req.Header, header)))
+		}
+		cacheKey = strings.Join(keyParts, " ")
+		if cached, ok := this.options.Cache.Get(cacheKey); ok && this.shouldPackage(req) {
+			if act != "" {
+				resp.Header().Set("AMP-Cache-Transform", act)
+			}
+			writeExchange(resp, sxgVersion, cached)
+			this.options.Logger.Info("Served cached exchange", "url", signURL, "outcome", "signed", "latency_ms", millisSince(start))
+			return
+		}
+	}
+
+	if !this.rateLimiters[urlSet].allow(this.nowFunc()) {
+		this.options.Logger.Info("Rate limited", "url", signURL, "outcome", "error", "latency_ms", millisSince(start))
+		util.NewHTTPError(http.StatusTooManyRequests, "URLSet rate limit exceeded for ", signURL).LogAndRespond(resp)
+		return
+	}
+
+	fetchReq, fetchResp, httpErr := this.fetchURL(fetchURL, req, urlSet)
 	if httpErr != nil {
+		this.options.Logger.Error("Fetch failed", "url", signURL, "outcome", "error", "error", httpErr, "latency_ms", millisSince(start))
 		httpErr.LogAndRespond(resp)
 		return
 	}
@@ -343,70 +1215,110 @@ func (this *Signer) ServeHTTP(resp http.ResponseWriter, req *http.Request, param
 		}
 	}()
 
-	if !this.shouldPackage() {
-		log.Println("Not packaging because server is unhealthy; see above log statements.")
-		proxy(resp, fetchResp, nil)
+	if !this.shouldPackage(req) {
+		log.Println("Not packaging because shouldPackage returned false (e.g. server is unhealthy); see above log statements.")
+		this.proxy(resp, fetchResp, nil)
 		return
 	}
-	var transformVersion int64
 	if this.requireHeaders {
-		header_value := GetJoined(req.Header, "AMP-Cache-Transform")
-		var act string
-		act, transformVersion = amp_cache_transform.ShouldSendSXG(header_value)
 		if act == "" {
-			log.Println("Not packaging because AMP-Cache-Transform request header is invalid:", header_value)
-			proxy(resp, fetchResp, nil)
+			log.Println("Not packaging because AMP-Cache-Transform request header is invalid:", GetJoined(req.Header, "AMP-Cache-Transform"))
+			this.proxy(resp, fetchResp, nil)
 			return
 		}
 		resp.Header().Set("AMP-Cache-Transform", act)
-	} else {
-		var err error
-		transformVersion, err = transformer.SelectVersion(nil)
-		if err != nil {
-			log.Println("Not packaging because of internal SelectVersion error:", err)
-			proxy(resp, fetchResp, nil)
-		}
+	} else if transformVersionErr != nil {
+		log.Println("Not packaging because of internal SelectVersion error:", transformVersionErr)
+		this.proxy(resp, fetchResp, nil)
+		return
 	}
-	if this.requireHeaders && !accept.CanSatisfy(GetJoined(req.Header, "Accept")) {
-		log.Printf("Not packaging because Accept request header lacks application/signed-exchange;v=%s.\n", accept.AcceptedSxgVersion)
-		proxy(resp, fetchResp, nil)
+	if !acceptsSXG {
+		log.Printf("Not packaging because Accept request header lacks application/signed-exchange with v in %v.\n", this.options.Versions)
+		this.proxy(resp, fetchResp, nil)
 		return
 	}
 
 	switch fetchResp.StatusCode {
 	case 200:
+		var debugInfo *debugExchange
+		if debug {
+			debugInfo = &debugExchange{FetchURL: fetchURL.String(), SignURL: signURL.String(), upstreamHeaders: sortedHeaderNames(fetchResp.Header)}
+		}
 		// If fetchURL returns an OK status, then validate, munge, and package.
-		if err := validateFetch(fetchReq, fetchResp); err != nil {
+		if err := this.applyBOM(fetchResp); err != nil {
+			log.Println("Not packaging because of charset conflict: ", err)
+			this.options.Logger.Info("Invalid fetch", "url", signURL, "outcome", "unsigned", "error", err, "latency_ms", millisSince(start))
+			this.proxy(resp, fetchResp, nil)
+			return
+		}
+		// validateFetch accepts only text/html, so XHTML is validated as
+		// such. It's relabeled for the exchange once transformed, and
+		// proxied as is otherwise.
+		contentType := fetchResp.Header.Get("Content-Type")
+		relabeled := this.options.AcceptXHTML && relabelXHTML(fetchResp.Header)
+		err := validateFetch(fetchReq, fetchResp)
+		if relabeled {
+			fetchResp.Header.Set("Content-Type", contentType)
+		}
+		if err != nil {
 			log.Println("Not packaging because of invalid fetch: ", err)
-			proxy(resp, fetchResp, nil)
+			this.options.Logger.Info("Invalid fetch", "url", signURL, "outcome", "unsigned", "error", err, "latency_ms", millisSince(start))
+			this.proxy(resp, fetchResp, nil)
 			return
 		}
 		for header := range statefulResponseHeaders {
-			if errorOnStatefulHeaders && GetJoined(fetchResp.Header, header) != "" {
+			if urlSet.Sign.ErrorOnStatefulHeaders && GetJoined(fetchResp.Header, header) != "" {
 				log.Println("Not packaging because ErrorOnStatefulHeaders = True and fetch response contains stateful header: ", header)
-				proxy(resp, fetchResp, nil)
+				this.proxy(resp, fetchResp, nil)
 				return
 			}
 			fetchResp.Header.Del(header)
 		}
 
 		// Mutate the fetched CSP to make sure it cannot break AMP pages.
+		// Set replaces any upstream values, so the exchange has exactly
+		// one CSP.
+		fetchedCSP := fetchResp.Header.Get("Content-Security-Policy")
+		if this.options.OverrideUpstreamCSP {
+			fetchedCSP = ""
+		}
 		fetchResp.Header.Set(
 			"Content-Security-Policy",
-			MutateFetchedContentSecurityPolicy(
-				fetchResp.Header.Get("Content-Security-Policy")))
+			MutateFetchedContentSecurityPolicy(fetchedCSP))
 
-		fetchResp.Header.Del("Link") // Ensure there are no privacy-violating Link:rel=preload headers.
+		if !this.options.MergeUpstreamLinkHeaders {
+			fetchResp.Header.Del("Link") // Ensure there are no privacy-violating Link:rel=preload headers.
+		}
 
 		if fetchResp.Header.Get("Variants") != "" || fetchResp.Header.Get("Variant-Key") != "" {
 			// Variants headers (https://tools.ietf.org/html/draft-ietf-httpbis-variants-04) are disallowed by AMP Cache.
 			// We could delete the headers, but it's safest to assume they reflect the downstream server's intent.
 			log.Println("Not packaging because response contains a Variants header.")
-			proxy(resp, fetchResp, nil)
+			this.proxy(resp, fetchResp, nil)
 			return
 		}
 
-		this.serveSignedExchange(resp, fetchResp, signURL, transformVersion)
+		if refresh := GetJoined(fetchResp.Header, "Refresh"); refresh != "" && this.options.ErrorOnRefreshHeader {
+			// Like <meta http-equiv=refresh>, this implies a redirect.
+			log.Printf("Not packaging because response contains a Refresh header: %q\n", refresh)
+			this.proxy(resp, fetchResp, nil)
+			return
+		}
+
+		if maxAge, ok := upstreamMaxAge(fetchResp.Header); ok && maxAge <= 0 {
+			// The signature would expire as soon as it's made.
+			log.Println("Not packaging because response has a max-age of 0.")
+			this.proxy(resp, fetchResp, nil)
+			return
+		}
+
+		if field := unsupportedVary(fetchResp.Header); field != "" && this.options.ErrorOnUnsupportedVary {
+			log.Println("Not packaging because response varies on unsupported header:", field)
+			this.proxy(resp, fetchResp, nil)
+			return
+		}
+
+		this.serveSignedExchange(resp, req, fetchResp, signURL, urlSet, sxgVersion, transformVersion, cacheKey, cert, key, start, debugInfo)
 
 	case 304:
 		// If fetchURL returns a 304, then also return a 304 with appropriate headers.
@@ -417,118 +1329,1026 @@ func (this *Signer) ServeHTTP(resp http.ResponseWriter, req *http.Request, param
 		}
 		resp.WriteHeader(http.StatusNotModified)
 
+	case 206:
+		// A partial body is never signable, as the exchange's payload
+		// must be the whole document. This can happen if Range is among
+		// the ForwardedHeaders.
+		log.Println("Not packaging because response is 206 Partial Content.")
+		this.proxy(resp, fetchResp, nil)
+
 	default:
 		log.Printf("Not packaging because status code %d is unrecognized.\n", fetchResp.StatusCode)
-		proxy(resp, fetchResp, nil)
+		this.proxy(resp, fetchResp, nil)
 	}
 }
 
-func formatLinkHeader(preloads []*rpb.Metadata_Preload) (string, error) {
-	var values []string
+// PreloadResource is a resource preloaded (or an origin preconnected to) by
+// the Link header of a signed exchange.
+type PreloadResource struct {
+	// The URL, escaped as in the Link header.
+	URL string
+	// The link relation: "preload", or "preconnect" (see
+	// Options.ExtendedPreloads).
+	Rel string
+	// The request destination, e.g. "script" or "style". Empty for
+	// preconnects.
+	As string
+	// The CORS settings with which the resource is requested: "" (no CORS),
+	// "anonymous", or "use-credentials".
+	CrossOrigin string
+	// The media query for which the resource is preloaded, if any (see
+	// Options.PreloadMedia).
+	Media string
+	// The image candidates and sizes from which the browser selects the
+	// image to preload, if any (see Options.PreloadHeroSrcset).
+	ImageSrcset, ImageSizes string
+}
+
+// PreloadResources returns the resources that the Link header of the signed
+// exchange for the given document would preload, in order, e.g. for building
+// an HTTP/2 push manifest for edge servers that don't parse Link headers. The
+// document is transformed at the default transform version. Upstream Link
+// headers (see Options.MergeUpstreamLinkHeaders) aren't included.
+func (this *Signer) PreloadResources(body []byte, signURL *url.URL) ([]PreloadResource, error) {
+	r := getTransformerRequest(this.rtvCache, string(body), signURL.String(), this.options.AllowedFormats)
+	version, err := transformer.SelectVersion(defaultTransformVersions(this.options.DefaultTransformVersion))
+	if err != nil {
+		return nil, errors.Wrap(err, "selecting transform version")
+	}
+	r.Version = version
+	transformed, metadata, err := transformer.Process(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "transforming")
+	}
+	return this.linkResources(transformed, metadata, signURL)
+}
+
+// Returns the resources for the Link header of the given transformed
+// document: its preloads, followed by any preconnects.
+func (this *Signer) linkResources(transformed string, metadata *rpb.Metadata, signURL *url.URL) ([]PreloadResource, error) {
+	resources, err := preloadResources(this.preloads(transformed, metadata, signURL))
+	if err != nil {
+		return nil, err
+	}
+	if !this.options.PreloadMedia {
+		for i := range resources {
+			resources[i].Media = ""
+		}
+	}
+	if !this.options.PreloadHeroSrcset {
+		for i := range resources {
+			resources[i].ImageSrcset, resources[i].ImageSizes = "", ""
+		}
+	}
+	if this.options.ExtendedPreloads {
+		_, preconnects := linkHints(transformed, signURL)
+		resources = append(resources, preconnects...)
+	}
+	return resources, nil
+}
+
+// Returns the number of resources that are preloads, rather than
+// preconnects.
+func countPreloads(resources []PreloadResource) int {
+	n := 0
+	for _, resource := range resources {
+		if resource.Rel == "preload" {
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the preloads for the given transformed document, per the Options.
+func (this *Signer) preloads(transformed string, metadata *rpb.Metadata, signURL *url.URL) []*rpb.Metadata_Preload {
+	preloads := metadata.Preloads
+	if this.options.ExcludeRuntimePreload {
+		preloads = withoutAMPRuntime(preloads)
+	}
+	if this.options.PreloadDataFetches {
+		preloads = append(preloads, dataFetchPreloads(transformed, signURL)...)
+	}
+	if this.options.ExtendedPreloads {
+		hints, _ := linkHints(transformed, signURL)
+		preloads = append(preloads, hints...)
+	}
+	return capPreloads(dedupePreloads(preloads), this.options.MaxPreloads)
+}
+
+// Returns the given preloads, without any whose URL duplicates an earlier one.
+func dedupePreloads(preloads []*rpb.Metadata_Preload) []*rpb.Metadata_Preload {
+	seen := map[string]bool{}
+	var deduped []*rpb.Metadata_Preload
+	for _, preload := range preloads {
+		if !seen[preload.Url] {
+			seen[preload.Url] = true
+			deduped = append(deduped, preload)
+		}
+	}
+	return deduped
+}
+
+// Returns at most max of the given preloads, in order. Stylesheets and scripts
+// are kept in preference to other types, as they block rendering.
+func capPreloads(preloads []*rpb.Metadata_Preload, max int) []*rpb.Metadata_Preload {
+	if len(preloads) <= max {
+		return preloads
+	}
+	keep := make([]bool, len(preloads))
+	kept := 0
+	for _, preferred := range []bool{true, false} {
+		for i, preload := range preloads {
+			if kept < max && (preload.As == "style" || preload.As == "script") == preferred {
+				keep[i] = true
+				kept++
+			}
+		}
+	}
+	var capped []*rpb.Metadata_Preload
+	for i, preload := range preloads {
+		if keep[i] {
+			capped = append(capped, preload)
+		}
+	}
+	return capped
+}
+
+// Validates the given preloads, and escapes their URLs for the Link header.
+func preloadResources(preloads []*rpb.Metadata_Preload) ([]PreloadResource, error) {
+	var resources []PreloadResource
 	for _, preload := range preloads {
 		u, err := url.Parse(preload.Url)
 		if err != nil {
-			return "", errors.Wrapf(err, "Invalid preload URL: %q\n", preload.Url)
+			return nil, errors.Wrapf(err, "Invalid preload URL: %q\n", preload.Url)
 		}
 		// Percent-escape any characters in the query that aren't valid
 		// URL characters (but don't escape '=' or '&').
 		u.RawQuery = url.PathEscape(u.RawQuery)
 
 		if preload.As == "" {
-			return "", errors.Errorf("Missing `as` attribute for preload URL: %q\n", preload.Url)
+			return nil, errors.Errorf("Missing `as` attribute for preload URL: %q\n", preload.Url)
 		}
+		resources = append(resources, PreloadResource{u.String(), "preload", preload.As, preload.Crossorigin, preload.Media, preload.Imagesrcset, preload.Imagesizes})
+	}
+	return resources, nil
+}
 
+func formatLinkHeader(resources []PreloadResource) string {
+	var values []string
+	for _, resource := range resources {
 		var value strings.Builder
 		value.WriteByte('<')
-		value.WriteString(u.String())
-		value.WriteString(">;rel=preload;as=")
-		value.WriteString(preload.As)
+		value.WriteString(resource.URL)
+		value.WriteString(">;rel=")
+		value.WriteString(resource.Rel)
+		if resource.As != "" {
+			value.WriteString(";as=")
+			value.WriteString(resource.As)
+		}
+		switch resource.CrossOrigin {
+		case "anonymous":
+			value.WriteString(";crossorigin")
+		case "use-credentials":
+			value.WriteString(";crossorigin=use-credentials")
+		}
+		if resource.Media != "" {
+			value.WriteString(";media=")
+			value.WriteString(quoteLinkParam(resource.Media))
+		}
+		if resource.ImageSrcset != "" {
+			value.WriteString(";imagesrcset=")
+			value.WriteString(quoteLinkParam(resource.ImageSrcset))
+			if resource.ImageSizes != "" {
+				value.WriteString(";imagesizes=")
+				value.WriteString(quoteLinkParam(resource.ImageSizes))
+			}
+		}
 		values = append(values, value.String())
 	}
-	return strings.Join(values, ","), nil
+	return strings.Join(values, ",")
+}
+
+// Returns the given Link param value as a quoted-string, per
+// https://tools.ietf.org/html/rfc7230#section-3.2.6.
+func quoteLinkParam(value string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for _, c := range value {
+		if c == '"' || c == '\\' {
+			quoted.WriteByte('\\')
+		}
+		quoted.WriteRune(c)
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// The URL prefix of the AMP runtime script, as well as its possible suffixes
+// (for AMP and AMP4ADS, respectively).
+const (
+	ampRuntimePrefix     = "https://cdn.ampproject.org/"
+	ampRuntimeSuffix     = "/v0.js"
+	amp4AdsRuntimeSuffix = "/amp4ads-v0.js"
+)
+
+// Returns true if rawURL has a scheme and host, i.e. it can't be mistaken for
+// extra path segments.
+func isAbsoluteURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.IsAbs() && u.Host != ""
+}
+
+// Lowercases the charset param of the Content-Type header (e.g. UTF-8 becomes
+// utf-8), reformatting the header canonically. Unparseable values are left
+// unchanged.
+func normalizeCharset(header http.Header) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || params["charset"] == "" {
+		return
+	}
+	params["charset"] = strings.ToLower(params["charset"])
+	header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+}
+
+// Relabels an application/xhtml+xml Content-Type as text/html, preserving its
+// params, and returns true if it did. The transforms parse the document as
+// HTML and output HTML either way.
+func relabelXHTML(header http.Header) bool {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "application/xhtml+xml" {
+		return false
+	}
+	header.Set("Content-Type", mime.FormatMediaType("text/html", params))
+	return true
+}
+
+// The byte order marks of the UTF encodings, and the charsets they signify.
+// See https://encoding.spec.whatwg.org/#bom-sniff.
+var boms = []struct {
+	bom     string
+	charset string
+}{
+	{"\xEF\xBB\xBF", "utf-8"},
+	{"\xFE\xFF", "utf-16be"},
+	{"\xFF\xFE", "utf-16le"},
+}
+
+// Reconciles the charset of the Content-Type header with the byte order mark
+// of the body, if any. A charset that disagrees with the BOM (where a missing
+// charset means utf-8, per validateFetch) is an error, unless
+// Options.PreferBOMCharset is set, in which case the BOM wins: a UTF-16 body
+// is transcoded to UTF-8, and the charset is set to utf-8. Either way,
+// fetchResp.Body is replaced with one that yields the (possibly transcoded)
+// body in full.
+func (this *Signer) applyBOM(fetchResp *http.Response) error {
+	buffered := bufio.NewReader(fetchResp.Body)
+	fetchResp.Body = struct {
+		io.Reader
+		io.Closer
+	}{buffered, fetchResp.Body}
+	prefix, _ := buffered.Peek(3)
+	var bomCharset string
+	for _, bom := range boms {
+		if bytes.HasPrefix(prefix, []byte(bom.bom)) {
+			bomCharset = bom.charset
+			break
+		}
+	}
+	if bomCharset == "" {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(fetchResp.Header.Get("Content-Type"))
+	if err != nil {
+		// validateFetch rejects this.
+		return nil
+	}
+	charset := strings.ToLower(params["charset"])
+	if charset == "" {
+		charset = "utf-8"
+	}
+	if charset == bomCharset && charset == "utf-8" {
+		return nil
+	}
+	if !this.options.PreferBOMCharset {
+		if charset == bomCharset {
+			// validateFetch rejects the charset.
+			return nil
+		}
+		return errors.Errorf("Content-Type charset %s conflicts with %s BOM", charset, bomCharset)
+	}
+	params["charset"] = "utf-8"
+	fetchResp.Header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	if bomCharset == "utf-8" {
+		return nil
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if bomCharset == "utf-16le" {
+		order = binary.LittleEndian
+	}
+	// The transcoded length differs.
+	fetchResp.ContentLength = -1
+	fetchResp.Header.Del("Content-Length")
+	fetchResp.Body = struct {
+		io.Reader
+		io.Closer
+	}{&utf16Reader{r: buffered, order: order}, fetchResp.Body}
+	return nil
+}
+
+// Transcodes UTF-16 to UTF-8, replacing unpaired surrogates and a trailing odd
+// byte with U+FFFD.
+type utf16Reader struct {
+	r       *bufio.Reader
+	order   binary.ByteOrder
+	pending []byte
+}
+
+func (this *utf16Reader) Read(p []byte) (int, error) {
+	for len(this.pending) == 0 {
+		var unit [2]byte
+		if _, err := io.ReadFull(this.r, unit[:]); err == io.ErrUnexpectedEOF {
+			this.pending = []byte(string(utf8.RuneError))
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		r := rune(this.order.Uint16(unit[:]))
+		if utf16.IsSurrogate(r) {
+			next, err := this.r.Peek(2)
+			if err == nil {
+				r = utf16.DecodeRune(r, rune(this.order.Uint16(next)))
+			} else {
+				r = utf8.RuneError
+			}
+			if r != utf8.RuneError {
+				this.r.Discard(2)
+			}
+		}
+		this.pending = []byte(string(r))
+	}
+	n := copy(p, this.pending)
+	this.pending = this.pending[n:]
+	return n, nil
+}
+
+// Reformats the Last-Modified header as an IMF-fixdate in GMT (e.g. Mon, 01 Oct
+// 2018 12:00:00 GMT), the preferred format per
+// https://tools.ietf.org/html/rfc7231#section-7.1.1.1. Unparseable values are
+// removed.
+func normalizeLastModified(header http.Header) {
+	value := header.Get("Last-Modified")
+	if value == "" {
+		return
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		header.Del("Last-Modified")
+		return
+	}
+	header.Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+}
+
+// Returns the given preloads, minus any for the AMP runtime script.
+func withoutAMPRuntime(preloads []*rpb.Metadata_Preload) []*rpb.Metadata_Preload {
+	var ret []*rpb.Metadata_Preload
+	for _, preload := range preloads {
+		isRuntime := preload.As == "script" && strings.HasPrefix(preload.Url, ampRuntimePrefix) &&
+			(strings.HasSuffix(preload.Url, ampRuntimeSuffix) || strings.HasSuffix(preload.Url, amp4AdsRuntimeSuffix))
+		if !isRuntime {
+			ret = append(ret, preload)
+		}
+	}
+	return ret
+}
+
+// Splits the given Link header value into its comma-separated link-values,
+// ignoring commas within the <URI-Reference> or quoted-string params of each.
+func splitLinkHeader(value string) []string {
+	var links []string
+	start, inURI, inQuote, escaped := 0, false, false, false
+	for i, c := range value {
+		if inQuote {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inQuote = false
+			}
+			continue
+		}
+		switch c {
+		case '<':
+			inURI = true
+		case '>':
+			inURI = false
+		case '"':
+			inQuote = !inURI
+		case ',':
+			if !inURI {
+				links = append(links, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	links = append(links, value[start:])
+	var ret []string
+	for _, link := range links {
+		if link = strings.TrimSpace(link); link != "" {
+			ret = append(ret, link)
+		}
+	}
+	return ret
+}
+
+// Returns the generated Link header value, followed by those upstream
+// link-values whose URI-References aren't already in it. Malformed upstream
+// link-values are dropped.
+func mergeLinkHeaders(generated string, upstream string) string {
+	links := splitLinkHeader(generated)
+	seen := map[string]bool{}
+	for _, link := range links {
+		seen[link[:strings.IndexByte(link, '>')+1]] = true
+	}
+	for _, link := range splitLinkHeader(upstream) {
+		end := strings.IndexByte(link, '>')
+		if !strings.HasPrefix(link, "<") || end < 0 {
+			continue
+		}
+		if uri := link[:end+1]; !seen[uri] {
+			seen[uri] = true
+			links = append(links, link)
+		}
+	}
+	return strings.Join(links, ",")
+}
+
+// The max number of data fetch preloads to add, to bound the size of the Link
+// header.
+const maxDataFetchPreloads = 5
+
+// The default max number of preloads in the Link header (see
+// Options.MaxPreloads). This matches the limit applied by the transformer,
+// which AMP Caches should enforce.
+const defaultMaxPreloads = 20
+
+// Returns as=fetch preloads for the JSON endpoints of the <amp-list> and
+// <amp-state> elements in the given document, resolved relative to base. Only
+// https endpoints requested without credentials are included, so that the
+// preload matches the element's request.
+func dataFetchPreloads(body string, base *url.URL) []*rpb.Metadata_Preload {
+	var preloads []*rpb.Metadata_Preload
+	tokenizer := html.NewTokenizer(strings.NewReader(body))
+	for len(preloads) < maxDataFetchPreloads {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return preloads
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data != "amp-list" && token.Data != "amp-state" {
+				continue
+			}
+			var src, credentials string
+			for _, attr := range token.Attr {
+				switch attr.Key {
+				case "src":
+					src = attr.Val
+				case "credentials":
+					credentials = attr.Val
+				}
+			}
+			if src == "" || credentials == "include" {
+				continue
+			}
+			u, err := base.Parse(src)
+			if err != nil || u.Scheme != "https" {
+				continue
+			}
+			// amp-list and amp-state make CORS requests.
+			preloads = append(preloads, &rpb.Metadata_Preload{Url: u.String(), As: "fetch", Crossorigin: "anonymous"})
+		}
+	}
+	return preloads
+}
+
+// The max number of preconnects to add, to bound the size of the Link header.
+const maxPreconnects = 5
+
+// Returns the author-supplied resource hints in the given document, resolved
+// relative to base: as=font preloads from <link rel=preload as=font> and
+// as=image preloads from <amp-img data-hero> hero images, followed by the
+// origins of <link rel=preconnect>. The <link>s are only recognized in the
+// <head>. Only https URLs are included.
+func linkHints(body string, base *url.URL) ([]*rpb.Metadata_Preload, []PreloadResource) {
+	var preloads []*rpb.Metadata_Preload
+	var preconnects []PreloadResource
+	seenOrigins := map[string]bool{}
+	inHead := false
+	tokenizer := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			return preloads, preconnects
+		case html.EndTagToken:
+			if tokenizer.Token().Data == "head" {
+				inHead = false
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			attrs := map[string]string{}
+			for _, attr := range token.Attr {
+				attrs[attr.Key] = attr.Val
+			}
+			switch token.Data {
+			case "head":
+				inHead = true
+			case "body":
+				inHead = false
+			case "link":
+				if !inHead {
+					continue
+				}
+				u, err := base.Parse(attrs["href"])
+				if err != nil || u.Scheme != "https" || attrs["href"] == "" {
+					continue
+				}
+				rels := map[string]bool{}
+				for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+					rels[rel] = true
+				}
+				if rels["preload"] && strings.EqualFold(attrs["as"], "font") {
+					// Fonts are always fetched in CORS mode, so the
+					// preload is anonymous even without crossorigin.
+					crossOrigin := "anonymous"
+					if strings.EqualFold(attrs["crossorigin"], "use-credentials") {
+						crossOrigin = "use-credentials"
+					}
+					preloads = append(preloads, &rpb.Metadata_Preload{Url: u.String(), As: "font", Crossorigin: crossOrigin, Media: strings.TrimSpace(attrs["media"])})
+				}
+				if origin := "https://" + u.Host; rels["preconnect"] && !seenOrigins[origin] && len(preconnects) < maxPreconnects {
+					seenOrigins[origin] = true
+					preconnects = append(preconnects, PreloadResource{URL: origin, Rel: "preconnect"})
+				}
+			case "amp-img":
+				if _, ok := attrs["data-hero"]; !ok || attrs["src"] == "" {
+					continue
+				}
+				u, err := base.Parse(attrs["src"])
+				if err != nil || u.Scheme != "https" {
+					continue
+				}
+				preload := &rpb.Metadata_Preload{Url: u.String(), As: "image"}
+				if srcset, ok := resolveSrcset(attrs["srcset"], base); ok {
+					preload.Imagesrcset, preload.Imagesizes = srcset, strings.TrimSpace(attrs["sizes"])
+				}
+				preloads = append(preloads, preload)
+			}
+		}
+	}
+}
+
+// Returns the given srcset attribute value with the URL of each image
+// candidate resolved against base, or false if it has no candidates or any
+// URL isn't https. See
+// https://html.spec.whatwg.org/multipage/images.html#srcset-attribute.
+func resolveSrcset(srcset string, base *url.URL) (string, bool) {
+	const whitespace = " \t\n\f\r"
+	var candidates []string
+	rest := srcset
+	for {
+		rest = strings.TrimLeft(rest, whitespace+",")
+		if rest == "" {
+			break
+		}
+		end := strings.IndexAny(rest, whitespace)
+		if end < 0 {
+			end = len(rest)
+		}
+		rawURL := rest[:end]
+		rest = rest[end:]
+		var descriptor string
+		if trimmed := strings.TrimRight(rawURL, ","); trimmed != rawURL {
+			// A URL followed directly by a comma has no descriptor.
+			rawURL = trimmed
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			descriptor = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		u, err := base.Parse(rawURL)
+		if err != nil || u.Scheme != "https" {
+			return "", false
+		}
+		candidate := u.String()
+		if descriptor != "" {
+			candidate += " " + descriptor
+		}
+		candidates = append(candidates, candidate)
+	}
+	return strings.Join(candidates, ", "), len(candidates) > 0
+}
+
+// True iff the request bears the secret configured by
+// Options.DebugSignedBytesToken.
+func (this *Signer) shouldDumpSignedBytes(req *http.Request) bool {
+	if this.options.DebugSignedBytesToken == "" {
+		return false
+	}
+	token := req.Header.Get(debugSignedBytesHeader)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(this.options.DebugSignedBytesToken)) == 1
 }
 
 // serveSignedExchange does the actual work of transforming, packaging and signed and writing to the response.
-func (this *Signer) serveSignedExchange(resp http.ResponseWriter, fetchResp *http.Response, signURL *url.URL, transformVersion int64) {
+// If debug is non-nil, it is filled in and written instead of the exchange.
+func (this *Signer) serveSignedExchange(resp http.ResponseWriter, req *http.Request, fetchResp *http.Response, signURL *url.URL, urlSet *util.URLSet, sxgVersion string, transformVersion int64, cacheKey string, cert *x509.Certificate, key crypto.PrivateKey, start time.Time, debug *debugExchange) {
+	if contentTypeOptions := fetchResp.Header.Get("X-Content-Type-Options"); contentTypeOptions != "" && !strings.EqualFold(strings.TrimSpace(contentTypeOptions), "nosniff") && this.options.ErrorOnNonNosniff {
+		log.Printf("Not packaging because X-Content-Type-Options is %q.\n", contentTypeOptions)
+		this.proxy(resp, fetchResp, nil)
+		return
+	}
 	fetchResp.Header.Set("X-Content-Type-Options", "nosniff")
 
+	// http.Client transparently decompresses gzipped responses, so the
+	// decompressed size is only known by reading it.
+	limitDecompressed := fetchResp.Uncompressed && this.options.MaxDecompressedBodyBytes > 0 && int64(this.options.MaxDecompressedBodyBytes) < this.options.MaxBodyBytes
+	// Read one byte past the limit, to detect oversized bodies.
+	readLimit := this.options.MaxBodyBytes + 1
+	if limitDecompressed {
+		readLimit = int64(this.options.MaxDecompressedBodyBytes) + 1
+	}
+
 	// After this, fetchResp.Body is consumed, and attempts to read or proxy it will result in an empty body.
-	fetchBody, err := ioutil.ReadAll(io.LimitReader(fetchResp.Body, maxBodyLength))
+	fetchBody, err := ioutil.ReadAll(io.LimitReader(fetchResp.Body, readLimit))
+	if limitDecompressed && len(fetchBody) > this.options.MaxDecompressedBodyBytes {
+		this.serveOversized(resp, fetchResp, fetchBody, "Decompressed body", int64(this.options.MaxDecompressedBodyBytes))
+		return
+	}
+	if int64(len(fetchBody)) > this.options.MaxBodyBytes {
+		this.serveOversized(resp, fetchResp, fetchBody, "Body", this.options.MaxBodyBytes)
+		return
+	}
+	// A body shorter than its Content-Length results in ErrUnexpectedEOF.
+	// (Note that http.Client truncates a body longer than its
+	// Content-Length, so that can't be detected here.)
+	mismatched := err == io.ErrUnexpectedEOF || (err == nil && fetchResp.ContentLength >= 0 && int64(len(fetchBody)) != fetchResp.ContentLength)
+	if mismatched && this.options.ErrorOnContentLengthMismatch {
+		log.Printf("Not packaging because body length %d doesn't match Content-Length %d.\n", len(fetchBody), fetchResp.ContentLength)
+		fetchResp.Header.Del("Content-Length")
+		this.proxy(resp, fetchResp, fetchBody)
+		return
+	}
 	if err != nil {
 		util.NewHTTPError(http.StatusBadGateway, "Error reading body: ", err).LogAndRespond(resp)
 		return
 	}
 
+	if len(fetchBody) < this.options.MinBodyBytes {
+		log.Printf("Not packaging because body is shorter than %d bytes.\n", this.options.MinBodyBytes)
+		this.options.Logger.Info("Body too small", "url", signURL, "outcome", "unsigned", "bytes", len(fetchBody), "latency_ms", millisSince(start))
+		this.proxy(resp, fetchResp, fetchBody)
+		return
+	}
+
+	if this.options.ErrorOnMissingDoctype && !hasHTMLDoctype(fetchBody) {
+		log.Println("Not packaging because document doesn't begin with <!doctype html>.")
+		this.proxy(resp, fetchResp, fetchBody)
+		return
+	}
+
+	if !hasViewportMeta(fetchBody) {
+		if this.options.ErrorOnMissingViewport {
+			log.Println("Not packaging because document is missing <meta name=viewport>.")
+			this.proxy(resp, fetchResp, fetchBody)
+			return
+		}
+		if this.options.WarnOnMissingViewport {
+			log.Println("Warning: document is missing <meta name=viewport>; it is likely invalid AMP.")
+		}
+	}
+
+	if this.options.MaxInlineDataBytes > 0 {
+		if n := inlineDataBytes(fetchBody); n > this.options.MaxInlineDataBytes {
+			log.Printf("Not packaging because document has %d bytes of inline data: URIs, exceeding %d.\n", n, this.options.MaxInlineDataBytes)
+			this.proxy(resp, fetchResp, fetchBody)
+			return
+		}
+	}
+
+	if len(this.options.DeniedExtensionSrcs) > 0 {
+		if src := deniedExtensionSrc(fetchBody, this.options.DeniedExtensionSrcs); src != "" {
+			log.Println("Not packaging because document uses denied extension:", src)
+			this.options.Logger.Info("Denied extension", "url", signURL, "outcome", "unsigned", "src", src, "latency_ms", millisSince(start))
+			this.proxy(resp, fetchResp, fetchBody)
+			return
+		}
+	}
+
+	if this.options.Validator != nil {
+		// The transformer rejects undeclared or disallowed formats below.
+		format, _ := transformer.DeclaredFormat(string(fetchBody))
+		if err := this.options.Validator.Validate(fetchBody, format); err != nil {
+			log.Println("Not packaging because document is invalid AMP:", err)
+			this.options.Logger.Info("Invalid AMP", "url", signURL, "outcome", "unsigned", "error", err, "latency_ms", millisSince(start))
+			this.proxy(resp, fetchResp, fetchBody)
+			return
+		}
+	}
+
+	var rtvWait time.Duration
+	if this.options.RTVUnavailable == "wait" {
+		rtvWait = this.options.RTVWaitTimeout
+	}
+	rtvPopulated := isRTVPopulated(this.rtvCache, rtvWait)
+	if !rtvPopulated && (this.options.RTVUnavailable == "wait" || this.options.RTVUnavailable == "proxy") {
+		log.Println("Not packaging because the RTV cache is unpopulated.")
+		this.options.Logger.Error("RTV unavailable", "url", signURL, "outcome", "unsigned", "latency_ms", millisSince(start))
+		this.proxy(resp, fetchResp, fetchBody)
+		return
+	}
+
+	// Don't waste effort on a client that has gone away.
+	if this.abortIfCanceled(req, signURL, start) {
+		return
+	}
+
 	// Perform local transformations.
-	r := getTransformerRequest(this.rtvCache, string(fetchBody), signURL.String())
+	r := getTransformerRequest(this.rtvCache, string(fetchBody), signURL.String(), this.options.AllowedFormats)
+	if !rtvPopulated {
+		// The exchange would reference the fallback runtime version for
+		// its whole lifetime, so don't cache it.
+		r.Rtv, r.Css = this.options.FallbackRTV, ""
+		cacheKey = ""
+	}
 	r.Version = transformVersion
+	for _, header := range this.options.TransformerHeaders {
+		if value := GetJoined(fetchResp.Header, header); value != "" {
+			if r.ResponseHeaders == nil {
+				r.ResponseHeaders = map[string]string{}
+			}
+			r.ResponseHeaders[header] = value
+		}
+	}
 	transformed, metadata, err := transformer.Process(r)
 	if err != nil {
 		log.Println("Not packaging due to transformer error:", err)
-		proxy(resp, fetchResp, fetchBody)
+		this.options.Logger.Error("Transform failed", "url", signURL, "outcome", "unsigned", "error", err, "latency_ms", millisSince(start))
+		this.proxy(resp, fetchResp, fetchBody)
+		return
+	}
+	if this.options.MaxTransformedBodyBytes > 0 && len(transformed) > this.options.MaxTransformedBodyBytes {
+		log.Printf("Not packaging because transformed body exceeds %d bytes.\n", this.options.MaxTransformedBodyBytes)
+		this.proxy(resp, fetchResp, fetchBody)
 		return
 	}
 	fetchResp.Header.Set("Content-Length", strconv.Itoa(len(transformed)))
-	linkHeader, err := formatLinkHeader(metadata.Preloads)
+	if this.options.AcceptXHTML {
+		relabelXHTML(fetchResp.Header)
+	}
+	if this.options.NormalizeCharset {
+		normalizeCharset(fetchResp.Header)
+	}
+	if this.options.LastModified {
+		normalizeLastModified(fetchResp.Header)
+	} else {
+		fetchResp.Header.Del("Last-Modified")
+	}
+	resources, err := this.linkResources(transformed, metadata, signURL)
 	if err != nil {
 		log.Println("Not packaging due to Link header error:", err)
-		proxy(resp, fetchResp, fetchBody)
+		this.proxy(resp, fetchResp, fetchBody)
 		return
 	}
+	if this.options.LogNoPreloads && countPreloads(resources) == 0 {
+		this.options.Logger.Info("No preloads", "url", signURL)
+	}
+	if this.options.CanonicalLinkHeader {
+		resources = append(resources, PreloadResource{URL: signURL.String(), Rel: "canonical"})
+	}
+	linkHeader := formatLinkHeader(resources)
+	if this.options.MergeUpstreamLinkHeaders {
+		linkHeader = mergeLinkHeaders(linkHeader, GetJoined(fetchResp.Header, "Link"))
+	}
 	if linkHeader != "" {
 		fetchResp.Header.Set("Link", linkHeader)
 	}
 
+	// The payload is unencoded at this point (see validateFetch), and
+	// MiEncodePayload appends its own Content-Encoding, so drop any
+	// upstream value to ensure the exchange reflects the actual encoding.
+	fetchResp.Header.Del("Content-Encoding")
+	// Likewise, the browser can't request a range of the signed payload
+	// (as its integrity is verified in whole, and the exchange itself is
+	// what's served), so don't advertise that it can.
+	fetchResp.Header.Del("Accept-Ranges")
+
 	exchange := signedexchange.NewExchange(
-		accept.SxgVersion, /*uri=*/signURL.String(), /*method=*/"GET",
+		accept.SupportedSxgVersions[sxgVersion], /*uri=*/signURL.String(), /*method=*/"GET",
 		http.Header{}, fetchResp.StatusCode, fetchResp.Header, []byte(transformed))
-	if err := exchange.MiEncodePayload(miRecordSize); err != nil {
+	recordSize := this.recordSize
+	if urlSet.RecordSize > 0 {
+		recordSize = urlSet.RecordSize
+	}
+	if err := this.miEncodePayload(exchange, recordSize); err != nil {
 		util.NewHTTPError(http.StatusInternalServerError, "Error MI-encoding: ", err).LogAndRespond(resp)
 		return
 	}
-	certURL, err := this.genCertURL(this.cert, signURL)
+	if this.options.VerifyMIPayload {
+		decoded, err := util.VerifyMIPayload(this.options.MIEncoding, exchange.Payload, exchange.ResponseHeaders.Get("Digest"))
+		if err == nil && string(decoded) != transformed {
+			err = errors.New("decoded payload differs from transformed document")
+		}
+		if err != nil {
+			util.NewHTTPError(http.StatusInternalServerError, "Error verifying MI-encoded payload: ", err).LogAndRespond(resp)
+			return
+		}
+	}
+	if this.shouldDumpSignedBytes(req) {
+		this.options.SignedBytesSink(signURL.String(), []byte(transformed), exchange.ResponseHeaders.Get("Digest"))
+	}
+	certURL, err := this.genCertURL(cert, signURL)
 	if err != nil {
 		util.NewHTTPError(http.StatusInternalServerError, "Error building cert URL: ", err).LogAndRespond(resp)
 		return
 	}
-	now := time.Now()
-	validityHRef, err := url.Parse(util.ValidityMapPath)
+	now := this.nowFunc()
+	validityHRef, err := url.Parse(this.options.ValidityURLPath)
 	if err != nil {
 		util.NewHTTPError(http.StatusInternalServerError, "Error building validity href: ", err).LogAndRespond(resp)
 	}
+	// Backdate the signature by a seventh of its lifetime (a day, by
+	// default), to allow for client clock skew.
+	date := now.Add(-this.signatureExpiry / 7)
+	expires := date.Add(this.signatureExpiry)
+	// Don't let the exchange outlive the upstream's caching intent.
+	if maxAge, ok := upstreamMaxAge(fetchResp.Header); ok && now.Add(maxAge).Before(expires) {
+		expires = now.Add(maxAge)
+	}
 	signer := signedexchange.Signer{
-		// Expires - Date must be <= 604800 seconds, per
-		// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-3.5.
-		Date:        now.Add(-24 * time.Hour),
-		Expires:     now.Add(6 * 24 * time.Hour),
-		Certs:       []*x509.Certificate{this.cert},
+		Date:        date,
+		Expires:     expires,
+		Certs:       []*x509.Certificate{cert},
 		CertUrl:     certURL,
 		ValidityUrl: signURL.ResolveReference(validityHRef),
-		PrivKey:     this.key,
+		PrivKey:     key,
 		// TODO(twifkak): Should we make Rand user-configurable? The
 		// default is to use getrandom(2) if available, else
 		// /dev/urandom.
+		Rand: signingRand,
+	}
+	if this.abortIfCanceled(req, signURL, start) {
+		return
 	}
 	if err := exchange.AddSignatureHeader(&signer); err != nil {
-		util.NewHTTPError(http.StatusInternalServerError, "Error signing exchange: ", err).LogAndRespond(resp)
+		if !isTransient(err) {
+			util.NewHTTPError(http.StatusInternalServerError, "Error signing exchange: ", err).LogAndRespond(resp)
+			return
+		}
+		if !this.options.ProxyOnTransientSigningError {
+			util.NewHTTPError(http.StatusServiceUnavailable, "Temporary error signing exchange: ", err).LogAndRespond(resp)
+			return
+		}
+		log.Println("Not packaging due to temporary signing error:", err)
+		this.options.Logger.Error("Signing failed", "url", signURL, "outcome", "unsigned", "error", err, "latency_ms", millisSince(start))
+		fetchResp.Header.Set("Content-Length", strconv.Itoa(len(fetchBody)))
+		this.proxy(resp, fetchResp, fetchBody)
+		return
+	}
+	if debug != nil {
+		debug.RTV = r.Rtv
+		debug.SXGVersion = sxgVersion
+		debug.Link = linkHeader
+		debug.ResponseHeaders = exchange.ResponseHeaders
+		debug.computeStrippedHeaders()
+		debug.Signature = debugSignature{signer.Date, signer.Expires, certURL.String(), signer.ValidityUrl.String(), exchange.SignatureHeaderValue}
+		writeDebugExchange(resp, debug)
+		this.options.Logger.Info("Described exchange", "url", signURL, "outcome", "debug", "latency_ms", millisSince(start))
 		return
 	}
-	var body bytes.Buffer
-	if err := exchange.Write(&body); err != nil {
-		util.NewHTTPError(http.StatusInternalServerError, "Error serializing exchange: ", err).LogAndRespond(resp)
+	if this.options.DebugOriginalDigest {
+		digest := sha256.Sum256(fetchBody)
+		resp.Header().Set(debugOriginalDigestHeader, "sha-256="+base64.StdEncoding.EncodeToString(digest[:]))
+	}
+	if cacheKey != "" {
+		// The cache needs the whole serialization, so buffer it.
+		var body bytes.Buffer
+		body.Grow(len(exchange.Payload) + len(exchange.SignatureHeaderValue) + exchangeFramingBytes)
+		if err := exchange.Write(&body); err != nil {
+			util.NewHTTPError(http.StatusInternalServerError, "Error serializing exchange: ", err).LogAndRespond(resp)
+			return
+		}
+		// Cached entries lapse along with the signature's validity.
+		this.options.Cache.Put(cacheKey, body.Bytes(), signer.Expires)
+		writeExchange(resp, sxgVersion, body.Bytes())
+	} else {
+		// Otherwise, stream it, so that the payload isn't copied into
+		// a second buffer. Without a Content-Length, net/http sends it
+		// chunked.
+		setExchangeHeaders(resp, sxgVersion)
+		w := &countingWriter{w: resp}
+		if err := exchange.Write(w); err != nil {
+			if w.n == 0 {
+				util.NewHTTPError(http.StatusInternalServerError, "Error serializing exchange: ", err).LogAndRespond(resp)
+				return
+			}
+			log.Printf("Error writing response, %d bytes into stream: %v\n", w.n, err)
+			return
+		}
+	}
+	this.options.Logger.Info("Signed exchange", "url", signURL, "outcome", "signed", "latency_ms", millisSince(start))
+}
+
+// A generous bound on the size of an exchange, excluding its payload and
+// signature: the magic bytes, length prefixes, fallback URL, and CBOR
+// headers. Used only to presize buffers.
+const exchangeFramingBytes = 8 << 10
+
+// MI-encodes the exchange's payload, like exchange.MiEncodePayload, but into
+// a buffer presized for the encoding, rather than one grown (and copied)
+// repeatedly as the encoder writes to it.
+func (this *Signer) miEncodePayload(exchange *signedexchange.Exchange, recordSize int) error {
+	enc := this.options.MIEncoding
+	if exchange.ResponseHeaders.Get(enc.DigestHeaderName()) != "" {
+		return errors.Errorf("response already has %q header", enc.DigestHeaderName())
+	}
+	// A record size prefix, plus a proof between each pair of records.
+	numRecords := (len(exchange.Payload) + recordSize - 1) / recordSize
+	var buf bytes.Buffer
+	buf.Grow(8 + len(exchange.Payload) + sha256.Size*numRecords)
+	digest, err := enc.Encode(&buf, exchange.Payload, recordSize)
+	if err != nil {
+		return err
 	}
+	exchange.Payload = buf.Bytes()
+	exchange.ResponseHeaders.Add("Content-Encoding", enc.ContentEncoding())
+	exchange.ResponseHeaders.Add(enc.DigestHeaderName(), digest)
+	return nil
+}
+
+// An io.Writer that counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
 
+func (this *countingWriter) Write(p []byte) (int, error) {
+	n, err := this.w.Write(p)
+	this.n += int64(n)
+	return n, err
+}
+
+// Sets the response headers for a serialized exchange.
+func setExchangeHeaders(resp http.ResponseWriter, sxgVersion string) {
 	// TODO(twifkak): Add Cache-Control: public with expiry to match when we think the AMP Cache
 	// should fetch an update (half-way between signature date & expires).
-	resp.Header().Set("Content-Type", accept.SxgContentType)
+	resp.Header().Set("Content-Type", accept.ContentType(sxgVersion))
 	resp.Header().Set("Cache-Control", "no-transform")
 	resp.Header().Set("X-Content-Type-Options", "nosniff")
-	if _, err := resp.Write(body.Bytes()); err != nil {
+}
+
+// Writes the given serialized exchange as the response.
+func writeExchange(resp http.ResponseWriter, sxgVersion string, body []byte) {
+	setExchangeHeaders(resp, sxgVersion)
+	if _, err := resp.Write(body); err != nil {
 		log.Println("Error writing response:", err)
 		return
 	}
 }
 
+// Responds to a request whose upstream body exceeds the given limit, of which
+// only prefix has been read, with a 502, or (if Options.ProxyOversizedBody is
+// set) by proxying the whole body unsigned. It's never proxied truncated, as
+// clients couldn't tell.
+func (this *Signer) serveOversized(resp http.ResponseWriter, fetchResp *http.Response, prefix []byte, what string, limit int64) {
+	if !this.options.ProxyOversizedBody {
+		util.NewHTTPError(http.StatusBadGateway, what, " exceeds max length of ", limit, " bytes").LogAndRespond(resp)
+		return
+	}
+	log.Printf("Not packaging because %s exceeds %d bytes.\n", strings.ToLower(what), limit)
+	// Proxy the part already read, followed by the rest.
+	fetchResp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), fetchResp.Body), fetchResp.Body}
+	this.proxy(resp, fetchResp, nil)
+}
+
+// Like proxy, but first adds the security headers requested by
+// Options.SecurityHeaders.
+func (this *Signer) proxy(resp http.ResponseWriter, fetchResp *http.Response, body []byte) {
+	if this.options.SecurityHeaders {
+		fetchResp.Header.Set("X-Content-Type-Options", "nosniff")
+		if this.options.HSTS != "" && fetchResp.Header.Get("Strict-Transport-Security") == "" {
+			fetchResp.Header.Set("Strict-Transport-Security", this.options.HSTS)
+		}
+	}
+	proxy(resp, fetchResp, body)
+}
+
 // Proxy the content unsigned. If body is non-nil, it is used in place of fetchResp.Body.
 // TODO(twifkak): Take a look at the source code to httputil.ReverseProxy and
 // see what else needs to be implemented.
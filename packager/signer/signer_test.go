@@ -15,18 +15,44 @@
 package signer
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf16"
 
 	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/cbor"
+	"github.com/WICG/webpackage/go/signedexchange/mice"
 	"github.com/ampproject/amppackager/packager/accept"
 	"github.com/ampproject/amppackager/packager/rtv"
 	pkgt "github.com/ampproject/amppackager/packager/testing"
@@ -34,6 +60,8 @@ import (
 	"github.com/ampproject/amppackager/transformer"
 	rpb "github.com/ampproject/amppackager/transformer/request"
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -62,7 +90,11 @@ type SignerSuite struct {
 }
 
 func (this *SignerSuite) new(urlSets []util.URLSet) *Signer {
-	handler, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, func() bool { return this.shouldPackage }, nil, true)
+	return this.newWithOptions(urlSets, Options{})
+}
+
+func (this *SignerSuite) newWithOptions(urlSets []util.URLSet, options Options) *Signer {
+	handler, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return this.shouldPackage }), nil, true, 0, 0, options)
 	this.Require().NoError(err)
 	// Accept the self-signed certificate generated by the test server.
 	handler.client = this.httpsClient
@@ -138,10 +170,12 @@ func (this *SignerSuite) SetupTest() {
 		resp.Write(fakeBody)
 	}
 	// Don't actually do any transforms. Only parse & print.
-	getTransformerRequest = func(r *rtv.RTVCache, s, u string) *rpb.Request {
+	getTransformerRequest = func(r *rtv.RTVCache, s, u string, formats []rpb.Request_HtmlFormat) *rpb.Request {
 		return &rpb.Request{Html: string(s), DocumentUrl: u, Config: rpb.Request_NONE,
-			AllowedFormats: []rpb.Request_HtmlFormat{rpb.Request_AMP}}
+			AllowedFormats: formats}
 	}
+	isRTVPopulated = func(*rtv.RTVCache, time.Duration) bool { return true }
+	getRTV = func(*rtv.RTVCache) string { return "" }
 }
 
 func (this *SignerSuite) TestSimple() {
@@ -149,7 +183,10 @@ func (this *SignerSuite) TestSimple() {
 		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
 		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
 	}}
-	resp := this.get(this.T(), this.new(urlSets),
+	handler := this.new(urlSets)
+	now := time.Date(2018, time.October, 1, 12, 0, 0, 0, time.UTC)
+	handler.nowFunc = func() time.Time { return now }
+	resp := this.get(this.T(), handler,
 		"/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath)+
 			"&sign="+url.QueryEscape(this.httpSignURL()+fakePath))
 
@@ -177,15 +214,239 @@ func (this *SignerSuite) TestSimple() {
 	this.Assert().Contains(exchange.SignatureHeaderValue, "integrity=\"digest/mi-sha256-03\"")
 	this.Assert().Contains(exchange.SignatureHeaderValue, "cert-url=\""+this.httpSignURL()+"/amppkg/cert/"+pkgt.CertName+"\"")
 	this.Assert().Contains(exchange.SignatureHeaderValue, "cert-sha256=*"+pkgt.CertName+"=*")
-	// TODO(twifkak): Control date, and test for expires and sig.
+	this.Assert().Contains(exchange.SignatureHeaderValue, fmt.Sprintf("date=%d; expires=%d", now.Add(-24*time.Hour).Unix(), now.Add(6*24*time.Hour).Unix()))
+	// TODO(twifkak): Test for sig.
 	// The response header values are untested here, as that is covered by signedexchange tests.
 
 	// For small enough bodies, the only thing that MICE does is add a record size prefix.
 	var payloadPrefix bytes.Buffer
-	binary.Write(&payloadPrefix, binary.BigEndian, uint64(miRecordSize))
+	binary.Write(&payloadPrefix, binary.BigEndian, uint64(handler.recordSize))
 	this.Assert().Equal(append(payloadPrefix.Bytes(), transformedBody...), exchange.Payload)
 }
 
+func (this *SignerSuite) TestFetchNetwork() {
+	// A transport that trusts the test server, and records the network of
+	// each dial.
+	var networks []string
+	transport := this.httpsClient.Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		networks = append(networks, network)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	for _, network := range []string{"", "tcp4", "tcp6"} {
+		urlSets := []util.URLSet{{
+			Sign:         &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+			FetchNetwork: network,
+		}}
+		handler, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{Transport: transport})
+		this.Require().NoError(err)
+		networks = nil
+		resp := this.get(this.T(), handler, target)
+		this.Require().NotEmpty(networks)
+		if network == "" {
+			this.Assert().Equal("tcp", networks[0])
+		} else {
+			this.Assert().Equal(network, networks[0])
+		}
+		// The test server only listens on an IPv4 address.
+		if network == "tcp6" {
+			this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+		} else {
+			this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		}
+	}
+
+	urlSets := []util.URLSet{{
+		Sign:         &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		FetchNetwork: "tcp4",
+	}}
+	_, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{FetchUnixSocket: "/tmp/amppkg.sock"})
+	this.Assert().EqualError(err, "FetchNetwork and FetchUnixSocket are mutually exclusive")
+}
+
+func (this *SignerSuite) TestValidityURLPath() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	for _, path := range []string{"amppkg/validity", "//example.com/validity", "/validity?x=1", "/validity#x", "https://example.com/validity"} {
+		_, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{ValidityURLPath: path})
+		this.Assert().Error(err, "path %q", path)
+	}
+
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{ValidityURLPath: "/prefix/amppkg/validity"}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(exchange.SignatureHeaderValue, "validity-url=\""+this.httpsURL()+"/prefix/amppkg/validity\"")
+}
+
+// Returns the response header names of the exchange in the given response,
+// exactly as serialized, in order.
+func (this *SignerSuite) rawResponseHeaderNames(resp *http.Response) []string {
+	sxg, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+
+	// Skip the magic, fallback URL, and signature to get to the headers.
+	pos := 8
+	pos += 2 + int(binary.BigEndian.Uint16(sxg[pos:]))
+	sigLength := int(sxg[pos])<<16 | int(sxg[pos+1])<<8 | int(sxg[pos+2])
+	headerLength := int(sxg[pos+3])<<16 | int(sxg[pos+4])<<8 | int(sxg[pos+5])
+	pos += 6 + sigLength
+	dec := cbor.NewDecoder(bytes.NewReader(sxg[pos : pos+headerLength]))
+	n, err := dec.DecodeMapHeader()
+	this.Require().NoError(err)
+	var names []string
+	for i := uint64(0); i < n; i++ {
+		name, err := dec.DecodeByteString()
+		this.Require().NoError(err)
+		_, err = dec.DecodeByteString()
+		this.Require().NoError(err)
+		names = append(names, string(name))
+	}
+	return names
+}
+
+func (this *SignerSuite) TestResponseHeaderOrder() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	names := this.rawResponseHeaderNames(resp)
+
+	// The SXG spec requires canonical CBOR, which sorts map keys by length,
+	// then bytewise.
+	this.Assert().Equal([]string{
+		"date", "digest", ":status", "content-type", "content-length",
+		"content-encoding", "x-content-type-options", "content-security-policy"}, names)
+}
+
+func (this *SignerSuite) TestSignatureExpiry() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	for _, expiry := range []time.Duration{-time.Hour, 7*24*time.Hour + time.Second} {
+		_, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, expiry, Options{})
+		this.Assert().Error(err, "expiry %s", expiry)
+	}
+
+	dateRE := regexp.MustCompile(`; date=(\d+); expires=(\d+)`)
+	for _, test := range []struct {
+		expiry, expected time.Duration
+	}{
+		{0, 7 * 24 * time.Hour},
+		{time.Hour, time.Hour},
+		{3 * 24 * time.Hour, 3 * 24 * time.Hour},
+	} {
+		handler, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, test.expiry, Options{})
+		this.Require().NoError(err)
+		handler.client = this.httpsClient
+		resp := this.get(this.T(), handler, "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		match := dateRE.FindStringSubmatch(exchange.SignatureHeaderValue)
+		this.Require().NotNil(match, exchange.SignatureHeaderValue)
+		date, err := strconv.ParseInt(match[1], 10, 64)
+		this.Require().NoError(err)
+		expires, err := strconv.ParseInt(match[2], 10, 64)
+		this.Require().NoError(err)
+		this.Assert().Equal(int64(test.expected/time.Second), expires-date, "expiry %s", test.expiry)
+		this.Assert().True(date <= time.Now().Unix() && time.Now().Unix() < expires)
+	}
+}
+
+func (this *SignerSuite) TestRequireSCT() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	// The test cert lacks SCTs, which is only a warning by default.
+	_, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{})
+	this.Assert().NoError(err)
+	_, err = New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{RequireSCT: true})
+	this.Assert().EqualError(err, "cert lacks embedded SCTs, so its signed exchanges will be rejected by Chrome")
+
+	cert := *pkgt.Certs[0]
+	cert.Extensions = append(cert.Extensions, pkix.Extension{
+		Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}, Value: []byte{0x04, 0x02, 0x00, 0x00}})
+	_, err = New(&cert, pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{RequireSCT: true})
+	this.Assert().NoError(err)
+}
+
+func (this *SignerSuite) TestCertURLVersion() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{CertURLVersion: "2 b"}), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(exchange.SignatureHeaderValue, "cert-url=\""+this.httpsURL()+"/amppkg/cert/"+pkgt.CertName+"?v=2+b\"")
+}
+
+func (this *SignerSuite) TestVersionNegotiation() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	for _, test := range []struct {
+		versions []string
+		accept   string
+		version  string // "" means unsigned
+	}{
+		{nil, "application/signed-exchange;v=b3", "b3"},
+		{nil, "application/signed-exchange;v=b2", ""},
+		{[]string{"b2", "b3"}, "application/signed-exchange;v=b2", "b2"},
+		{[]string{"b2", "b3"}, "application/signed-exchange;v=b2,application/signed-exchange;v=b3", "b3"},
+		{[]string{"b2"}, "application/signed-exchange;v=b2,application/signed-exchange;v=b3", "b2"},
+	} {
+		resp := pkgt.GetH(this.T(), this.newWithOptions(urlSets, Options{Versions: test.versions}),
+			"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath),
+			http.Header{"AMP-Cache-Transform": {"google"}, "Accept": {test.accept}})
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		if test.version == "" {
+			this.Assert().Equal("text/html", resp.Header.Get("Content-Type"), "%v %q", test.versions, test.accept)
+			continue
+		}
+		this.Assert().Equal("application/signed-exchange;v="+test.version, resp.Header.Get("Content-Type"), "%v %q", test.versions, test.accept)
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal(accept.SupportedSxgVersions[test.version], exchange.Version)
+	}
+
+	_, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{Versions: []string{"b1"}})
+	this.Assert().Error(err)
+}
+
+func (this *SignerSuite) TestRecordSize() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	for _, size := range []int{0, 1000, 512, 256 << 10} {
+		_, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, size, 0, Options{})
+		if size == 0 {
+			this.Assert().NoError(err)
+		} else {
+			this.Assert().Error(err, "size %d", size)
+		}
+	}
+
+	handler, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 4096, 0, Options{})
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	resp := this.get(this.T(), handler, "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(uint64(4096), binary.BigEndian.Uint64(exchange.Payload[:8]))
+}
+
+func (this *SignerSuite) TestFetchUserAgent() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{FetchUserAgent: "amppackager-test/1.0"}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("amppackager-test/1.0", this.lastRequest.Header.Get("User-Agent"))
+
+	_, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, nil, nil, true, 0, 0, Options{FetchUserAgent: "a\r\nCookie: b"})
+	this.Assert().Error(err)
+}
+
 func (this *SignerSuite) TestParamsInPostBody() {
 	urlSets := []util.URLSet{{
 		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
@@ -202,6 +463,67 @@ func (this *SignerSuite) TestParamsInPostBody() {
 	this.Assert().Equal(this.httpSignURL()+fakePath, exchange.RequestURI)
 }
 
+func (this *SignerSuite) TestSignPostedDocument() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	post := func(handler *Signer, target, contentType, body string) *http.Response {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		handler.ServeSignDocument(rec, req, nil)
+		return rec.Result()
+	}
+	html := "<html amp><head><link rel=stylesheet href=foo></head><body>posted</body></html>"
+	target := "/priv/sign?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	handler := this.newWithOptions(urlSets, Options{SignPostedDocuments: true})
+	this.lastRequest = nil
+
+	resp := post(handler, target, "text/html; charset=utf-8", html)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Nil(this.lastRequest, "document was fetched")
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(this.httpsURL()+fakePath, exchange.RequestURI)
+	this.Assert().Equal("text/html; charset=utf-8", exchange.ResponseHeaders.Get("Content-Type"))
+	this.Assert().Equal("<foo>;rel=preload;as=style", exchange.ResponseHeaders.Get("Link"))
+	payload, err := util.VerifyMIPayload(mice.Draft03Encoding, exchange.Payload, exchange.ResponseHeaders.Get("Digest"))
+	this.Require().NoError(err)
+	transformed, _, err := transformer.Process(getTransformerRequest(nil, html, this.httpsURL()+fakePath, []rpb.Request_HtmlFormat{rpb.Request_AMP}))
+	this.Require().NoError(err)
+	this.Assert().Equal(transformed, string(payload))
+
+	resp = post(handler, "/priv/sign?sign="+url.QueryEscape(this.httpsURL()+"/other/path"), "text/html", html)
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+	resp = post(handler, target, "application/json", "{}")
+	this.Assert().Equal(http.StatusUnsupportedMediaType, resp.StatusCode)
+	resp = post(this.new(urlSets), target, "text/html", html)
+	this.Assert().Equal(http.StatusNotFound, resp.StatusCode)
+	this.Assert().Nil(this.lastRequest, "document was fetched")
+}
+
+func (this *SignerSuite) TestUpgradeSignURLScheme() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	httpSignURL := "HTTP://" + this.httpsHost() + fakePath
+
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(httpSignURL))
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
+
+	for _, target := range []string{"/priv/doc?sign=" + url.QueryEscape(httpSignURL), "/priv/doc/" + httpSignURL} {
+		this.lastRequest = nil
+		var params httprouter.Params
+		if strings.HasPrefix(target, "/priv/doc/") {
+			params = httprouter.Params{{"signURL", "/" + httpSignURL}}
+		}
+		resp = this.getP(this.T(), this.newWithOptions(urlSets, Options{UpgradeSignURLScheme: true}), target, params)
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal(fakePath, this.lastRequest.URL.String())
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal(this.httpsURL()+fakePath, exchange.RequestURI)
+	}
+}
+
 func (this *SignerSuite) TestEscapeQueryParamsInFetchAndSign() {
 	urlSets := []util.URLSet{{
 		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(".*"), false, 2000, nil},
@@ -230,6 +552,110 @@ func (this *SignerSuite) TestNoFetchParam() {
 	this.Assert().Equal(this.httpsURL()+fakePath, exchange.RequestURI)
 }
 
+func (this *SignerSuite) TestDuplicateSignParams() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath+"first") +
+		"&sign=" + url.QueryEscape(this.httpsURL()+fakePath+"last")
+
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
+
+	for _, selection := range []string{"first", "last"} {
+		resp = this.get(this.T(), this.newWithOptions(urlSets, Options{DuplicateParams: selection}), target)
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status for %s: %#v", selection, resp)
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal(this.httpsURL()+fakePath+selection, exchange.RequestURI)
+		this.Assert().Equal(fakePath+selection, this.lastRequest.URL.String())
+	}
+
+	_, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{DuplicateParams: "random"})
+	this.Assert().EqualError(err, `duplicate params selection "random" is not one of "first" or "last"`)
+}
+
+func (this *SignerSuite) TestSignPathMismatch() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+"/not-amp.html")
+	for _, test := range []struct {
+		notFound bool
+		status   int
+	}{
+		{false, http.StatusBadRequest},
+		{true, http.StatusNotFound},
+	} {
+		logger := &capturingLogger{}
+		resp := this.get(this.T(), this.newWithOptions(urlSets, Options{NotFoundOnSignPathMismatch: test.notFound, Logger: logger}), target)
+		this.Assert().Equal(test.status, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+		this.Require().Len(logger.entries, 1)
+		this.Assert().Equal("Rejected URL", logger.entries[0].msg)
+		this.Assert().Contains(fmt.Sprint(logger.entries[0].kv), "URLSet[0]: sign URL: PathRE doesn't match")
+	}
+}
+
+func (this *SignerSuite) TestCanSignDocs() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+	}}
+	this.lastRequest = nil
+	handler := this.new(urlSets)
+	for _, test := range []struct {
+		signURL  string
+		expected bool
+	}{
+		{this.httpSignURL() + fakePath, true},
+		{this.httpSignURL() + "/amp/other.html", true},
+		{this.httpSignURL() + "/amp/../amp/other.html", true},
+		{this.httpSignURL() + "/other.html", false},
+		{this.httpSignURL() + "/amp/../other.html", false},
+		{this.httpSignURL() + fakePath + "?q=1", false},
+		{this.httpURL() + fakePath, false},
+		{"https://other.example" + fakePath, false},
+		{fakePath, false},
+	} {
+		this.Assert().Equal(test.expected, handler.CanSignDocs(urlOrDie(test.signURL)), test.signURL)
+	}
+	// Nothing was fetched.
+	this.Assert().Nil(this.lastRequest)
+
+	// With RequireCertCoverage, the cert must cover the host, too.
+	cert, key := this.newCert("www.amppackageexample.com")
+	handler, err := New(cert, key, []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", "www.amppackageexample.com", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}, {
+		Sign: &util.URLPattern{[]string{"https"}, "", "amppackageexample.org", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{RequireCertCoverage: true})
+	this.Require().NoError(err)
+	this.Assert().True(handler.CanSignDocs(urlOrDie("https://www.amppackageexample.com" + fakePath)))
+	this.Assert().False(handler.CanSignDocs(urlOrDie("https://amppackageexample.org" + fakePath)))
+
+	// A wildcard Domain matches hosts the cert may not cover.
+	cert, key = this.newCert("*.amppackageexample.com")
+	wildcardSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", "*.amppackageexample.com", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	handler, err = New(cert, key, wildcardSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{RequireCertCoverage: true})
+	this.Require().NoError(err)
+	this.Assert().True(handler.CanSignDocs(urlOrDie("https://a.amppackageexample.com" + fakePath)))
+	this.Assert().True(handler.CanSignDocs(urlOrDie("https://b.amppackageexample.com" + fakePath)))
+	this.Assert().False(handler.CanSignDocs(urlOrDie("https://amppackageexample.com.evil.com" + fakePath)))
+	// A cert for some of the hosts a wildcard Domain matches covers it, but
+	// only those hosts may be signed.
+	cert, key = this.newCert("a.amppackageexample.com")
+	handler, err = New(cert, key, wildcardSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{RequireCertCoverage: true})
+	this.Require().NoError(err)
+	this.Assert().True(handler.CanSignDocs(urlOrDie("https://a.amppackageexample.com" + fakePath)))
+	this.Assert().False(handler.CanSignDocs(urlOrDie("https://b.amppackageexample.com" + fakePath)))
+	this.Assert().NoError(handler.ReloadCert([]*x509.Certificate{cert}, key))
+	cert, key = this.newCert("a.b.amppackageexample.com")
+	_, err = New(cert, key, wildcardSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{RequireCertCoverage: true})
+	this.Assert().EqualError(err, "cert covers none of the URLSet Sign domains: *.amppackageexample.com")
+	this.Assert().EqualError(handler.ReloadCert([]*x509.Certificate{cert}, key), "cert covers none of the URLSet Sign domains: *.amppackageexample.com")
+}
+
 func (this *SignerSuite) TestSignAsPathParam() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
@@ -243,6 +669,81 @@ func (this *SignerSuite) TestSignAsPathParam() {
 	this.Assert().Equal(this.httpsURL()+fakePath, exchange.RequestURI)
 }
 
+func (this *SignerSuite) TestSignAsPathAndQueryParam() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(".*"), false, 2000, nil},
+	}}
+	query := "?sign=other.html"
+	params := httprouter.Params{httprouter.Param{"signURL", "/" + this.httpsURL() + fakePath}}
+
+	// The path takes precedence; the query belongs to its URL.
+	resp := this.getP(this.T(), this.new(urlSets), "/priv/doc/"+this.httpsURL()+fakePath+query, params)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakePath+query, this.lastRequest.URL.String())
+	this.Assert().Equal(this.httpsURL()+fakePath+query, exchange.RequestURI)
+
+	resp = this.getP(this.T(), this.newWithOptions(urlSets, Options{ErrorOnAmbiguousSignURL: true}), "/priv/doc/"+this.httpsURL()+fakePath+query, params)
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+
+	// Other query params are unambiguous.
+	resp = this.getP(this.T(), this.newWithOptions(urlSets, Options{ErrorOnAmbiguousSignURL: true}), "/priv/doc/"+this.httpsURL()+fakePath+"?page=2", params)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(fakePath+"?page=2", this.lastRequest.URL.String())
+}
+
+func (this *SignerSuite) TestExtraPathSegments() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	for _, test := range []struct {
+		notFound bool
+		target   string
+		signURL  string
+		status   int
+	}{
+		{false, "/priv/doc/?sign=" + url.QueryEscape(this.httpsURL()+fakePath), "/", http.StatusOK},
+		{true, "/priv/doc/?sign=" + url.QueryEscape(this.httpsURL()+fakePath), "/", http.StatusOK},
+		{false, "/priv/doc/foo/bar", "/foo/bar", http.StatusBadRequest},
+		{true, "/priv/doc/foo/bar", "/foo/bar", http.StatusNotFound},
+		{true, "/priv/doc/" + this.httpsURL() + fakePath, "/" + this.httpsURL() + fakePath, http.StatusOK},
+	} {
+		resp := this.getP(this.T(), this.newWithOptions(urlSets, Options{NotFoundOnExtraPathSegments: test.notFound}), test.target,
+			httprouter.Params{httprouter.Param{"signURL", test.signURL}})
+		this.Assert().Equal(test.status, resp.StatusCode, "incorrect status for %s: %#v", test.target, resp)
+	}
+}
+
+func (this *SignerSuite) TestForwardedHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	handler := this.newWithOptions(urlSets, Options{ForwardedHeaders: []string{"accept-language", "X-Feature"}})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	header := http.Header{
+		"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+		"Accept-Language": {"fr-CH, fr;q=0.9"}, "X-Feature": {"on"}, "X-Other": {"1"}}
+	resp := pkgt.GetH(this.T(), handler, target, header)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal([]string{"Accept, AMP-Cache-Transform", "Accept-Language, X-Feature"}, resp.Header[http.CanonicalHeaderKey("Vary")])
+	this.Assert().Equal("fr-CH, fr;q=0.9", this.lastRequest.Header.Get("Accept-Language"))
+	this.Assert().Equal("on", this.lastRequest.Header.Get("X-Feature"))
+	this.Assert().Equal("", this.lastRequest.Header.Get("X-Other"))
+
+	// Headers the client declares hop-by-hop aren't forwarded.
+	header.Set("Connection", "X-Feature")
+	resp = pkgt.GetH(this.T(), handler, target, header)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("fr-CH, fr;q=0.9", this.lastRequest.Header.Get("Accept-Language"))
+	this.Assert().Equal("", this.lastRequest.Header.Get("X-Feature"))
+
+	for _, forwarded := range []string{"Cookie", "Authorization", "Connection", "TE"} {
+		_, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{ForwardedHeaders: []string{forwarded}})
+		this.Assert().Error(err, forwarded)
+	}
+}
+
 func (this *SignerSuite) TestPreservesContentType() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
@@ -258,6 +759,30 @@ func (this *SignerSuite) TestPreservesContentType() {
 	this.Assert().Equal("text/html;charset=utf-8;v=5", exchange.ResponseHeaders.Get("Content-Type"))
 }
 
+func (this *SignerSuite) TestUppercaseCharset() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html;charset=UTF-8")
+		resp.Write(fakeBody)
+	}
+	for _, test := range []struct {
+		normalize   bool
+		contentType string
+	}{
+		{false, "text/html;charset=UTF-8"},
+		{true, "text/html; charset=utf-8"},
+	} {
+		resp := this.get(this.T(), this.newWithOptions(urlSets, Options{NormalizeCharset: test.normalize}), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal(test.contentType, exchange.ResponseHeaders.Get("Content-Type"))
+	}
+}
+
 func (this *SignerSuite) TestRemovesLinkHeaders() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
@@ -290,6 +815,50 @@ func (this *SignerSuite) TestRemovesStatefulHeaders() {
 	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Set-Cookie"))
 }
 
+func (this *SignerSuite) TestTransformerHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Content-Location", "/amp/base/")
+		resp.Header().Set("X-Other", "1")
+		resp.Write(fakeBody)
+	}
+	var transformerRequest *rpb.Request
+	origGetTransformerRequest := getTransformerRequest
+	defer func() { getTransformerRequest = origGetTransformerRequest }()
+	getTransformerRequest = func(r *rtv.RTVCache, s, u string, formats []rpb.Request_HtmlFormat) *rpb.Request {
+		transformerRequest = origGetTransformerRequest(r, s, u, formats)
+		return transformerRequest
+	}
+
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{TransformerHeaders: []string{"content-location", "X-Missing"}}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().NotNil(transformerRequest)
+	this.Assert().Equal(map[string]string{"Content-Location": "/amp/base/"}, transformerRequest.ResponseHeaders)
+}
+
+func (this *SignerSuite) TestPreservesOtherHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("Vary", "Accept-Encoding")
+		resp.Header().Set("X-Amp-Version", "42")
+		resp.Header().Set("Set-Cookie", "yum yum yum")
+		resp.Write(fakeBody)
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("Accept-Encoding", exchange.ResponseHeaders.Get("Vary"))
+	this.Assert().Equal("42", exchange.ResponseHeaders.Get("X-Amp-Version"))
+	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Set-Cookie"))
+}
+
 func (this *SignerSuite) TestMutatesCspHeaders() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{
@@ -334,6 +903,31 @@ func (this *SignerSuite) TestMutatesCspHeaders() {
 		exchange.ResponseHeaders.Get("Content-Security-Policy"))
 }
 
+func (this *SignerSuite) TestOverrideUpstreamCSP() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Add("Content-Security-Policy", "base-uri http://*.example.com; script-src https://notallowed.org/")
+		resp.Header().Add("Content-Security-Policy", "form-action 'self'")
+		resp.Write(fakeBody)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	for _, test := range []struct {
+		override bool
+		expected string
+	}{
+		{false, "base-uri http://*.example.com;" + MutateFetchedContentSecurityPolicy("")},
+		{true, MutateFetchedContentSecurityPolicy("")},
+	} {
+		resp := this.get(this.T(), this.newWithOptions(urlSets, Options{OverrideUpstreamCSP: test.override}), target)
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal([]string{test.expected}, exchange.ResponseHeaders["Content-Security-Policy"], "override=%t", test.override)
+	}
+}
+
 func (this *SignerSuite) TestAddsLinkHeaders() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
@@ -349,250 +943,2489 @@ func (this *SignerSuite) TestAddsLinkHeaders() {
 	this.Assert().Equal("<foo>;rel=preload;as=style,<bar>;rel=preload;as=script", exchange.ResponseHeaders.Get("Link"))
 }
 
-func (this *SignerSuite) TestEscapesLinkHeaders() {
+func (this *SignerSuite) TestPreloadResources() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	body := []byte("<html amp><head><link rel=stylesheet href=foo><script src=bar>")
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		// This shouldn't happen for valid AMP, and AMP Caches should
-		// verify the Link header so that it wouldn't be ingested.
-		// However, it would be nice to limit the impact that could be
-		// caused by transformation of an invalid AMP, e.g. on a
-		// same-origin impression.
-		resp.Write([]byte(`<html amp><head><script src="https://foo.com/a,b>c?d>e|f">`))
+		resp.Write(body)
 	}
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
-
+	handler := this.new(urlSets)
+	resp := this.get(this.T(), handler, "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 	exchange, err := signedexchange.ReadExchange(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal("<https://foo.com/a,b%3Ec?d%3Ee%7Cf>;rel=preload;as=script", exchange.ResponseHeaders.Get("Link"))
+
+	signURL, err := url.Parse(this.httpsURL() + fakePath)
+	this.Require().NoError(err)
+	resources, err := handler.PreloadResources(body, signURL)
+	this.Require().NoError(err)
+	this.Assert().Equal([]PreloadResource{{"foo", "preload", "style", "", "", "", ""}, {"bar", "preload", "script", "", "", "", ""}}, resources)
+	this.Assert().Equal(exchange.ResponseHeaders.Get("Link"), formatLinkHeader(resources))
 }
 
-func (this *SignerSuite) TestRemovesHopByHopHeaders() {
+func (this *SignerSuite) TestMergesUpstreamLinkHeaders() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Header().Set("Connection", "PROXY-AUTHENTICATE, Server")
-		resp.Header().Set("Proxy-Authenticate", "Basic")
-		resp.Header().Set("Server", "thing")
-		resp.Header().Set("Transfer-Encoding", "chunked") // Also removed, per RFC 2616.
+		resp.Header().Add("Link", "<foo>; rel=preload; as=style, <https://example.com/a,b.woff2>; rel=preload; as=font; crossorigin")
+		resp.Header().Add("Link", "<https://example.com/hero.jpg>;rel=preload;as=image, garbage")
 		resp.Write([]byte("<html amp><head><link rel=stylesheet href=foo><script src=bar>"))
 	}
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{MergeUpstreamLinkHeaders: true}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 
 	exchange, err := signedexchange.ReadExchange(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Contains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Content-Type"))
-	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Connection"))
-	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Proxy-Authenticate"))
-	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Server"))
-	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Transfer-Encoding"))
+	this.Assert().Equal("<foo>;rel=preload;as=style,<bar>;rel=preload;as=script,"+
+		"<https://example.com/a,b.woff2>; rel=preload; as=font; crossorigin,"+
+		"<https://example.com/hero.jpg>;rel=preload;as=image",
+		exchange.ResponseHeaders.Get("Link"))
 }
 
-func (this *SignerSuite) TestErrorNoCache() {
+func (this *SignerSuite) TestRuntimePreload() {
 	urlSets := []util.URLSet{{
-		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
-	}}
-	// Missing sign param generates an error.
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath))
-	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
-	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Write([]byte("<html amp><head><script async src=https://cdn.ampproject.org/v0.js></script><link rel=stylesheet href=foo>"))
+	}
+	for _, test := range []struct {
+		exclude bool
+		link    string
+	}{
+		{false, "<https://cdn.ampproject.org/v0.js>;rel=preload;as=script,<foo>;rel=preload;as=style"},
+		{true, "<foo>;rel=preload;as=style"},
+	} {
+		resp := this.get(this.T(), this.newWithOptions(urlSets, Options{ExcludeRuntimePreload: test.exclude}),
+			"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal(test.link, exchange.ResponseHeaders.Get("Link"), "exclude=%t", test.exclude)
+	}
 }
 
-func (this *SignerSuite) TestProxyUnsignedIfRedirect() {
+func (this *SignerSuite) TestDataFetchPreloads() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
-	}}
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Header().Set("Set-Cookie", "yum yum yum")
-		resp.Header().Set("Location", "/login")
-		resp.WriteHeader(301)
+		resp.Write([]byte(`<html amp><head><link rel=stylesheet href=foo></head><body>` +
+			`<amp-list src="https://example.com/list.json" width=auto height=100></amp-list>` +
+			`<amp-state id=state src="/state.json"></amp-state>` +
+			`<amp-list src="https://example.com/private.json" credentials=include></amp-list>` +
+			`<amp-list src="http://example.com/insecure.json"></amp-list>`))
 	}
 
 	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(301, resp.StatusCode)
-	this.Assert().Equal("yum yum yum", resp.Header.Get("set-cookie"))
-	this.Assert().Equal("/login", resp.Header.Get("location"))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<foo>;rel=preload;as=style", exchange.ResponseHeaders.Get("Link"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{PreloadDataFetches: true}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err = signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<foo>;rel=preload;as=style,"+
+		"<https://example.com/list.json>;rel=preload;as=fetch;crossorigin,"+
+		"<"+this.httpsURL()+"/state.json>;rel=preload;as=fetch;crossorigin",
+		exchange.ResponseHeaders.Get("Link"))
 }
 
-func (this *SignerSuite) TestProxyUnsignedIfNotModified() {
+func (this *SignerSuite) TestMaxPreloads() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
-	}}
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Header().Set("Cache-control", "private")
-		resp.Header().Set("Cookie", "yum yum yum")
-		resp.Header().Set("ETag", "superrad")
-		resp.WriteHeader(304)
+		resp.Write([]byte(`<html amp><head><link rel=stylesheet href=a><script src=b></script><link rel=stylesheet href=a>` +
+			`<script src=c></script><script src=b></script></head><body>` +
+			`<amp-list src="https://example.com/list.json" width=auto height=100></amp-list>`))
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	for _, test := range []struct {
+		max  int
+		link string
+	}{
+		{0, "<a>;rel=preload;as=style,<b>;rel=preload;as=script,<c>;rel=preload;as=script,<https://example.com/list.json>;rel=preload;as=fetch;crossorigin"},
+		{3, "<a>;rel=preload;as=style,<b>;rel=preload;as=script,<c>;rel=preload;as=script"},
+		{1, "<a>;rel=preload;as=style"},
+	} {
+		resp := this.get(this.T(), this.newWithOptions(urlSets, Options{PreloadDataFetches: true, MaxPreloads: test.max}), target)
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal(test.link, exchange.ResponseHeaders.Get("Link"), "max=%d", test.max)
 	}
+}
 
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(304, resp.StatusCode)
-	this.Assert().Equal("private", resp.Header.Get("cache-control"))
-	this.Assert().Equal("", resp.Header.Get("cookie"))
-	this.Assert().Equal("superrad", resp.Header.Get("etag"))
+func TestCapPreloads(t *testing.T) {
+	preloads := []*rpb.Metadata_Preload{
+		{Url: "data.json", As: "fetch"}, {Url: "a.css", As: "style"}, {Url: "font.woff", As: "font"}, {Url: "b.js", As: "script"}}
+	urls := func(preloads []*rpb.Metadata_Preload) []string {
+		var urls []string
+		for _, preload := range preloads {
+			urls = append(urls, preload.Url)
+		}
+		return urls
+	}
+	assert.Equal(t, []string{"data.json", "a.css", "font.woff", "b.js"}, urls(capPreloads(preloads, 4)))
+	assert.Equal(t, []string{"data.json", "a.css", "b.js"}, urls(capPreloads(preloads, 3)))
+	assert.Equal(t, []string{"a.css", "b.js"}, urls(capPreloads(preloads, 2)))
+	assert.Equal(t, []string{"a.css"}, urls(capPreloads(preloads, 1)))
 }
 
-func (this *SignerSuite) TestProxyUnsignedIfShouldntPackage() {
+func (this *SignerSuite) TestExtendedPreloads() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
-	}}
-	this.shouldPackage = false
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Write([]byte(`<html amp><head><link rel=stylesheet href=a>` +
+			`<link rel=preload as=font href="https://fonts.example/a,b>c.woff2?d>e|f">` +
+			`<link rel="dns-prefetch preconnect" href="https://fonts.example/">` +
+			`<link rel=preconnect href="https://fonts.example/other">` +
+			`<link rel=preconnect href="http://insecure.example/">` +
+			`</head><body>` +
+			`<amp-img data-hero src="/hero.jpg" width=100 height=100></amp-img>` +
+			`<amp-img src="/other.jpg" width=100 height=100></amp-img>` +
+			`<link rel=preload as=font href="https://fonts.example/body.woff2">`))
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<a>;rel=preload;as=style", exchange.ResponseHeaders.Get("Link"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{ExtendedPreloads: true}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err = signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<a>;rel=preload;as=style,"+
+		"<https://fonts.example/a,b%3Ec.woff2?d%3Ee%7Cf>;rel=preload;as=font;crossorigin,"+
+		"<"+this.httpsURL()+"/hero.jpg>;rel=preload;as=image,"+
+		"<https://fonts.example>;rel=preconnect", exchange.ResponseHeaders.Get("Link"))
+}
+
+func (this *SignerSuite) TestCrossOriginLinkHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Write([]byte(`<html amp><head><link rel=stylesheet href=a crossorigin=anonymous>` +
+			`<link rel=preload as=font href="https://fonts.example/a>b.woff2" crossorigin>` +
+			`<link rel=preload as=font href="https://fonts.example/c.woff2" crossorigin=use-credentials>`))
+	}
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{ExtendedPreloads: true}), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<a>;rel=preload;as=style;crossorigin,"+
+		"<https://fonts.example/a%3Eb.woff2>;rel=preload;as=font;crossorigin,"+
+		"<https://fonts.example/c.woff2>;rel=preload;as=font;crossorigin=use-credentials", exchange.ResponseHeaders.Get("Link"))
+}
+
+func (this *SignerSuite) TestPreloadMedia() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Write([]byte(`<html amp><head><link rel=stylesheet href=a media="screen and (min-width: 600px), print">` +
+			`<link rel=preload as=font href="https://fonts.example/b>c.woff2" media='(prefers-color-scheme: "dark")'>` +
+			`<script src=d></script>`))
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{ExtendedPreloads: true}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<a>;rel=preload;as=style,<d>;rel=preload;as=script,"+
+		"<https://fonts.example/b%3Ec.woff2>;rel=preload;as=font;crossorigin", exchange.ResponseHeaders.Get("Link"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{ExtendedPreloads: true, PreloadMedia: true}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err = signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	link := `<a>;rel=preload;as=style;media="screen and (min-width: 600px), print",<d>;rel=preload;as=script,` +
+		`<https://fonts.example/b%3Ec.woff2>;rel=preload;as=font;crossorigin;media="(prefers-color-scheme: \"dark\")"`
+	this.Assert().Equal(link, exchange.ResponseHeaders.Get("Link"))
+	// The quoted commas don't split link-values.
+	this.Assert().Len(splitLinkHeader(link), 3)
+}
+
+func (this *SignerSuite) TestPreloadHeroSrcset() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Write([]byte(`<html amp><head></head><body>` +
+			`<amp-img data-hero src="/hero.jpg" srcset="/hero-1x.jpg 1x,/hero-2x.jpg 2x, https://cdn.example/hero-3x.jpg,"` +
+			` sizes="(min-width: 600px) 50vw, 100vw" width=100 height=100></amp-img>`))
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{ExtendedPreloads: true}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<"+this.httpsURL()+"/hero.jpg>;rel=preload;as=image", exchange.ResponseHeaders.Get("Link"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{ExtendedPreloads: true, PreloadHeroSrcset: true}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err = signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<"+this.httpsURL()+"/hero.jpg>;rel=preload;as=image;"+
+		`imagesrcset="`+this.httpsURL()+"/hero-1x.jpg 1x, "+this.httpsURL()+`/hero-2x.jpg 2x, https://cdn.example/hero-3x.jpg";`+
+		`imagesizes="(min-width: 600px) 50vw, 100vw"`, exchange.ResponseHeaders.Get("Link"))
+}
+
+func (this *SignerSuite) TestPreloadHeroSrcsetInsecureCandidate() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Write([]byte(`<html amp><head></head><body>` +
+			`<amp-img data-hero src="/hero.jpg" srcset="/hero-1x.jpg 1x, http://insecure.example/hero-2x.jpg 2x" width=100 height=100></amp-img>`))
+	}
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{ExtendedPreloads: true, PreloadHeroSrcset: true}), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	// The src is still preloaded, but the srcset is dropped.
+	this.Assert().Equal("<"+this.httpsURL()+"/hero.jpg>;rel=preload;as=image", exchange.ResponseHeaders.Get("Link"))
+}
+
+func (this *SignerSuite) TestCanonicalLinkHeader() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Write([]byte(`<html amp><head><script src=a></script>`))
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<a>;rel=preload;as=script", exchange.ResponseHeaders.Get("Link"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{CanonicalLinkHeader: true}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err = signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<a>;rel=preload;as=script,<"+this.httpsURL()+fakePath+">;rel=canonical", exchange.ResponseHeaders.Get("Link"))
+}
+
+func (this *SignerSuite) TestEscapesLinkHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// This shouldn't happen for valid AMP, and AMP Caches should
+		// verify the Link header so that it wouldn't be ingested.
+		// However, it would be nice to limit the impact that could be
+		// caused by transformation of an invalid AMP, e.g. on a
+		// same-origin impression.
+		resp.Write([]byte(`<html amp><head><script src="https://foo.com/a,b>c?d>e|f">`))
+	}
 	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
 	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
-	body, err := ioutil.ReadAll(resp.Body)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+	this.Assert().Equal("<https://foo.com/a,b%3Ec?d%3Ee%7Cf>;rel=preload;as=script", exchange.ResponseHeaders.Get("Link"))
 }
 
-func (this *SignerSuite) TestProxyUnsignedIfMissingAMPCacheTransformHeader() {
+func (this *SignerSuite) TestRemovesHopByHopHeaders() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
-	}}
-	resp := pkgt.GetH(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), http.Header{
-		"Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion}})
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("Connection", "PROXY-AUTHENTICATE, Server")
+		resp.Header().Set("Proxy-Authenticate", "Basic")
+		resp.Header().Set("Server", "thing")
+		resp.Header().Set("Transfer-Encoding", "chunked") // Also removed, per RFC 2616.
+		resp.Write([]byte("<html amp><head><link rel=stylesheet href=foo><script src=bar>"))
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
 	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
-	body, err := ioutil.ReadAll(resp.Body)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+	this.Assert().Contains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Content-Type"))
+	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Connection"))
+	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Proxy-Authenticate"))
+	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Server"))
+	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Transfer-Encoding"))
 }
 
-func (this *SignerSuite) TestProxyUnsignedIfMissingAcceptHeader() {
+func (this *SignerSuite) TestErrorNoCache() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
 	}}
-	resp := pkgt.GetH(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), http.Header{
-		"AMP-Cache-Transform": {"google"}})
+	// Missing sign param generates an error.
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath))
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+}
+
+func (this *SignerSuite) TestFetchSignPathMismatch() {
+	urlSets := []util.URLSet{{
+		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?fetch="+url.QueryEscape(this.httpURL()+"/amp/a.html")+
+		"&sign="+url.QueryEscape(this.httpsURL()+"/amp/b.html"))
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+
+	resp = this.get(this.T(), this.new(urlSets), "/priv/doc?fetch="+url.QueryEscape(this.httpURL()+"/amp/./a.html")+
+		"&sign="+url.QueryEscape(this.httpsURL()+"/amp/%61.html"))
 	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
-	body, err := ioutil.ReadAll(resp.Body)
-	this.Require().NoError(err)
-	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+	this.Assert().Equal("/amp/a.html", this.lastRequest.URL.Path)
 }
 
-func (this *SignerSuite) TestProxyUnsignedNonCachable() {
+func (this *SignerSuite) TestProxyUnsignedIfRedirect() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
 	}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
-		resp.Header().Set("Content-Type", "text/html")
-		resp.Header().Set("Cache-Control", "no-store")
-		resp.WriteHeader(200)
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("Set-Cookie", "yum yum yum")
+		resp.Header().Set("Location", "/login")
+		resp.WriteHeader(301)
 	}
 
 	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(200, resp.StatusCode)
-	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
-	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	this.Assert().Equal(301, resp.StatusCode)
+	this.Assert().Equal("yum yum yum", resp.Header.Get("set-cookie"))
+	this.Assert().Equal("/login", resp.Header.Get("location"))
 }
 
-func (this *SignerSuite) TestProxyUnsignedBadContentEncoding() {
+func (this *SignerSuite) TestStripsAcceptRanges() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
 	}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
-		resp.Header().Set("Content-Type", "text/html")
-		resp.Header().Set("Content-Encoding", "br")
-		resp.WriteHeader(200)
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("Accept-Ranges", "bytes")
+		resp.Write(fakeBody)
 	}
 
 	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(200, resp.StatusCode)
-	this.Assert().Equal("br", resp.Header.Get("Content-Encoding"))
-	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Empty(resp.Header.Get("Accept-Ranges"))
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().NotContains(exchange.ResponseHeaders, "Accept-Ranges")
 }
 
-func (this *SignerSuite) TestProxyUnsignedErrOnStatefulHeader() {
+func (this *SignerSuite) TestProxyUnsignedIfPartialContent() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), true, 2000, nil},
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
 	}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		this.lastRequest = req
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Header().Set("Set-Cookie", "chocolate chip")
-		resp.Header().Set("Content-Type", "text/html")
-		resp.WriteHeader(200)
+		resp.Header().Set("Content-Range", "bytes 0-9/100")
+		resp.WriteHeader(206)
+		resp.Write([]byte("<html amp"))
 	}
 
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(200, resp.StatusCode)
-	this.Assert().Equal("chocolate chip", resp.Header.Get("Set-Cookie"))
-	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	resp := pkgt.GetH(this.T(), this.newWithOptions(urlSets, Options{ForwardedHeaders: []string{"Range"}}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), http.Header{
+			"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+			"Range": {"bytes=0-9"}})
+	this.Assert().Equal(206, resp.StatusCode)
+	this.Assert().Equal("bytes=0-9", this.lastRequest.Header.Get("Range"))
+	this.Assert().Equal("text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	this.Assert().Equal("bytes 0-9/100", resp.Header.Get("Content-Range"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<html amp", string(body))
 }
 
-func (this *SignerSuite) TestProxyUnsignedOnVariants() {
+func (this *SignerSuite) TestProxyUnsignedIfNotModified() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), true, 2000, nil},
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
 	}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Header().Set("Variants", "foo")
-		resp.Header().Set("Content-Type", "text/html")
-		resp.WriteHeader(200)
+		resp.Header().Set("Cache-control", "private")
+		resp.Header().Set("Cookie", "yum yum yum")
+		resp.Header().Set("ETag", "superrad")
+		resp.WriteHeader(304)
 	}
 
 	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(200, resp.StatusCode)
-	this.Assert().Equal("foo", resp.Header.Get("Variants"))
-	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	this.Assert().Equal(304, resp.StatusCode)
+	this.Assert().Equal("private", resp.Header.Get("cache-control"))
+	this.Assert().Equal("", resp.Header.Get("cookie"))
+	this.Assert().Equal("superrad", resp.Header.Get("etag"))
 }
 
-
-func (this *SignerSuite) TestProxyUnsignedIfNotAMP() {
+func (this *SignerSuite) TestProxyUnsignedIfShouldntPackage() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
-	nonAMPBody := []byte("<html><body>They like to OPINE. Get it? (Is he fir real? Yew gotta be kidding me.)")
-	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
-		resp.Header().Set("Content-Type", "text/html")
-		resp.Write(nonAMPBody)
-	}
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	this.shouldPackage = false
 	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
 	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
-
 	body, err := ioutil.ReadAll(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal(nonAMPBody, body, "incorrect body: %#v", resp)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
 }
 
-func (this *SignerSuite) TestProxyUnsignedIfWrongAMP() {
+func (this *SignerSuite) TestRequestAwareShouldPackage() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
-	wrongAMPBody := []byte("<html amp4email><body>They like to OPINE. Get it? (Is he fir real? Yew gotta be kidding me.)")
-	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
-		resp.Header().Set("Content-Type", "text/html")
-		resp.Write(wrongAMPBody)
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	shouldPackage := func(req *http.Request) bool {
+		signURL, err := url.Parse(req.FormValue("sign"))
+		return err == nil && !strings.HasPrefix(signURL.Path, "/amp/unsigned/")
 	}
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	handler, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, shouldPackage, nil, true, 0, 0, Options{})
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+
+	resp := this.get(this.T(), handler, "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
 	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
 
+	resp = this.get(this.T(), handler, "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+"/amp/unsigned/page.html"))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
 	body, err := ioutil.ReadAll(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal(wrongAMPBody, body, "incorrect body: %#v", resp)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
 }
 
-func (this *SignerSuite) TestProxyTransformError() {
+func (this *SignerSuite) TestKillSwitch() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
 	}}
+	dir, err := ioutil.TempDir("", "killswitch")
+	this.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "disable-signing")
+	// Cached exchanges, too, aren't served while it's engaged.
+	handler := this.newWithOptions(urlSets, Options{KillSwitch: util.NewKillSwitch(path, 0), Cache: NewLRUCache(10, 0)})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
 
-	// Generate a request for non-existent transformer that will fail
-	getTransformerRequest = func(r *rtv.RTVCache, s, u string) *rpb.Request {
-		return &rpb.Request{Html: string(s), DocumentUrl: u, Config: rpb.Request_CUSTOM,
-			AllowedFormats: []rpb.Request_HtmlFormat{rpb.Request_AMP},
-			Transformers:   []string{"bogus"}}
-	}
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(200, resp.StatusCode)
+	resp := this.get(this.T(), handler, target)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+	this.Require().NoError(ioutil.WriteFile(path, nil, 0644))
+	resp = this.get(this.T(), handler, target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+
+	// It's ANDed with shouldPackage, which may still disable signing.
+	this.Require().NoError(os.Remove(path))
+	this.shouldPackage = false
+	resp = this.get(this.T(), handler, target)
 	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
 
+	this.shouldPackage = true
+	resp = this.get(this.T(), handler, target)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfMissingAMPCacheTransformHeader() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	resp := pkgt.GetH(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), http.Header{
+		"Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion}})
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 	body, err := ioutil.ReadAll(resp.Body)
 	this.Require().NoError(err)
 	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
 }
 
-func TestSignerSuite(t *testing.T) {
-	suite.Run(t, new(SignerSuite))
+func (this *SignerSuite) TestProxyUnsignedIfMissingAcceptHeader() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	resp := pkgt.GetH(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), http.Header{
+		"AMP-Cache-Transform": {"google"}})
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+}
+
+func (this *SignerSuite) TestProxyUnsignedNonCachable() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Cache-Control", "no-store")
+		resp.WriteHeader(200)
+	}
+
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(200, resp.StatusCode)
+	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+}
+
+func (this *SignerSuite) TestMaxAgeClampsExpiry() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	cacheControl := "max-age=600"
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Cache-Control", cacheControl)
+		resp.Write(fakeBody)
+	}
+	handler := this.new(urlSets)
+	now := time.Date(2018, time.October, 1, 12, 0, 0, 0, time.UTC)
+	handler.nowFunc = func() time.Time { return now }
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), handler, target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(exchange.SignatureHeaderValue, fmt.Sprintf("date=%d; expires=%d", now.Add(-24*time.Hour).Unix(), now.Add(600*time.Second).Unix()))
+
+	// s-maxage takes precedence, as the AMP Cache is a shared cache.
+	cacheControl = "max-age=600, s-maxage=60"
+	resp = this.get(this.T(), handler, target)
+	exchange, err = signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(exchange.SignatureHeaderValue, fmt.Sprintf("expires=%d", now.Add(60*time.Second).Unix()))
+
+	// A max-age longer than the signature expiry doesn't extend it.
+	cacheControl = "max-age=31536000"
+	resp = this.get(this.T(), handler, target)
+	exchange, err = signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(exchange.SignatureHeaderValue, fmt.Sprintf("expires=%d", now.Add(6*24*time.Hour).Unix()))
+
+	// A max-age of 0 can't be honored by a signed exchange.
+	cacheControl = "max-age=0"
+	resp = this.get(this.T(), handler, target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+}
+
+func (this *SignerSuite) TestLastModified() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		// An obsolete RFC 850 date.
+		resp.Header().Set("Last-Modified", "Monday, 01-Oct-18 12:00:00 GMT")
+		resp.Write(fakeBody)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().NotContains(exchange.ResponseHeaders, "Last-Modified")
+
+	handler := this.newWithOptions(urlSets, Options{LastModified: true})
+	resp = this.get(this.T(), handler, target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err = signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("Mon, 01 Oct 2018 12:00:00 GMT", exchange.ResponseHeaders.Get("Last-Modified"))
+}
+
+func (this *SignerSuite) TestProxyUnsignedConflictingCacheControl() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	// no-store and private win over public, in either order, and whether
+	// in the same header or not.
+	for _, cacheControl := range [][]string{{"no-store, public"}, {"public, no-store"}, {"public", "no-store"}, {"public, private"}} {
+		this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("Content-Type", "text/html")
+			resp.Header()["Cache-Control"] = cacheControl
+			resp.Write(fakeBody)
+		}
+		resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+		this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal("text/html", resp.Header.Get("Content-Type"), "%q", cacheControl)
+		body, err := ioutil.ReadAll(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal(fakeBody, body, "%q", cacheControl)
+	}
+}
+
+func (this *SignerSuite) TestProxyUnsignedBadContentEncoding() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Content-Encoding", "br")
+		resp.WriteHeader(200)
+	}
+
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(200, resp.StatusCode)
+	this.Assert().Equal("br", resp.Header.Get("Content-Encoding"))
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+}
+
+func (this *SignerSuite) TestProxyUnsignedErrOnStatefulHeader() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), true, 2000, nil},
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("Set-Cookie", "chocolate chip")
+		resp.Header().Set("Content-Type", "text/html")
+		resp.WriteHeader(200)
+	}
+
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(200, resp.StatusCode)
+	this.Assert().Equal("chocolate chip", resp.Header.Get("Set-Cookie"))
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+}
+
+func (this *SignerSuite) TestProxyUnsignedOnVariants() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), true, 2000, nil},
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("Variants", "foo")
+		resp.Header().Set("Content-Type", "text/html")
+		resp.WriteHeader(200)
+	}
+
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(200, resp.StatusCode)
+	this.Assert().Equal("foo", resp.Header.Get("Variants"))
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+}
+
+
+func (this *SignerSuite) TestProxyUnsignedIfNotAMP() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	nonAMPBody := []byte("<html><body>They like to OPINE. Get it? (Is he fir real? Yew gotta be kidding me.)")
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(nonAMPBody)
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(nonAMPBody, body, "incorrect body: %#v", resp)
+}
+
+type stubValidator struct {
+	err    error
+	html   []byte
+	format rpb.Request_HtmlFormat
+}
+
+func (this *stubValidator) Validate(html []byte, format rpb.Request_HtmlFormat) error {
+	this.html, this.format = html, format
+	return this.err
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfInvalidAMP() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	validator := &stubValidator{err: errors.New("The mandatory tag 'amphtml engine v0.js script' is missing or incorrect.")}
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{Validator: validator}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+	this.Assert().Equal(fakeBody, validator.html)
+	this.Assert().Equal(rpb.Request_AMP, validator.format)
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{Validator: &stubValidator{}}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfWrongAMP() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	wrongAMPBody := []byte("<html amp4email><body>They like to OPINE. Get it? (Is he fir real? Yew gotta be kidding me.)")
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(wrongAMPBody)
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(wrongAMPBody, body, "incorrect body: %#v", resp)
+}
+
+func (this *SignerSuite) TestAllowedFormats() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	adsBody := []byte("<html amp4ads><body>Buy now!</body></html>")
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(adsBody)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	// AMP4ADS isn't allowed by default.
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(adsBody, body, "incorrect body: %#v", resp)
+
+	validator := &stubValidator{}
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{
+		AllowedFormats: []rpb.Request_HtmlFormat{rpb.Request_AMP, rpb.Request_AMP4ADS},
+		Validator:      validator,
+	}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	this.Assert().Equal(rpb.Request_AMP4ADS, validator.format)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	payload, err := util.VerifyMIPayload(mice.Draft03Encoding, exchange.Payload, exchange.ResponseHeaders.Get("Digest"))
+	this.Require().NoError(err)
+	this.Assert().Contains(string(payload), "<html amp4ads>")
+}
+
+func (this *SignerSuite) TestProxyTransformError() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+
+	// Generate a request for non-existent transformer that will fail
+	getTransformerRequest = func(r *rtv.RTVCache, s, u string, formats []rpb.Request_HtmlFormat) *rpb.Request {
+		return &rpb.Request{Html: string(s), DocumentUrl: u, Config: rpb.Request_CUSTOM,
+			AllowedFormats: formats,
+			Transformers:   []string{"bogus"}}
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(200, resp.StatusCode)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfMissingViewport() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+
+	// By default, fakeBody (which lacks a viewport) is signed.
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{ErrorOnMissingViewport: true}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+
+	// A document with a viewport is signed.
+	viewportBody := []byte(`<html amp><head><meta name="viewport" content="width=device-width"></head><body></body></html>`)
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(viewportBody)
+	}
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{ErrorOnMissingViewport: true}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+}
+
+func (this *SignerSuite) TestNonNosniffContentTypeOptions() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("X-Content-Type-Options", "sniff-away")
+		resp.Write(fakeBody)
+	}
+
+	// By default, the value is normalized.
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("nosniff", exchange.ResponseHeaders.Get("X-Content-Type-Options"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{ErrorOnNonNosniff: true}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	this.Assert().Equal("sniff-away", resp.Header.Get("X-Content-Type-Options"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+}
+
+func (this *SignerSuite) TestUnsupportedVary() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Vary", "Cookie")
+		resp.Write(fakeBody)
+	}
+
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{ErrorOnUnsupportedVary: true}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	this.Assert().Equal("Cookie", resp.Header.Get("Vary"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+}
+
+type logEntry struct {
+	level, msg string
+	kv         []interface{}
+}
+
+type capturingLogger struct {
+	entries []logEntry
+}
+
+func (this *capturingLogger) Info(msg string, kv ...interface{}) {
+	this.entries = append(this.entries, logEntry{"info", msg, kv})
+}
+
+func (this *capturingLogger) Error(msg string, kv ...interface{}) {
+	this.entries = append(this.entries, logEntry{"error", msg, kv})
+}
+
+func (this *SignerSuite) TestSecurityHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	this.shouldPackage = false
+
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().Equal("text/html", resp.Header.Get("Content-Type"))
+	this.Assert().Equal("", resp.Header.Get("X-Content-Type-Options"))
+	this.Assert().Equal("", resp.Header.Get("Strict-Transport-Security"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{SecurityHeaders: true}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().Equal("text/html", resp.Header.Get("Content-Type"))
+	this.Assert().Equal("nosniff", resp.Header.Get("X-Content-Type-Options"))
+	this.Assert().Equal("", resp.Header.Get("Strict-Transport-Security"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body)
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{SecurityHeaders: true, HSTS: "max-age=31536000"}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("nosniff", resp.Header.Get("X-Content-Type-Options"))
+	this.Assert().Equal("max-age=31536000", resp.Header.Get("Strict-Transport-Security"))
+
+	// Upstream HSTS is preserved, but upstream X-Content-Type-Options isn't.
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Strict-Transport-Security", "max-age=60")
+		resp.Header().Set("X-Content-Type-Options", "sniff")
+		resp.Write(fakeBody)
+	}
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{SecurityHeaders: true, HSTS: "max-age=31536000"}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("nosniff", resp.Header.Get("X-Content-Type-Options"))
+	this.Assert().Equal("max-age=60", resp.Header.Get("Strict-Transport-Security"))
+}
+
+func (this *SignerSuite) TestLogNoPreloads() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	// fakeBody has no preloadable resources.
+	logger := &capturingLogger{}
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{Logger: logger}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().Len(logger.entries, 1)
+	this.Assert().Equal("Signed exchange", logger.entries[0].msg)
+
+	logger = &capturingLogger{}
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{Logger: logger, LogNoPreloads: true}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().NotContains(exchange.ResponseHeaders, "Link")
+	this.Require().Len(logger.entries, 2)
+	this.Assert().Equal(logEntry{"info", "No preloads", []interface{}{"url", urlOrDie(this.httpsURL() + fakePath)}}, logger.entries[0])
+	this.Assert().Equal("Signed exchange", logger.entries[1].msg)
+}
+
+func (this *SignerSuite) TestDebugOriginalDigest() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("", resp.Header.Get("AMPPKG-Debug-Original-Digest"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{DebugOriginalDigest: true}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	digest := sha256.Sum256(fakeBody)
+	this.Assert().Equal("sha-256="+base64.StdEncoding.EncodeToString(digest[:]), resp.Header.Get("AMPPKG-Debug-Original-Digest"))
+}
+
+func (this *SignerSuite) TestLogger() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	// Close the connection without responding.
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		conn, _, err := resp.(http.Hijacker).Hijack()
+		this.Require().NoError(err)
+		conn.Close()
+	}
+	logger := &capturingLogger{}
+	header := http.Header{
+		"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+		"Cookie": {"secret=yum"}}
+	resp := pkgt.GetH(this.T(), this.newWithOptions(urlSets, Options{Logger: logger}), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), header)
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+
+	this.Require().Len(logger.entries, 1)
+	entry := logger.entries[0]
+	this.Assert().Equal("error", entry.level)
+	this.Assert().Equal("Fetch failed", entry.msg)
+	fields := map[string]interface{}{}
+	for i := 0; i+1 < len(entry.kv); i += 2 {
+		fields[entry.kv[i].(string)] = entry.kv[i+1]
+	}
+	this.Assert().Equal(this.httpsURL()+fakePath, fmt.Sprint(fields["url"]))
+	this.Assert().Equal("error", fields["outcome"])
+	this.Assert().Contains(fields, "latency_ms")
+	this.Assert().NotContains(fmt.Sprint(entry.kv), "yum")
+
+	// The default logger writes JSON.
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	log.SetFlags(0)
+	defer log.SetFlags(log.LstdFlags)
+	JSONLogger{}.Error("Fetch failed", "url", urlOrDie(this.httpsURL()+fakePath), "error", errors.New("oops"), "latency_ms", 1.5)
+	this.Assert().JSONEq(`{"level": "error", "msg": "Fetch failed", "url": "`+this.httpsURL()+fakePath+`", "error": "oops", "latency_ms": 1.5}`, buf.String())
+}
+
+func (this *SignerSuite) TestContentLengthMismatch() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	// Claim a longer body than is sent. (net/http won't write this, so
+	// hijack the connection.)
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		conn, buf, err := resp.(http.Hijacker).Hijack()
+		this.Require().NoError(err)
+		defer conn.Close()
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: %d\r\n\r\n", len(fakeBody)+10)
+		buf.Write(fakeBody)
+		buf.Flush()
+	}
+
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{ErrorOnContentLengthMismatch: true}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+}
+
+func (this *SignerSuite) TestContentLengthOverread() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	// Send more than the Content-Length claims. (net/http won't write this,
+	// so hijack the connection.)
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		conn, buf, err := resp.(http.Hijacker).Hijack()
+		this.Require().NoError(err)
+		defer conn.Close()
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: %d\r\n\r\n", len(fakeBody))
+		buf.Write(fakeBody)
+		buf.WriteString("<script>alert('extra')</script>")
+		buf.Flush()
+	}
+
+	// The excess is ignored, with or without ErrorOnContentLengthMismatch.
+	for _, options := range []Options{{}, {ErrorOnContentLengthMismatch: true}} {
+		resp := this.get(this.T(), this.newWithOptions(urlSets, options), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+		this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		payload, err := util.VerifyMIPayload(mice.Draft03Encoding, exchange.Payload, exchange.ResponseHeaders.Get("Digest"))
+		this.Require().NoError(err)
+		this.Assert().Equal(transformedBody, payload)
+	}
+}
+
+func (this *SignerSuite) TestRefreshHeader() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Refresh", "0; url=https://example.com/")
+		resp.Write(fakeBody)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{ErrorOnRefreshHeader: true}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	this.Assert().Equal("0; url=https://example.com/", resp.Header.Get("Refresh"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+}
+
+func (this *SignerSuite) TestMissingDoctype() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+
+	// By default, fakeBody (which has an amp attribute but no doctype) is signed.
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{ErrorOnMissingDoctype: true}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(append([]byte("<!doctype html>"), fakeBody...))
+	}
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{ErrorOnMissingDoctype: true}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+}
+
+func (this *SignerSuite) TestFetchRetries() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	var fetches int
+	failures := 0
+	status := http.StatusServiceUnavailable
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		fetches++
+		if fetches <= failures {
+			resp.WriteHeader(status)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	options := Options{FetchRetries: 2, FetchRetryBackoff: time.Millisecond}
+
+	fetches, failures = 0, 2
+	resp := this.get(this.T(), this.newWithOptions(urlSets, options), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	this.Assert().Equal(3, fetches)
+
+	// Retries are limited.
+	fetches, failures = 0, 3
+	resp = this.get(this.T(), this.newWithOptions(urlSets, options), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusServiceUnavailable, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(3, fetches)
+
+	// 4xx responses aren't retried.
+	fetches, failures, status = 0, 1, http.StatusNotFound
+	resp = this.get(this.T(), this.newWithOptions(urlSets, options), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusNotFound, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(1, fetches)
+
+	// By default, nothing is retried.
+	fetches, failures, status = 0, 1, http.StatusServiceUnavailable
+	resp = this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusServiceUnavailable, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(1, fetches)
+}
+
+// Returns a TLS server that doesn't respond until the request is canceled (or
+// 5s pass), and a Signer with the given options that fetches from it. This
+// is separate from tlsServer, as its handler may still be running (and
+// reading this.fakeHandler) after the request times out.
+func (this *SignerSuite) newSlowServer(options Options) (*httptest.Server, *Signer) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	serverURL, err := url.Parse(server.URL)
+	this.Require().NoError(err)
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", serverURL.Host, stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	handler, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, options)
+	this.Require().NoError(err)
+	handler.client = server.Client()
+	handler.client.CheckRedirect = noRedirects
+	return server, handler
+}
+
+func (this *SignerSuite) TestFetchTimeout() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	server, handler := this.newSlowServer(Options{FetchTimeout: 50 * time.Millisecond})
+	defer server.Close()
+	start := time.Now()
+	resp := this.get(this.T(), handler, "/priv/doc?sign="+url.QueryEscape(server.URL+fakePath))
+	this.Assert().Equal(http.StatusGatewayTimeout, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().True(time.Since(start) < 2*time.Second, "took %s", time.Since(start))
+
+	// A fetch within the timeout succeeds, including reading the body.
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{FetchTimeout: 5 * time.Second}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+}
+
+func (this *SignerSuite) TestDeadlineHeader() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	getWithDeadline := func(handler *Signer, upstreamURL string, deadline string) *http.Response {
+		return pkgt.GetH(this.T(), handler, "/priv/doc?sign="+url.QueryEscape(upstreamURL+fakePath), http.Header{
+			"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+			"X-Amppkg-Deadline": {deadline}})
+	}
+
+	server, handler := this.newSlowServer(Options{HonorDeadlineHeader: true})
+	defer server.Close()
+	start := time.Now()
+	resp := getWithDeadline(handler, server.URL, "50")
+	this.Assert().Equal(http.StatusGatewayTimeout, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().True(time.Since(start) < 2*time.Second, "took %s", time.Since(start))
+
+	// The deadline is bounded by FetchTimeout.
+	server, handler = this.newSlowServer(Options{HonorDeadlineHeader: true, FetchTimeout: 50 * time.Millisecond})
+	defer server.Close()
+	start = time.Now()
+	resp = getWithDeadline(handler, server.URL, "60000")
+	this.Assert().Equal(http.StatusGatewayTimeout, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().True(time.Since(start) < 2*time.Second, "took %s", time.Since(start))
+
+	handler = this.newWithOptions(urlSets, Options{HonorDeadlineHeader: true})
+	resp = getWithDeadline(handler, this.httpsURL(), "5000")
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	// Invalid values are ignored.
+	resp = getWithDeadline(handler, this.httpsURL(), "soon")
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
+func (this *SignerSuite) TestGETWithBody() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+	}}
+	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) +
+		"&sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
+	getWithBody := func(handler *Signer) *http.Response {
+		rec := httptest.NewRecorder()
+		// The body params would fail to match the URLSet, if they were read.
+		req := httptest.NewRequest(http.MethodGet, target, strings.NewReader("sign=https%3A%2F%2Fexample.com%2F"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("AMP-Cache-Transform", "google")
+		req.Header.Set("Accept", "application/signed-exchange;v="+accept.AcceptedSxgVersion)
+		handler.ServeHTTP(rec, req, httprouter.Params{})
+		return rec.Result()
+	}
+
+	// By default, the body is ignored.
+	resp := getWithBody(this.new(urlSets))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(this.httpSignURL()+fakePath, exchange.RequestURI)
+
+	resp = getWithBody(this.newWithOptions(urlSets, Options{ErrorOnGETWithBody: true}))
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+}
+
+func (this *SignerSuite) TestOverridesUpstreamContentEncoding() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	for _, encoding := range []string{"gzip", "identity"} {
+		this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("Content-Type", "text/html")
+			resp.Header().Set("Content-Encoding", encoding)
+			if encoding == "gzip" {
+				// http.Client transparently decodes this.
+				gz := gzip.NewWriter(resp)
+				gz.Write(fakeBody)
+				gz.Close()
+			} else {
+				resp.Write(fakeBody)
+			}
+		}
+		resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+		this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal([]string{"mi-sha256-03"}, exchange.ResponseHeaders[http.CanonicalHeaderKey("Content-Encoding")], encoding)
+		var payloadPrefix bytes.Buffer
+		binary.Write(&payloadPrefix, binary.BigEndian, uint64(miRecordSize))
+		this.Assert().Equal(append(payloadPrefix.Bytes(), transformedBody...), exchange.Payload, encoding)
+	}
+}
+
+func (this *SignerSuite) TestMaxBodyBytes() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	body := append([]byte("<html amp><body>"), bytes.Repeat([]byte("pine "), 1000)...)
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(body)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	// A body at the limit is signed.
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{MaxBodyBytes: int64(len(body))}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{MaxBodyBytes: 1000}), target)
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{MaxBodyBytes: 1000, ProxyOversizedBody: true}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	proxied, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(body, proxied)
+}
+
+func (this *SignerSuite) TestMaxTransformedBodyBytes() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{MaxTransformedBodyBytes: 1 << 16}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+	// The transforms grow fakeBody, so its output exceeds its own size.
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{MaxTransformedBodyBytes: len(fakeBody)}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+}
+
+func (this *SignerSuite) TestMaxInlineDataBytes() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	body := []byte(`<html amp><body><amp-img src="data:image/png;base64,` + strings.Repeat("A", 2000) + `" width=1 height=1></amp-img></body></html>`)
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(body)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{MaxInlineDataBytes: 4000}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{MaxInlineDataBytes: 1000}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	proxied, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(body, proxied)
+}
+
+func (this *SignerSuite) TestMinBodyBytes() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	body := []byte(`<html amp><body>a</body></html>`)
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(body)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{MinBodyBytes: len(body)}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	// The transformed body fits in a single record, so the payload is the
+	// record size followed by the body, and the digest is of that record.
+	this.Require().True(len(exchange.Payload) > 8)
+	this.Assert().Equal(uint64(miRecordSize), binary.BigEndian.Uint64(exchange.Payload[:8]))
+	payload, err := util.VerifyMIPayload(mice.Draft03Encoding, exchange.Payload, exchange.ResponseHeaders.Get("Digest"))
+	this.Require().NoError(err)
+	this.Assert().Equal(exchange.Payload[8:], payload)
+	this.Assert().Equal(strconv.Itoa(len(payload)), exchange.ResponseHeaders.Get("Content-Length"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{MinBodyBytes: len(body) + 1}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	proxied, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(body, proxied)
+}
+
+func (this *SignerSuite) TestDeniedExtensionSrcs() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	body := []byte(`<html amp><head>` +
+		`<script async custom-element="amp-bind" src="https://cdn.ampproject.org/v0/amp-bind-0.1.js"></script>` +
+		`<script async src="https://cdn.ampproject.org/v0/amp-access-0.1.js"></script>` +
+		`</head><body></body></html>`)
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(body)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	// Only extension scripts are considered.
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{DeniedExtensionSrcs: []string{"https://cdn.ampproject.org/v0/amp-access-0.1.js"}}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{DeniedExtensionSrcs: []string{"https://cdn.ampproject.org/v0/amp-bind-0.1.js"}}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	proxied, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(body, proxied)
+}
+
+func (this *SignerSuite) TestGzipBomb() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	// Returns a handler responding with fakeBody followed by the given number
+	// of MB of zeros, each of which compresses to about 1KB.
+	bomb := func(zerosMB int) func(http.ResponseWriter, *http.Request) {
+		return func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("Content-Type", "text/html")
+			resp.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(resp)
+			gz.Write(fakeBody)
+			zeros := make([]byte, 1<<20)
+			for i := 0; i < zerosMB; i++ {
+				if _, err := gz.Write(zeros); err != nil {
+					// The signer stopped reading.
+					return
+				}
+			}
+			gz.Close()
+		}
+	}
+	this.fakeHandler = bomb(1 << 10)
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	// It's neither signed nor proxied truncated.
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{MaxDecompressedBodyBytes: 1 << 16}), target)
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+
+	// With ProxyOversizedBody, it's proxied whole (streamed, rather than
+	// read into memory by the signer). A smaller bomb suffices.
+	this.fakeHandler = bomb(4)
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{MaxDecompressedBodyBytes: 1 << 16, ProxyOversizedBody: true}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Len(body, len(fakeBody)+4<<20)
+	this.Assert().True(bytes.HasPrefix(body, fakeBody))
+}
+
+func (this *SignerSuite) TestDebugDryRun() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Set-Cookie", "yum")
+		resp.Header().Set("Link", "<https://example.com/evil.js>; rel=preload; as=script")
+		resp.Write(fakeBody)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath) + "&debug=1"
+
+	// Off by default.
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{DebugEnabled: true}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/json", resp.Header.Get("Content-Type"))
+	var debug map[string]interface{}
+	this.Require().NoError(json.NewDecoder(resp.Body).Decode(&debug))
+	this.Assert().ElementsMatch([]string{"fetch_url", "sign_url", "rtv", "sxg_version", "response_headers", "stripped_headers", "signature"}, mapKeys(debug))
+	this.Assert().Equal(this.httpsURL()+fakePath, debug["fetch_url"])
+	this.Assert().Equal(this.httpsURL()+fakePath, debug["sign_url"])
+	this.Assert().Equal(accept.AcceptedSxgVersion, debug["sxg_version"])
+	this.Assert().Equal([]interface{}{"Link", "Set-Cookie"}, debug["stripped_headers"])
+	this.Assert().Contains(debug["response_headers"], "Content-Security-Policy")
+	signature := debug["signature"].(map[string]interface{})
+	this.Assert().ElementsMatch([]string{"date", "expires", "cert_url", "validity_url", "header"}, mapKeys(signature))
+	this.Assert().Equal(this.httpsURL()+"/amppkg/cert/"+pkgt.CertName, signature["cert_url"])
+	this.Assert().Contains(signature["header"], "sig=*")
+}
+
+func mapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (this *SignerSuite) TestDumpSignedBytes() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	var dumpedURL, dumpedDigest string
+	var dumpedPayload []byte
+	numDumps := 0
+	handler := this.newWithOptions(urlSets, Options{
+		DebugSignedBytesToken: "s3cr3t",
+		SignedBytesSink: func(signURL string, payload []byte, digest string) {
+			dumpedURL, dumpedPayload, dumpedDigest = signURL, payload, digest
+			numDumps++
+		},
+	})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	header := http.Header{
+		"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion}}
+
+	// Not triggered without the header, or with the wrong token.
+	this.get(this.T(), handler, target)
+	header.Set("AMPPKG-Debug-Signed-Bytes", "guess")
+	pkgt.GetH(this.T(), handler, target, header)
+	this.Assert().Equal(0, numDumps)
+
+	header.Set("AMPPKG-Debug-Signed-Bytes", "s3cr3t")
+	resp := pkgt.GetH(this.T(), handler, target, header)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().Equal(1, numDumps)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(this.httpsURL()+fakePath, dumpedURL)
+	this.Assert().Equal(transformedBody, dumpedPayload)
+	this.Assert().Equal(exchange.ResponseHeaders.Get("Digest"), dumpedDigest)
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfAcceptOnlyHTML() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	numTransforms := 0
+	origGetTransformerRequest := getTransformerRequest
+	getTransformerRequest = func(r *rtv.RTVCache, s, u string, formats []rpb.Request_HtmlFormat) *rpb.Request {
+		numTransforms++
+		return origGetTransformerRequest(r, s, u, formats)
+	}
+	header := http.Header{"AMP-Cache-Transform": {"google"}, "Accept": {"text/html"}}
+
+	resp := pkgt.GetH(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), header)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+	this.Assert().Equal(0, numTransforms)
+
+	this.lastRequest = nil
+	resp = pkgt.GetH(this.T(), this.newWithOptions(urlSets, Options{ErrorOnUnsatisfiableAccept: true}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), header)
+	this.Assert().Equal(http.StatusNotAcceptable, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+	this.Assert().Nil(this.lastRequest)
+	this.Assert().Equal(0, numTransforms)
+}
+
+// Returns the integrity proof of the given MI-encoded records (sans record
+// size), asserting that each embedded proof matches its following record.
+func (this *SignerSuite) miProof(records []byte, recordSize int) []byte {
+	if len(records) <= recordSize {
+		sum := sha256.Sum256(append(append([]byte{}, records...), 0))
+		return sum[:]
+	}
+	next := this.miProof(records[recordSize+32:], recordSize)
+	this.Assert().Equal(next, records[recordSize:recordSize+32])
+	sum := sha256.Sum256(append(append([]byte{}, records[:recordSize+32]...), 1))
+	return sum[:]
+}
+
+func (this *SignerSuite) TestPerURLSetRecordSize() {
+	urlSets := []util.URLSet{{
+		Sign:       &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		RecordSize: 4096,
+	}, {
+		Sign:       &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch:      &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+		RecordSize: 1024,
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write([]byte("<html amp><body>" + strings.Repeat("pine ", 1000)))
+	}
+	handler := this.new(urlSets)
+	for _, test := range []struct {
+		target     string
+		recordSize int
+	}{
+		{"/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath), 1024},
+		{"/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath), 4096},
+	} {
+		resp := this.get(this.T(), handler, test.target)
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal(uint64(test.recordSize), binary.BigEndian.Uint64(exchange.Payload[:8]))
+		proof := this.miProof(exchange.Payload[8:], test.recordSize)
+		this.Assert().Equal("mi-sha256-03="+base64.StdEncoding.EncodeToString(proof), exchange.ResponseHeaders.Get("Digest"))
+	}
+}
+
+func (this *SignerSuite) TestVerifyMIPayload() {
+	urlSets := []util.URLSet{{
+		Sign:       &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		RecordSize: 1024,
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write([]byte("<html amp><body>" + strings.Repeat("pine ", 1000)))
+	}
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{VerifyMIPayload: true}), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	payload, err := util.VerifyMIPayload(mice.Draft03Encoding, exchange.Payload, exchange.ResponseHeaders.Get("Digest"))
+	this.Require().NoError(err)
+	this.Assert().Contains(string(payload), strings.Repeat("pine ", 1000))
+}
+
+func (this *SignerSuite) TestIntegrityReference() {
+	this.Assert().Equal("digest/mi-sha256-03", integrityReference(mice.Draft03Encoding))
+	this.Assert().Equal("mi-draft2", integrityReference(mice.Draft02Encoding))
+
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{MIEncoding: mice.Draft03Encoding}),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(exchange.SignatureHeaderValue, "integrity=\""+integrityReference(mice.Draft03Encoding)+"\"")
+
+	// mi-sha256-draft2 can't be emitted with the current SXG version.
+	_, err = New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{MIEncoding: mice.Draft02Encoding})
+	this.Assert().Error(err)
+}
+
+func (this *SignerSuite) TestTransformIdentities() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	for _, test := range []struct {
+		identities []string
+		act        []string
+		expected   string
+	}{
+		{nil, []string{"google"}, "google"},
+		{nil, []string{"bing"}, ""},
+		{[]string{"bing", "google"}, []string{"bing"}, "bing"},
+		{[]string{"bing", "google"}, []string{"foo, google", "bing"}, "google"},
+		{[]string{"bing", "google"}, []string{"foo", "bing, google"}, "bing"},
+		{[]string{"bing"}, []string{"any, google"}, ""},
+	} {
+		resp := pkgt.GetH(this.T(), this.newWithOptions(urlSets, Options{TransformIdentities: test.identities}), target, http.Header{
+			"AMP-Cache-Transform": test.act, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion}})
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		if test.expected == "" {
+			this.Assert().Equal("text/html", resp.Header.Get("Content-Type"), "%v", test.act)
+			this.Assert().Equal("", resp.Header.Get("AMP-Cache-Transform"), "%v", test.act)
+		} else {
+			this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"), "%v", test.act)
+			this.Assert().Equal(fmt.Sprintf(`%s;v="%d"`, test.expected, transformer.SupportedVersions[0].Max), resp.Header.Get("AMP-Cache-Transform"), "%v", test.act)
+		}
+	}
+
+	_, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{TransformIdentities: []string{"Bing"}})
+	this.Assert().Error(err)
+}
+
+func (this *SignerSuite) TestDefaultTransformVersion() {
+	orig := transformer.SupportedVersions
+	defer func() { transformer.SupportedVersions = orig }()
+	transformer.SupportedVersions = []*rpb.VersionRange{{Min: 1, Max: 2}}
+
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	for _, test := range []struct {
+		defaultVersion int64
+		act            string
+		expected       string
+	}{
+		{0, "google", `google;v="2"`},
+		{1, "google", `google;v="1"`},
+		{1, `google;v="2"`, `google;v="2"`},
+	} {
+		resp := pkgt.GetH(this.T(), this.newWithOptions(urlSets, Options{DefaultTransformVersion: test.defaultVersion}), target, http.Header{"AMP-Cache-Transform": {test.act}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion}})
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal(test.expected, resp.Header.Get("AMP-Cache-Transform"))
+	}
+
+	_, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{DefaultTransformVersion: 3})
+	this.Assert().Error(err)
+}
+
+func (this *SignerSuite) TestRTVUnavailable() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	fetches := 0
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		fetches++
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	var transformerRequest *rpb.Request
+	origGetTransformerRequest := getTransformerRequest
+	getTransformerRequest = func(r *rtv.RTVCache, s, u string, formats []rpb.Request_HtmlFormat) *rpb.Request {
+		transformerRequest = origGetTransformerRequest(r, s, u, formats)
+		transformerRequest.Rtv, transformerRequest.Css = "011907311947510", "css"
+		return transformerRequest
+	}
+	// The cache is populated only by waiting.
+	var waited time.Duration
+	isRTVPopulated = func(r *rtv.RTVCache, wait time.Duration) bool {
+		waited = wait
+		return wait > 0
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	// The fallback RTV is used, and the exchange isn't cached.
+	handler := this.newWithOptions(urlSets, Options{FallbackRTV: "012345678901234", Cache: NewLRUCache(10, 0)})
+	for i := 1; i <= 2; i++ {
+		resp := this.get(this.T(), handler, target)
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+		this.Assert().Equal("012345678901234", transformerRequest.Rtv)
+		this.Assert().Equal("", transformerRequest.Css)
+		this.Assert().Equal(i, fetches)
+	}
+	this.Assert().Equal(time.Duration(0), waited)
+
+	resp := this.get(this.T(), this.newWithOptions(urlSets, Options{RTVUnavailable: "proxy"}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{RTVUnavailable: "wait"}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	this.Assert().Equal("011907311947510", transformerRequest.Rtv)
+	this.Assert().Equal(defaultRTVWaitTimeout, waited)
+
+	// The wait times out.
+	isRTVPopulated = func(*rtv.RTVCache, time.Duration) bool { return false }
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{RTVUnavailable: "wait", RTVWaitTimeout: time.Millisecond}), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+
+	_, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, nil, nil, true, 0, 0, Options{RTVUnavailable: "block"})
+	this.Assert().EqualError(err, `RTV unavailable behavior "block" is not one of "fallback", "wait", or "proxy"`)
+}
+
+// Returns a self-signed cert for the given hosts, and its key.
+func (this *SignerSuite) newCert(hosts ...string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	this.Require().NoError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	this.Require().NoError(err)
+	cert, err := x509.ParseCertificate(der)
+	this.Require().NoError(err)
+	return cert, key
+}
+
+type countingTransport struct {
+	http.RoundTripper
+	requests int
+}
+
+func (this *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	this.requests++
+	return this.RoundTripper.RoundTrip(req)
+}
+
+func (this *SignerSuite) TestTransport() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Location", "/elsewhere")
+		resp.WriteHeader(http.StatusFound)
+	}
+	// Accept the self-signed certificate generated by the test server.
+	transport := &countingTransport{RoundTripper: this.httpsClient.Transport}
+	handler, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{Transport: transport})
+	this.Require().NoError(err)
+
+	resp := this.get(this.T(), handler, "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(1, transport.requests)
+	// The redirect is proxied, not followed.
+	this.Assert().Equal(http.StatusFound, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("/elsewhere", resp.Header.Get("Location"))
+}
+
+// A transport that renames the response headers with non-canonical casing,
+// as a custom Transport might.
+type mixedCaseTransport struct {
+	http.RoundTripper
+}
+
+func (this mixedCaseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := this.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	for name, values := range resp.Header {
+		header[strings.ToLower(name[:1])+strings.ToUpper(name[1:])] = values
+	}
+	// Two names that differ only by case.
+	header["x-Mixed-case"] = []string{"a"}
+	header["X-MIXED-CASE"] = []string{"b"}
+	resp.Header = header
+	return resp, nil
+}
+
+func (this *SignerSuite) TestMixedCaseResponseHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	transport := mixedCaseTransport{this.httpsClient.Transport}
+	handler, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{Transport: transport})
+	this.Require().NoError(err)
+
+	resp := this.get(this.T(), handler, "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	names := this.rawResponseHeaderNames(resp)
+	seen := map[string]bool{}
+	for _, name := range names {
+		this.Assert().Equal(strings.ToLower(name), name)
+		this.Assert().False(seen[name], "duplicate header %q", name)
+		seen[name] = true
+	}
+	this.Assert().True(seen["content-type"])
+	this.Assert().True(seen["x-mixed-case"])
+}
+
+func (this *SignerSuite) TestMaxConcurrentFetches() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	handler := this.newWithOptions(urlSets, Options{MaxConcurrentFetches: 2, QueueFetches: true})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 10)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = this.get(this.T(), handler, target).StatusCode
+		}(i)
+	}
+	wg.Wait()
+	for _, status := range statuses {
+		this.Assert().Equal(http.StatusOK, status)
+	}
+	this.Assert().True(maxInFlight <= 2, "max in flight: %d", maxInFlight)
+
+	// Without queueing, excess requests fail fast.
+	block := make(chan struct{})
+	started := make(chan struct{})
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-block
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	handler = this.newWithOptions(urlSets, Options{MaxConcurrentFetches: 1})
+	firstStatus := make(chan int)
+	go func() {
+		firstStatus <- this.get(this.T(), handler, target).StatusCode
+	}()
+	<-started
+	resp := this.get(this.T(), handler, target)
+	this.Assert().Equal(http.StatusServiceUnavailable, resp.StatusCode, "incorrect status: %#v", resp)
+	close(block)
+	this.Assert().Equal(http.StatusOK, <-firstStatus)
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "key unavailable" }
+func (temporaryError) Temporary() bool { return true }
+
+type errorReader struct{ err error }
+
+func (this errorReader) Read([]byte) (int, error) { return 0, this.err }
+
+func (this *SignerSuite) TestTransientSigningError() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	defer func() { signingRand = nil }()
+
+	signingRand = errorReader{temporaryError{}}
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusServiceUnavailable, resp.StatusCode, "incorrect status: %#v", resp)
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{ProxyOnTransientSigningError: true}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	this.Assert().Equal(strconv.Itoa(len(fakeBody)), resp.Header.Get("Content-Length"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+
+	// Permanent errors aren't masked.
+	signingRand = errorReader{errors.New("broken")}
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{ProxyOnTransientSigningError: true}), target)
+	this.Assert().Equal(http.StatusInternalServerError, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
+func (this *SignerSuite) TestCancelAbortsFetch() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan bool, 1)
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		// The client disconnects mid-fetch.
+		cancel()
+		select {
+		case <-req.Context().Done():
+			canceled <- true
+		case <-time.After(5 * time.Second):
+			canceled <- false
+		}
+	}
+	handler := this.new(urlSets)
+	req := httptest.NewRequest("", "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), nil).WithContext(ctx)
+	req.Header.Set("AMP-Cache-Transform", "google")
+	req.Header.Set("Accept", "application/signed-exchange;v="+accept.AcceptedSxgVersion)
+	handler.ServeHTTP(httptest.NewRecorder(), req, httprouter.Params{})
+	this.Assert().True(<-canceled, "upstream fetch wasn't canceled")
+}
+
+func (this *SignerSuite) TestReloadCert() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{[]string{"https"}, "", "amppackageexample.com", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+	}}
+	handler := this.new(urlSets)
+	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpsURL()+fakePath) + "&sign=" + url.QueryEscape("https://amppackageexample.com"+fakePath)
+	signature := func() string {
+		resp := this.get(this.T(), handler, target)
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		return exchange.SignatureHeaderValue
+	}
+	this.Assert().Contains(signature(), "cert-sha256=*"+pkgt.CertName+"=*")
+
+	newCert, newKey := this.newCert("amppackageexample.com")
+	newCertName := util.CertName(newCert)
+	newCertSHA := sha256.Sum256(newCert.Raw)
+
+	// Invalid signing material is rejected, leaving the old cert in use.
+	this.Assert().Error(handler.ReloadCert(nil, newKey))
+	this.Assert().Error(handler.ReloadCert([]*x509.Certificate{newCert}, pkgt.Key))
+	this.Assert().Contains(signature(), "cert-sha256=*"+pkgt.CertName+"=*")
+
+	this.Require().NoError(handler.ReloadCert([]*x509.Certificate{newCert}, newKey))
+	sig := signature()
+	this.Assert().Contains(sig, "cert-sha256=*"+base64.StdEncoding.EncodeToString(newCertSHA[:])+"*")
+	this.Assert().Contains(sig, "cert-url=\"https://amppackageexample.com/amppkg/cert/"+newCertName+"\"")
+}
+
+func (this *SignerSuite) TestReloadCertDuringSign() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{[]string{"https"}, "", "amppackageexample.com", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+	}}
+	handler := this.newWithOptions(urlSets, Options{Cache: NewLRUCache(10, 0)})
+	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpsURL()+fakePath) + "&sign=" + url.QueryEscape("https://amppackageexample.com"+fakePath)
+	newCert, newKey := this.newCert("amppackageexample.com")
+	newCertName := util.CertName(newCert)
+	// Rotate while the first request is mid-flight.
+	rotated := false
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		if !rotated {
+			this.Require().NoError(handler.ReloadCert([]*x509.Certificate{newCert}, newKey))
+			rotated = true
+		}
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	signature := func() string {
+		resp := this.get(this.T(), handler, target)
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		return exchange.SignatureHeaderValue
+	}
+
+	// The request that began before the rotation is signed wholly with the
+	// old cert.
+	sig := signature()
+	this.Assert().True(rotated)
+	this.Assert().Contains(sig, "cert-url=\"https://amppackageexample.com/amppkg/cert/"+pkgt.CertName+"\"")
+	this.Assert().Contains(sig, "cert-sha256=*"+pkgt.CertName+"=*")
+
+	// Subsequent requests use the new cert, rather than the exchange cached
+	// under the old one.
+	newCertSHA := sha256.Sum256(newCert.Raw)
+	sig = signature()
+	this.Assert().Contains(sig, "cert-url=\"https://amppackageexample.com/amppkg/cert/"+newCertName+"\"")
+	this.Assert().Contains(sig, "cert-sha256=*"+base64.StdEncoding.EncodeToString(newCertSHA[:])+"*")
+}
+
+func (this *SignerSuite) TestCache() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	fetches := 0
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		fetches++
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	handler := this.newWithOptions(urlSets, Options{Cache: NewLRUCache(10, 0)})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), handler, target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	first, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(1, fetches)
+
+	resp = this.get(this.T(), handler, target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	this.Assert().Equal(fmt.Sprintf(`google;v="%d"`, transformer.SupportedVersions[0].Max), resp.Header.Get("AMP-Cache-Transform"))
+	second, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(first, second)
+	this.Assert().Equal(1, fetches)
+
+	// Cached exchanges aren't served when shouldPackage is false.
+	this.shouldPackage = false
+	resp = this.get(this.T(), handler, target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	this.Assert().Equal(2, fetches)
+
+	// A different sign URL is a cache miss.
+	this.shouldPackage = true
+	resp = this.get(this.T(), handler, "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+"/amp/another.html"))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(3, fetches)
+
+	// Conditional requests bypass the cache, so that the origin may
+	// respond 304.
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		fetches++
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	resp = pkgt.GetH(this.T(), handler, target, http.Header{
+		"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion}, "If-None-Match": {`"v1"`}})
+	this.Assert().Equal(http.StatusNotModified, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(4, fetches)
+	// Nor do they populate it.
+	resp = this.get(this.T(), handler, target)
+	third, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(first, third)
+	this.Assert().Equal(4, fetches)
+
+	// The cert is part of the key, so exchanges signed with a replaced cert
+	// aren't served.
+	newCert, newKey := this.newCert(this.httpsHost())
+	this.Require().NoError(handler.ReloadCert([]*x509.Certificate{newCert}, newKey))
+	resp = this.get(this.T(), handler, target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(5, fetches)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(exchange.SignatureHeaderValue, util.CertName(newCert))
+}
+
+func TestSignerSuite(t *testing.T) {
+	suite.Run(t, new(SignerSuite))
+}
+
+// An http.ResponseWriter that discards the body, so that benchmarks measure
+// the signer's allocations rather than those of buffering its response.
+type discardResponseWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(code int)        { w.code = code }
+
+func benchmarkServeHTTP(b *testing.B, body []byte, options Options) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	origGetTransformerRequest := getTransformerRequest
+	defer func() { getTransformerRequest = origGetTransformerRequest }()
+	getTransformerRequest = func(r *rtv.RTVCache, s, u string, formats []rpb.Request_HtmlFormat) *rpb.Request {
+		return &rpb.Request{Html: string(s), DocumentUrl: u, Config: rpb.Request_NONE,
+			AllowedFormats: formats}
+	}
+	origGetRTV := getRTV
+	defer func() { getRTV = origGetRTV }()
+	getRTV = func(*rtv.RTVCache) string { return "" }
+	server := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(body)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", serverURL.Host, stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	handler, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	handler.client = server.Client()
+	handler.client.CheckRedirect = noRedirects
+	target := "/priv/doc?sign=" + url.QueryEscape(server.URL+fakePath)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest("", target, nil)
+		req.Header.Set("AMP-Cache-Transform", "google")
+		req.Header.Set("Accept", accept.SxgContentType)
+		resp := &discardResponseWriter{header: http.Header{}, code: http.StatusOK}
+		handler.ServeHTTP(resp, req, httprouter.Params{})
+		if resp.code != http.StatusOK {
+			b.Fatalf("incorrect status: %d", resp.code)
+		}
+		if resp.header.Get("Content-Type") != accept.SxgContentType {
+			b.Fatalf("incorrect content-type: %q", resp.header.Get("Content-Type"))
+		}
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	benchmarkServeHTTP(b, fakeBody, Options{})
+}
+
+func BenchmarkServeHTTPCached(b *testing.B) {
+	benchmarkServeHTTP(b, fakeBody, Options{Cache: NewLRUCache(10, 0)})
+}
+
+// A multi-megabyte document, for measuring allocations proportional to the
+// body size.
+func BenchmarkServeHTTPLarge(b *testing.B) {
+	body := []byte("<html amp><body>" + strings.Repeat("<p>They like to OPINE.</p>", 3<<20/26) + "</body></html>")
+	benchmarkServeHTTP(b, body, Options{MaxBodyBytes: 8 << 20})
+}
+
+func (this *SignerSuite) TestBOMCharset() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	// A UTF-8 BOM conflicting with the declared charset.
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=iso-8859-1")
+		resp.Write(append([]byte("\xEF\xBB\xBF"), fakeBody...))
+	}
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html; charset=iso-8859-1", resp.Header.Get("Content-Type"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{PreferBOMCharset: true}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("text/html; charset=utf-8", exchange.ResponseHeaders.Get("Content-Type"))
+
+	// A UTF-16LE BOM conflicting with the declared charset.
+	units := utf16.Encode([]rune("\uFEFF" + string(fakeBody)))
+	utf16Body := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(utf16Body[2*i:], unit)
+	}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Write(utf16Body)
+	}
+	resp = this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(utf16Body, body)
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{PreferBOMCharset: true}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	exchange, err = signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("text/html; charset=utf-8", exchange.ResponseHeaders.Get("Content-Type"))
+	payload, err := util.VerifyMIPayload(mice.Draft03Encoding, exchange.Payload, exchange.ResponseHeaders.Get("Digest"))
+	this.Require().NoError(err)
+	this.Assert().Contains(string(payload), "They like to OPINE.")
+}
+
+func TestUTF16Reader(t *testing.T) {
+	tests := []struct {
+		desc     string
+		input    string
+		expected string
+	}{
+		{"empty", "", ""},
+		{"ascii", "a\x00b\x00", "ab"},
+		{"surrogate pair", "\x3D\xD8\x00\xDE", "\U0001F600"},
+		{"unpaired high surrogate", "\x3D\xD8a\x00", "\uFFFDa"},
+		{"unpaired low surrogate", "\x00\xDEa\x00", "\uFFFDa"},
+		{"trailing surrogate", "a\x00\x3D\xD8", "a\uFFFD"},
+		{"odd byte", "a\x00b", "a\uFFFD"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			output, err := ioutil.ReadAll(&utf16Reader{r: bufio.NewReader(strings.NewReader(test.input)), order: binary.LittleEndian})
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expected, string(output))
+			}
+		})
+	}
+}
+
+func (this *SignerSuite) TestFetchUnixSocket() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	dir, err := ioutil.TempDir("", "unixsocket")
+	this.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "origin.sock")
+	listener, err := net.Listen("unix", socket)
+	this.Require().NoError(err)
+	var fetchReq *http.Request
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		fetchReq = req
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}))
+	origin.Listener.Close()
+	origin.Listener = listener
+	origin.Start()
+	defer origin.Close()
+
+	handler, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{FetchUnixSocket: socket})
+	this.Require().NoError(err)
+	this.lastRequest = nil
+	resp := this.get(this.T(), handler, "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	this.Require().NotNil(fetchReq)
+	this.Assert().Equal(fakePath, fetchReq.URL.Path)
+	this.Assert().Equal(this.httpsHost(), fetchReq.Host)
+	// The test server wasn't contacted.
+	this.Assert().Nil(this.lastRequest)
+
+	_, err = New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{FetchUnixSocket: socket, Transport: http.DefaultTransport})
+	this.Assert().EqualError(err, "FetchUnixSocket and Transport are mutually exclusive")
+}
+
+func (this *SignerSuite) TestSignatureAlg() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", "amppackageexample.com", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	newSigner := func(key crypto.PrivateKey, alg string) error {
+		_, err := New(pkgt.Certs[0], key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{SignatureAlg: alg})
+		return err
+	}
+
+	this.Assert().NoError(newSigner(pkgt.Key, ""))
+	this.Assert().NoError(newSigner(pkgt.Key, "ecdsa_secp256r1_sha256"))
+	this.Assert().EqualError(newSigner(pkgt.Key, "ecdsa_secp384r1_sha384"),
+		"signature algorithm ecdsa_secp384r1_sha384 requires a P-384 key, not P-256")
+	this.Assert().EqualError(newSigner(pkgt.Key, "rsa_pss_rsae_sha256"), `unsupported signature algorithm "rsa_pss_rsae_sha256"`)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	this.Require().NoError(err)
+	this.Assert().EqualError(newSigner(rsaKey, "ecdsa_secp256r1_sha256"),
+		"signature algorithm ecdsa_secp256r1_sha256 requires an ECDSA key, not *rsa.PrivateKey")
+
+	// ReloadCert checks the new key, too.
+	handler, err := New(pkgt.Certs[0], pkgt.Key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{SignatureAlg: "ecdsa_secp256r1_sha256"})
+	this.Require().NoError(err)
+	cert, key := this.newCert("amppackageexample.com")
+	this.Assert().NoError(handler.ReloadCert([]*x509.Certificate{cert}, key))
+}
+
+func (this *SignerSuite) TestRequireCertCoverage() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{[]string{"https"}, "", "www.amppackageexample.com", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+	}, {
+		Sign:  &util.URLPattern{[]string{"https"}, "", "amppackageexample.org", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+	}}
+	newSigner := func(host string, options Options) (*Signer, error) {
+		cert, key := this.newCert(host)
+		handler, err := New(cert, key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, options)
+		if handler != nil {
+			handler.client = this.httpsClient
+		}
+		return handler, err
+	}
+	target := func(signHost string) string {
+		return "/priv/doc?fetch=" + url.QueryEscape(this.httpsURL()+fakePath) + "&sign=" + url.QueryEscape("https://"+signHost+fakePath)
+	}
+
+	_, err := newSigner("amppackageexample.net", Options{RequireCertCoverage: true})
+	this.Assert().EqualError(err, "cert covers none of the URLSet Sign domains: www.amppackageexample.com, amppackageexample.org")
+
+	// The wildcard covers one of the domains.
+	handler, err := newSigner("*.amppackageexample.com", Options{RequireCertCoverage: true})
+	this.Require().NoError(err)
+	resp := this.get(this.T(), handler, target("www.amppackageexample.com"))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+	resp = this.get(this.T(), handler, target("amppackageexample.org"))
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+
+	// ReloadCert applies the same rule: the cert need only cover one domain.
+	cert, key := this.newCert("amppackageexample.net")
+	this.Assert().EqualError(handler.ReloadCert([]*x509.Certificate{cert}, key), "cert covers none of the URLSet Sign domains: www.amppackageexample.com, amppackageexample.org")
+	cert, key = this.newCert("amppackageexample.org")
+	this.Assert().NoError(handler.ReloadCert([]*x509.Certificate{cert}, key))
+
+	// Without the option, it's signed regardless.
+	handler, err = newSigner("*.amppackageexample.com", Options{})
+	this.Require().NoError(err)
+	resp = this.get(this.T(), handler, target("amppackageexample.org"))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+}
+
+func (this *SignerSuite) TestExtraCerts() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{[]string{"https"}, "", "www.amppackageexample.com", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+	}, {
+		Sign:  &util.URLPattern{[]string{"https"}, "", "amppackageexample.org", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+	}}
+	cert, key := this.newCert("amppackageexample.org")
+	// The extra certs' SANs overlap each other's and the cert's.
+	both, bothKey := this.newCert("www.amppackageexample.com", "amppackageexample.org")
+	wildcard, wildcardKey := this.newCert("*.amppackageexample.com")
+	www, wwwKey := this.newCert("www.amppackageexample.com")
+	newSigner := func(extraCerts []SigningCert) *Signer {
+		handler, err := New(cert, key, urlSets, &rtv.RTVCache{}, IgnoreRequest(func() bool { return true }), nil, true, 0, 0, Options{RequireCertCoverage: true, ExtraCerts: extraCerts})
+		this.Require().NoError(err)
+		handler.client = this.httpsClient
+		return handler
+	}
+	// Returns the cert-url of the signature for the given sign host.
+	certURL := func(handler *Signer, signHost string) string {
+		resp := this.get(this.T(), handler, "/priv/doc?fetch="+url.QueryEscape(this.httpsURL()+fakePath)+"&sign="+url.QueryEscape("https://"+signHost+fakePath))
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		return exchange.SignatureHeaderValue
+	}
+	signedWith := func(signHost string, cert *x509.Certificate) string {
+		return "cert-url=\"https://" + signHost + "/amppkg/cert/" + util.CertName(cert) + "\""
+	}
+
+	handler := newSigner([]SigningCert{{both, bothKey, 1}, {wildcard, wildcardKey, 2}, {www, wwwKey, -1}})
+	// Of the three certs covering www, the highest priority one signs.
+	this.Assert().Contains(certURL(handler, "www.amppackageexample.com"), signedWith("www.amppackageexample.com", wildcard))
+	// The extra cert outranks the cert passed to New.
+	this.Assert().Contains(certURL(handler, "amppackageexample.org"), signedWith("amppackageexample.org", both))
+
+	// Ties go to the cert passed to New, then to the earliest extra cert.
+	handler = newSigner([]SigningCert{{both, bothKey, 0}, {www, wwwKey, 0}})
+	this.Assert().Contains(certURL(handler, "amppackageexample.org"), signedWith("amppackageexample.org", cert))
+	this.Assert().Contains(certURL(handler, "www.amppackageexample.com"), signedWith("www.amppackageexample.com", both))
+
+	// Extra certs remain in use after ReloadCert, and count toward its
+	// coverage check.
+	newCert, newKey := this.newCert("amppackageexample.net")
+	this.Require().NoError(handler.ReloadCert([]*x509.Certificate{newCert}, newKey))
+	this.Assert().Contains(certURL(handler, "amppackageexample.org"), signedWith("amppackageexample.org", both))
+
+	// An extra cert's key must match it.
+	_, err := New(cert, key, urlSets, &rtv.RTVCache{}, nil, nil, true, 0, 0, Options{ExtraCerts: []SigningCert{{both, wwwKey, 1}}})
+	this.Assert().EqualError(err, "extra cert 0: key doesn't match cert")
+}
+
+func (this *SignerSuite) TestAcceptXHTML() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	body := []byte(`<?xml version="1.0" encoding="utf-8"?>` + "\n" +
+		`<html amp="" xmlns="http://www.w3.org/1999/xhtml"><head></head><body><p>Hello, XHTML.</p></body></html>`)
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "application/xhtml+xml; charset=utf-8")
+		resp.Write(body)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/xhtml+xml; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{AcceptXHTML: true}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("text/html; charset=utf-8", exchange.ResponseHeaders.Get("Content-Type"))
+	payload, err := util.VerifyMIPayload(mice.Draft03Encoding, exchange.Payload, exchange.ResponseHeaders.Get("Digest"))
+	this.Require().NoError(err)
+	this.Assert().Contains(string(payload), "Hello, XHTML.")
+
+	// Non-AMP XHTML is still proxied unsigned, with its original Content-Type.
+	nonAMP := bytes.Replace(body, []byte(`amp="" `), nil, 1)
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "application/xhtml+xml; charset=utf-8")
+		resp.Write(nonAMP)
+	}
+	resp = this.get(this.T(), this.newWithOptions(urlSets, Options{AcceptXHTML: true}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/xhtml+xml; charset=utf-8", resp.Header.Get("Content-Type"))
+	proxied, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(nonAMP, proxied)
+}
+
+func (this *SignerSuite) TestURLSetRateLimit() {
+	urlSets := []util.URLSet{{
+		Sign:      &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		RateLimit: 1, RateLimitBurst: 2,
+	}, {
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/other/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	handler := this.new(urlSets)
+	now := time.Now()
+	handler.nowFunc = func() time.Time { return now }
+	limited := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	unlimited := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+"/other/doc.html")
+
+	for i := 0; i < 2; i++ {
+		resp := this.get(this.T(), handler, limited)
+		this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	}
+	this.lastRequest = nil
+	resp := this.get(this.T(), handler, limited)
+	this.Assert().Equal(http.StatusTooManyRequests, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+	this.Assert().Nil(this.lastRequest, "document was fetched")
+
+	// The other URLSet is unaffected.
+	for i := 0; i < 5; i++ {
+		resp = this.get(this.T(), handler, unlimited)
+		this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	}
+
+	// The limit recovers over time.
+	now = now.Add(time.Second)
+	resp = this.get(this.T(), handler, limited)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 }
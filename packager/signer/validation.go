@@ -2,15 +2,22 @@
 package signer
 
 import (
+	"bytes"
+	"fmt"
 	"mime"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ampproject/amppackager/packager/util"
 	"github.com/pkg/errors"
 	"github.com/pquerna/cachecontrol"
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 // Converts an URL string into an URL object with an unambiguous interpretation.
@@ -39,6 +46,16 @@ func parseURL(rawURL string, name string) (*url.URL, *util.HTTPError) {
 	return ret, nil
 }
 
+// Returns rawURL with an http scheme replaced by https. Other URLs are
+// returned unchanged.
+func upgradeScheme(rawURL string) string {
+	const http, https = "http://", "https://"
+	if len(rawURL) >= len(http) && strings.EqualFold(rawURL[:len(http)], http) {
+		return https + rawURL[len(http):]
+	}
+	return rawURL
+}
+
 // Returns true iff the given pattern matches the entire test string.
 func regexpFullMatch(pattern string, test string) bool {
 	// This is how regexp/exec_test.go turns a partial pattern into a full pattern.
@@ -47,6 +64,9 @@ func regexpFullMatch(pattern string, test string) bool {
 	return matches
 }
 
+// Returned by urlMatches when the URL's path doesn't match PathRE.
+var errPathREMismatch = errors.New("PathRE doesn't match")
+
 // Implements the URL-matching common to both fetchURLMatches and signURLMatches.
 func urlMatches(url *url.URL, pattern util.URLPattern) error {
 	if url.Opaque != "" {
@@ -66,7 +86,7 @@ func urlMatches(url *url.URL, pattern util.URLPattern) error {
 	// PathRE matches the path component of the URL, including the
 	// beginning slash.
 	if !regexpFullMatch(*pattern.PathRE, url.EscapedPath()) {
-		return errors.New("PathRE doesn't match")
+		return errPathREMismatch
 	}
 	// If any of PathExcludeRE matches, the URL does not match.
 	for _, re := range pattern.PathExcludeRE {
@@ -114,7 +134,7 @@ func fetchURLMatches(url *url.URL, pattern *util.URLPattern) error {
 		return errors.New("Scheme doesn't match")
 	}
 	// The fetch block may specify either Domain or DomainRE.
-	if pattern.Domain != "" && url.Host != pattern.Domain {
+	if pattern.Domain != "" && !util.DomainMatches(pattern.Domain, url.Host) {
 		return errors.New("Domain doesn't match")
 	}
 	if pattern.DomainRE != "" && !regexpFullMatch(pattern.DomainRE, url.Host) {
@@ -133,20 +153,58 @@ func signURLMatches(url *url.URL, pattern *util.URLPattern) error {
 	if url.Scheme != "https" {
 		return errors.New("Scheme doesn't match")
 	}
-	// The sign block may only specify Domain. DomainRE would only be
-	// useful for wildcard SXG certificates. Please open an issue if you
-	// have a valid wildcard SXG certificate and a legitimate need for
-	// this. This should be implemented with some thought into how to
-	// ensure that the sign URL matches the fetch URL.
-	if url.Host != pattern.Domain {
+	// The sign block may only specify Domain, which may be a wildcard
+	// (for wildcard SXG certificates) only if the fetch URL is the sign
+	// URL (see util.ReadConfig). DomainRE would be harder to match against
+	// certs.
+	if !util.DomainMatches(pattern.Domain, url.Host) {
 		return errors.New("Domain doesn't match")
 	}
 	return urlMatches(url, *pattern)
 }
 
+// Returns the path and query of u, normalized per
+// https://tools.ietf.org/html/rfc3986#section-6.2.2 so that equivalent URLs
+// (e.g. /a/./%62 and /a/b) compare equal: percent-encodings are made canonical
+// and dot-segments are removed. Encoded slashes remain distinct from literal
+// ones, as servers may treat them differently.
+func normalizedRequestURI(u *url.URL) string {
+	segments := strings.Split(u.EscapedPath(), "/")
+	var normalized []string
+	for i, segment := range segments {
+		if unescaped, err := url.PathUnescape(segment); err == nil {
+			segment = url.PathEscape(unescaped)
+		}
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+		case "..":
+			// Preserve the empty segment before the leading slash.
+			if len(normalized) > 1 {
+				normalized = normalized[:len(normalized)-1]
+			}
+		default:
+			normalized = append(normalized, segment)
+			continue
+		}
+		if last {
+			// A trailing dot-segment leaves a trailing slash.
+			normalized = append(normalized, "")
+		}
+	}
+	ret := strings.Join(normalized, "/")
+	if !strings.HasPrefix(ret, "/") {
+		ret = "/" + ret
+	}
+	if u.ForceQuery || u.RawQuery != "" {
+		ret += "?" + u.RawQuery
+	}
+	return ret
+}
+
 // True iff the given fetchURL and signURL match the given set (as specified by
 // an [[URLSet]] block in the config file), and, if SamePath is true (default),
-// fetchURL and signURL match each other.
+// fetchURL and signURL match each other, after normalization.
 func urlsMatch(fetchURL *url.URL, signURL *url.URL, set util.URLSet) error {
 	if err := fetchURLMatches(fetchURL, set.Fetch); err != nil {
 		return errors.Wrap(err, "fetch URL")
@@ -154,7 +212,7 @@ func urlsMatch(fetchURL *url.URL, signURL *url.URL, set util.URLSet) error {
 	if err := signURLMatches(signURL, set.Sign); err != nil {
 		return errors.Wrap(err, "sign URL")
 	}
-	theyMatch := set.Fetch == nil || !*set.Fetch.SamePath || fetchURL.RequestURI() == signURL.RequestURI()
+	theyMatch := set.Fetch == nil || !*set.Fetch.SamePath || normalizedRequestURI(fetchURL) == normalizedRequestURI(signURL)
 	if !theyMatch {
 		return errors.New("fetch and sign paths don't match")
 	}
@@ -163,34 +221,89 @@ func urlsMatch(fetchURL *url.URL, signURL *url.URL, set util.URLSet) error {
 
 // If the given fetch and sign URLs are valid, and match at least one of the
 // urlSets (as specified by the [[URLSet]] blocks in the config file), then
-// this returns the parsed URLs as well as a bool containing the value of
-// ErrorOnStatefulHeaders for the first matching URLSet. Otherwise, returns an
-// error.
-func parseURLs(fetch string, sign string, urlSets []util.URLSet) (*url.URL, *url.URL, bool, *util.HTTPError) {
+// this returns the parsed URLs as well as the first matching URLSet.
+// Otherwise, returns an error, listing why each URLSet didn't match. The error
+// is a 404 if notFoundOnSignPathMismatch is true and some URLSet matched the
+// sign URL's domain but not its path, else a 400.
+func parseURLs(fetch string, sign string, urlSets []util.URLSet, notFoundOnSignPathMismatch bool) (*url.URL, *url.URL, *util.URLSet, *util.HTTPError) {
 	var fetchURL *url.URL
 	var err *util.HTTPError
 	if fetch != "" {
 		fetchURL, err = parseURL(fetch, "fetch")
 		if err != nil {
 			// TODO(twifkak): Use errors.Wrap() after changing return types to error.
-			return nil, nil, false, err
+			return nil, nil, nil, err
 		}
 	}
 	signURL, err := parseURL(sign, "sign")
 	if err != nil {
 		// TODO(twifkak): Use errors.Wrap() after changing return types to error.
-		return nil, nil, false, err
+		return nil, nil, nil, err
 	}
-	for _, set := range urlSets {
-		err := urlsMatch(fetchURL, signURL, set)
+	var reasons []string
+	signPathMismatch := false
+	for i := range urlSets {
+		err := urlsMatch(fetchURL, signURL, urlSets[i])
 		if err == nil {
 			if fetchURL == nil {
 				fetchURL = signURL
 			}
-			return fetchURL, signURL, set.Sign.ErrorOnStatefulHeaders, nil
+			return fetchURL, signURL, &urlSets[i], nil
+		}
+		reasons = append(reasons, fmt.Sprintf("URLSet[%d]: %s", i, err))
+		if errors.Cause(signURLMatches(signURL, urlSets[i].Sign)) == errPathREMismatch {
+			signPathMismatch = true
 		}
 	}
-	return nil, nil, false, util.NewHTTPError(http.StatusBadRequest, "fetch/sign URLs do not match config")
+	status := http.StatusBadRequest
+	if notFoundOnSignPathMismatch && signPathMismatch {
+		status = http.StatusNotFound
+	}
+	return nil, nil, nil, util.NewHTTPError(status, "fetch/sign URLs do not match config: ", strings.Join(reasons, "; "))
+}
+
+// Returns how long the upstream intends a shared cache (such as an AMP Cache)
+// to consider the response fresh, per its s-maxage or else max-age
+// Cache-Control directive. Returns false if it specifies neither.
+func upstreamMaxAge(header http.Header) (time.Duration, bool) {
+	value := GetJoined(header, "Cache-Control")
+	if _, err := cacheobject.ParseResponseCacheControl(value); err != nil {
+		return 0, false
+	}
+	if sMaxAge, ok := minDeltaSeconds(value, "s-maxage"); ok {
+		return sMaxAge, true
+	}
+	return minDeltaSeconds(value, "max-age")
+}
+
+// Returns the value of the named delta-seconds directive (e.g. max-age) in the
+// given Cache-Control value. Duplicate directives are invalid, per
+// https://tools.ietf.org/html/rfc7234#section-4.2.1, so the smallest is
+// returned, as the most conservative. Values are capped at
+// maxSignatureExpiry, as no exchange may outlive that anyway.
+func minDeltaSeconds(value, name string) (time.Duration, bool) {
+	var ret time.Duration
+	found := false
+	for _, directive := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+		if len(parts) != 2 || !strings.EqualFold(strings.TrimSpace(parts[0]), name) {
+			continue
+		}
+		seconds, err := strconv.ParseUint(strings.Trim(strings.TrimSpace(parts[1]), `"`), 10, 64)
+		if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+			// Too large to represent, so capped below.
+		} else if err != nil {
+			continue
+		}
+		delta := maxSignatureExpiry
+		if seconds < uint64(maxSignatureExpiry/time.Second) {
+			delta = time.Duration(seconds) * time.Second
+		}
+		if !found || delta < ret {
+			ret, found = delta, true
+		}
+	}
+	return ret, found
 }
 
 // Given a request/response pair for the fetch from the packager to the backend
@@ -204,6 +317,14 @@ func validateFetch(req *http.Request, resp *http.Response) error {
 	// Note: If the cachecontrol library ever adds support for no-cache
 	// with field name arguments, then instruct the signer to remove these
 	// headers, per https://github.com/WICG/webpackage/pull/339.
+	//
+	// The library reads only the first Cache-Control header, so join them
+	// all, in order that a no-store or private in any of them makes the
+	// response non-cacheable, even alongside public. This also leaves the
+	// exchange with a single, equivalent header.
+	if values := resp.Header["Cache-Control"]; len(values) > 1 {
+		resp.Header.Set("Cache-Control", strings.Join(values, ", "))
+	}
 	nonCachableReasons, _, err := cachecontrol.CachableResponse(req, resp, cachecontrol.Options{PrivateCache: false})
 	if err != nil {
 		return errors.Wrap(err, "Parsing cache headers")
@@ -214,7 +335,8 @@ func validateFetch(req *http.Request, resp *http.Response) error {
 
 	// Validate that no Content-Encoding is specified. Otherwise, it was
 	// encoded as something that http.Client was unable to decode (e.g. br).
-	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+	// "identity" is equivalent to no encoding.
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
 		return errors.Errorf("Invalid Content-Encoding: %s", encoding)
 	}
 
@@ -237,3 +359,142 @@ func validateFetch(req *http.Request, resp *http.Response) error {
 	}
 	return nil
 }
+
+// Returns true iff the given document contains a <meta name=viewport> before
+// the start of its <body>. AMP requires a viewport meta, so its absence is a
+// sign of likely-invalid AMP.
+func hasViewportMeta(body []byte) bool {
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.DataAtom {
+			case atom.Body:
+				return false
+			case atom.Meta:
+				for _, attr := range token.Attr {
+					if attr.Namespace == "" && attr.Key == "name" && strings.EqualFold(strings.TrimSpace(attr.Val), "viewport") {
+						return true
+					}
+				}
+			}
+		}
+	}
+}
+
+// Returns true iff the given document begins with <!doctype html> (ignoring
+// leading whitespace and comments), as AMP requires. Legacy doctypes, such as
+// HTML 4.01's, don't count.
+func hasHTMLDoctype(body []byte) bool {
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch tokenizer.Next() {
+		case html.CommentToken:
+			continue
+		case html.TextToken:
+			if len(bytes.TrimSpace(tokenizer.Text())) == 0 {
+				continue
+			}
+			return false
+		case html.DoctypeToken:
+			return strings.EqualFold(tokenizer.Token().Data, "html")
+		default:
+			return false
+		}
+	}
+}
+
+// Matches data: URIs, as they appear in attribute values and CSS.
+var dataURIRE = regexp.MustCompile(`(?i)\bdata:[^\s'"()]+`)
+
+// Returns the total length of the data: URIs in the given document's
+// attribute values and <style> elements (e.g. base64 images), which bloat the
+// signed payload.
+func inlineDataBytes(body []byte) int {
+	total := 0
+	count := func(s string) {
+		for _, uri := range dataURIRE.FindAllString(s, -1) {
+			total += len(uri)
+		}
+	}
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	inStyle := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return total
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			inStyle = token.DataAtom == atom.Style
+			for _, attr := range token.Attr {
+				count(attr.Val)
+			}
+		case html.TextToken:
+			if inStyle {
+				count(string(tokenizer.Text()))
+			}
+		default:
+			inStyle = false
+		}
+	}
+}
+
+// Returns the src of the first AMP extension script (i.e. with a
+// custom-element or custom-template attribute) in the given document that is
+// among denied, or "" if none are.
+func deniedExtensionSrc(body []byte, denied []string) string {
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.DataAtom != atom.Script {
+				continue
+			}
+			isExtension := false
+			var src string
+			for _, attr := range token.Attr {
+				switch attr.Key {
+				case "custom-element", "custom-template":
+					isExtension = true
+				case "src":
+					src = strings.TrimSpace(attr.Val)
+				}
+			}
+			if !isExtension {
+				continue
+			}
+			for _, d := range denied {
+				if src == d {
+					return src
+				}
+			}
+		}
+	}
+}
+
+// Request headers on which the signed response may vary: the payload is
+// decoded before signing, and the signer itself handles Accept and
+// AMP-Cache-Transform.
+var supportedVaryHeaders = map[string]bool{
+	"Accept":              true,
+	"Accept-Encoding":     true,
+	"Amp-Cache-Transform": true,
+}
+
+// Returns the first field name in the given response's Vary header that the
+// signed exchange can't represent (e.g. Cookie or *), or "" if there are none.
+func unsupportedVary(header http.Header) string {
+	for _, field := range strings.Split(GetJoined(header, "Vary"), ",") {
+		field = strings.TrimSpace(field)
+		if field != "" && !supportedVaryHeaders[http.CanonicalHeaderKey(field)] {
+			return field
+		}
+	}
+	return ""
+}
@@ -1,6 +1,7 @@
 package signer
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -86,6 +87,30 @@ func TestSignURLMatches(t *testing.T) {
 	assert.EqualError(t, signURLMatches(urlOrDie("https://wrongexample.com/"),
 		&util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}),
 		"Domain doesn't match")
+
+	// A wildcard Domain matches any single label in its place.
+	wildcard := &util.URLPattern{Domain: "*.example.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}
+	assert.NoError(t, signURLMatches(urlOrDie("https://a.example.com/"), wildcard))
+	assert.NoError(t, signURLMatches(urlOrDie("https://b.example.com/"), wildcard))
+	assert.EqualError(t, signURLMatches(urlOrDie("https://example.com/"), wildcard), "Domain doesn't match")
+	assert.EqualError(t, signURLMatches(urlOrDie("https://example.com.evil.com/"), wildcard), "Domain doesn't match")
+	assert.EqualError(t, signURLMatches(urlOrDie("https://a.b.example.com/"), wildcard), "Domain doesn't match")
+
+	// QueryRE can require a marker param, such as amp=1.
+	ampQuery := stringPtr("(.*&)?amp=1(&.*)?")
+	assert.NoError(t, signURLMatches(urlOrDie("https://example.com/?amp=1"),
+		&util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: ampQuery, MaxLength: 2000}))
+	assert.NoError(t, signURLMatches(urlOrDie("https://example.com/?a=b&amp=1"),
+		&util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: ampQuery, MaxLength: 2000}))
+	assert.EqualError(t, signURLMatches(urlOrDie("https://example.com/"),
+		&util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: ampQuery, MaxLength: 2000}),
+		"QueryRE doesn't match")
+	assert.EqualError(t, signURLMatches(urlOrDie("https://example.com/?amp=10"),
+		&util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: ampQuery, MaxLength: 2000}),
+		"QueryRE doesn't match")
+	assert.EqualError(t, signURLMatches(urlOrDie("https://example.com/?noamp=1"),
+		&util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: ampQuery, MaxLength: 2000}),
+		"QueryRE doesn't match")
 }
 
 func TestURLsMatch(t *testing.T) {
@@ -108,37 +133,88 @@ func TestURLsMatch(t *testing.T) {
 	assert.EqualError(t, urlsMatch(urlOrDie("http://fetch.com/"), urlOrDie("https://sign.com/other"), config),
 		"fetch and sign paths don't match")
 
+	// Equivalent paths match after normalization.
+	assert.NoError(t, urlsMatch(urlOrDie("http://fetch.com/a/./b/../%7ec?d"), urlOrDie("https://sign.com/a/~c?d"), config))
+	assert.EqualError(t, urlsMatch(urlOrDie("http://fetch.com/a%2Fb"), urlOrDie("https://sign.com/a/b"), config),
+		"fetch and sign paths don't match")
+	assert.EqualError(t, urlsMatch(urlOrDie("http://fetch.com/a?b"), urlOrDie("https://sign.com/a?c"), config),
+		"fetch and sign paths don't match")
+
 	*config.Fetch.SamePath = false
 	assert.NoError(t, urlsMatch(urlOrDie("http://fetch.com/"), urlOrDie("https://sign.com/other"), config))
 }
 
+func TestNormalizedRequestURI(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"https://example.com", "/"},
+		{"https://example.com/", "/"},
+		{"https://example.com/a/b", "/a/b"},
+		{"https://example.com/a/./b", "/a/b"},
+		{"https://example.com/a/b/.", "/a/b/"},
+		{"https://example.com/a/b/..", "/a/"},
+		{"https://example.com/a/../../b", "/b"},
+		{"https://example.com/a//b", "/a//b"},
+		{"https://example.com/%61%2fb%7E", "/a%2Fb~"},
+		{"https://example.com/a%20b", "/a%20b"},
+		{"https://example.com/a?", "/a?"},
+		{"https://example.com/a?b=%2F", "/a?b=%2F"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, normalizedRequestURI(urlOrDie(test.url)), test.url)
+	}
+}
+
 func TestParseURLs(t *testing.T) {
-	if _, _, _, err := parseURLs("a%-", "b", []util.URLSet{}); assert.NotNil(t, err) {
+	if _, _, _, err := parseURLs("a%-", "b", []util.URLSet{}, false); assert.NotNil(t, err) {
 		assert.Contains(t, err.Error(), "fetch URL")
 	}
-	if _, _, _, err := parseURLs("http://a", "b%-", []util.URLSet{}); assert.NotNil(t, err) {
+	if _, _, _, err := parseURLs("http://a", "b%-", []util.URLSet{}, false); assert.NotNil(t, err) {
 		assert.Contains(t, err.Error(), "sign URL")
 	}
 
-	fetch, sign, errorOnStatefulHeaders, err := parseURLs("", "https://example.com/", []util.URLSet{
+	fetch, sign, urlSet, err := parseURLs("", "https://example.com/", []util.URLSet{
 		{Sign: &util.URLPattern{Domain: "wrongexample.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}},
 		{Sign: &util.URLPattern{Domain: "example.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(".*"), MaxLength: 2000}},
 		{Sign: &util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000, ErrorOnStatefulHeaders: true}},
 		{Sign: &util.URLPattern{Domain: "badexample.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}},
-	})
+	}, false)
 	if assert.Nil(t, err) {
 		assert.Equal(t, "https://example.com/", fetch.String())
 		assert.Equal(t, "https://example.com/", sign.String())
-		assert.True(t, errorOnStatefulHeaders)
+		assert.True(t, urlSet.Sign.ErrorOnStatefulHeaders)
 	}
 
-	_, _, _, err = parseURLs("", "https://example.com/", []util.URLSet{
+	urlSets := []util.URLSet{
 		{Sign: &util.URLPattern{Domain: "wrongexample.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}},
 		{Sign: &util.URLPattern{Domain: "example.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(".*"), MaxLength: 2000}},
 		{Sign: &util.URLPattern{Domain: "badexample.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}},
-	})
+	}
+	_, _, _, err = parseURLs("", "https://example.com/", urlSets, false)
+	if assert.NotNil(t, err) {
+		assert.EqualError(t, err, "fetch/sign URLs do not match config: "+
+			"URLSet[0]: sign URL: Domain doesn't match; URLSet[1]: sign URL: PathRE doesn't match; URLSet[2]: sign URL: Domain doesn't match")
+		resp := httptest.NewRecorder()
+		err.LogAndRespond(resp)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	}
+
+	// The domain matches URLSet[1] but the path doesn't.
+	_, _, _, err = parseURLs("", "https://example.com/", urlSets, true)
 	if assert.NotNil(t, err) {
-		assert.EqualError(t, err, "fetch/sign URLs do not match config")
+		resp := httptest.NewRecorder()
+		err.LogAndRespond(resp)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+		assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+	}
+	// No domain matches.
+	_, _, _, err = parseURLs("", "https://other.com/", urlSets, true)
+	if assert.NotNil(t, err) {
+		resp := httptest.NewRecorder()
+		err.LogAndRespond(resp)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
 	}
 }
 
@@ -160,6 +236,17 @@ func TestValidateFetch(t *testing.T) {
 		assert.Contains(t, err.Error(), "Non-cacheable response")
 	}
 
+	// no-store and private win over public, even in a separate header.
+	resp.Header["Cache-Control"] = []string{"public", "no-store"}
+	if err := validateFetch(req, &resp); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Non-cacheable response")
+	}
+	assert.Equal(t, []string{"public, no-store"}, resp.Header["Cache-Control"])
+	resp.Header.Set("Cache-Control", "public, private")
+	if err := validateFetch(req, &resp); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Non-cacheable response")
+	}
+
 	resp.Header.Set("Cache-Control", "public")
 
 	resp.Header.Set("Content-Type", "text//html")
@@ -208,4 +295,65 @@ func TestValidateFetch(t *testing.T) {
 
 	resp.Header.Set("Content-Type", `text/html; charset="utf-8"`)
 	assert.NoError(t, validateFetch(req, &resp))
+
+	resp.Header.Set("Content-Encoding", "identity")
+	assert.NoError(t, validateFetch(req, &resp))
+
+	resp.Header.Set("Content-Encoding", "br")
+	if err := validateFetch(req, &resp); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Invalid Content-Encoding")
+	}
+}
+
+func TestUnsupportedVary(t *testing.T) {
+	assert.Equal(t, "", unsupportedVary(http.Header{}))
+	assert.Equal(t, "", unsupportedVary(http.Header{"Vary": {"Accept-Encoding, amp-cache-transform", "Accept"}}))
+	assert.Equal(t, "Cookie", unsupportedVary(http.Header{"Vary": {"Accept-Encoding, Cookie"}}))
+	assert.Equal(t, "*", unsupportedVary(http.Header{"Vary": {"*"}}))
+}
+
+func TestInlineDataBytes(t *testing.T) {
+	assert.Equal(t, 0, inlineDataBytes([]byte(`<html amp><img src="https://example.com/a.png" alt="metadata:none"></html>`)))
+	assert.Equal(t, len("data:image/png;base64,iVBORw0KGgo="), inlineDataBytes([]byte(
+		`<html amp><amp-img src="data:image/png;base64,iVBORw0KGgo="></amp-img><p>data:text/plain,hi</p></html>`)))
+	assert.Equal(t, 2*len("data:image/gif;base64,R0lGOD=="), inlineDataBytes([]byte(
+		`<html amp><style amp-custom>.a{background:url('data:image/gif;base64,R0lGOD==')}</style>`+
+			`<div style="background:url(data:image/gif;base64,R0lGOD==)"></div></html>`)))
+}
+
+func TestDeniedExtensionSrc(t *testing.T) {
+	const bind = "https://cdn.ampproject.org/v0/amp-bind-0.1.js"
+	denied := []string{bind}
+	assert.Equal(t, bind, deniedExtensionSrc([]byte(`<html amp><script async custom-element=amp-bind src="`+bind+`"></script>`), denied))
+	assert.Equal(t, bind, deniedExtensionSrc([]byte(`<html amp><script custom-template=amp-bind src=" `+bind+` "></script>`), denied))
+	assert.Equal(t, "", deniedExtensionSrc([]byte(`<html amp><script async src="`+bind+`"></script>`), denied))
+	assert.Equal(t, "", deniedExtensionSrc([]byte(`<html amp><script async custom-element=amp-bind src="https://cdn.ampproject.org/v0/amp-bind-latest.js"></script>`), denied))
+	assert.Equal(t, "", deniedExtensionSrc([]byte(`<html amp><link rel=preload as=script href="`+bind+`">`), denied))
+}
+
+func TestHasHTMLDoctype(t *testing.T) {
+	assert.True(t, hasHTMLDoctype([]byte("<!doctype html><html amp>")))
+	assert.True(t, hasHTMLDoctype([]byte("\n <!-- hi --> <!DOCTYPE HTML>\n<html amp>")))
+	assert.False(t, hasHTMLDoctype([]byte("<html amp>")))
+	assert.False(t, hasHTMLDoctype([]byte("")))
+	assert.False(t, hasHTMLDoctype([]byte("hello<!doctype html><html amp>")))
+	assert.False(t, hasHTMLDoctype([]byte(`<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 4.01//EN" "http://www.w3.org/TR/html4/strict.dtd"><html amp>`)))
+}
+
+func TestUpstreamMaxAge(t *testing.T) {
+	maxAge := func(values ...string) string {
+		d, ok := upstreamMaxAge(http.Header{"Cache-Control": values})
+		return fmt.Sprint(d, ok)
+	}
+	assert.Equal(t, "0s false", maxAge())
+	assert.Equal(t, "0s false", maxAge("public"))
+	assert.Equal(t, "10m0s true", maxAge("public, max-age=600"))
+	assert.Equal(t, "1m0s true", maxAge("max-age=600, s-maxage=60"))
+	assert.Equal(t, "1m0s true", maxAge("public, MAX-AGE=\"60\""))
+	// Duplicates use the smallest, in any order or header.
+	assert.Equal(t, "0s true", maxAge("max-age=60, max-age=0"))
+	assert.Equal(t, "0s true", maxAge("max-age=0, max-age=60"))
+	assert.Equal(t, "1m0s true", maxAge("max-age=600", "max-age=60"))
+	assert.Equal(t, "168h0m0s true", maxAge("max-age=99999999999999999999"))
+	assert.Equal(t, "0s false", maxAge("max-age=ph'nglui"))
 }
@@ -0,0 +1,31 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	rpb "github.com/ampproject/amppackager/transformer/request"
+)
+
+// Validator checks documents for AMP validity before they are signed, e.g. by
+// running them through the AMP validator
+// (https://github.com/ampproject/amphtml/tree/master/validator). This is
+// stronger than the Signer's own check, which only requires the AMP
+// attribute. Implementations must be safe for concurrent use.
+type Validator interface {
+	// Returns nil if html (the document as fetched, before any
+	// transforms) is valid in the given format, else an error describing
+	// why not.
+	Validate(html []byte, format rpb.Request_HtmlFormat) error
+}
@@ -18,6 +18,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 
 	"github.com/pelletier/go-toml"
 	"github.com/pkg/errors"
@@ -30,11 +31,126 @@ type Config struct {
 	KeyFile   string // Just for the first cert, obviously.
 	OCSPCache string
 	URLSet    []URLSet
+
+	// Certs to sign with besides CertFile, for the URLSet Sign domains they
+	// cover. See amppkg.example.toml for details.
+	ExtraCert []ExtraCert
+
+	// If non-empty, only clients within these IPs/CIDR ranges may fetch the
+	// cert and validity endpoints.
+	CacheIPAllowlist []string
+
+	// If non-empty, cert URLs in signatures carry this version as a query
+	// param, and the cert endpoint requires it.
+	CertURLVersion string
+
+	// If non-empty, signing is disabled while a file exists at this path.
+	KillSwitchFile string
+
+	// How often to refresh the AMP runtime version, whether /healthz
+	// tolerates a failed refresh, and how stale it may get before a
+	// synchronous refresh. See amppkg.example.toml for details.
+	RTVRefreshIntervalSeconds int
+	RTVStaleWhileError        bool
+	RTVMaxAgeSeconds          int
+	// If non-empty, the AMP runtime version to always use.
+	PinnedRTV string
+	// Whether to start when the AMP runtime version can't be fetched, and
+	// how to handle requests until it is.
+	RTVAllowColdStart    bool
+	RTVUnavailable       string
+	RTVWaitTimeoutMillis int
+	FallbackRTV          string
+
+	// Optional signer behavior. See amppkg.example.toml for details.
+	RecordSize                   int
+	SignatureExpirySeconds       int
+	WarnOnMissingViewport        bool
+	ErrorOnMissingViewport       bool
+	ErrorOnGETWithBody           bool
+	DebugSignedBytesToken        string
+	DebugOriginalDigest          bool
+	ErrorOnUnsatisfiableAccept   bool
+	ErrorOnNonNosniff            bool
+	ErrorOnUnsupportedVary       bool
+	ExcludeRuntimePreload        bool
+	SXGVersions                  []string
+	SXGCacheMaxEntries           int
+	SXGCacheMaxBytes             int
+	ErrorOnContentLengthMismatch bool
+	PreloadDataFetches           bool
+	ErrorOnMissingDoctype        bool
+	FetchRetries                 int
+	FetchRetryBackoffMillis      int
+	MergeUpstreamLinkHeaders     bool
+	FetchTimeoutMillis           int
+	DefaultTransformVersion      int64
+	MaxDecompressedBodyBytes     int
+	TransformIdentities          []string
+	MaxBodyBytes                 int64
+	ProxyOversizedBody           bool
+	NormalizeCharset             bool
+	NotFoundOnExtraPathSegments  bool
+	ForwardedHeaders             []string
+	TransformerHeaders           []string
+	DuplicateParams              string
+	MaxTransformedBodyBytes      int
+	RequireSCT                   bool
+	OverrideUpstreamCSP          bool
+	MaxInlineDataBytes           int
+	DebugEnabled                 bool
+	HonorDeadlineHeader          bool
+	NotFoundOnSignPathMismatch   bool
+	ErrorOnRefreshHeader         bool
+	MaxPreloads                  int
+	ExtendedPreloads             bool
+	VerifyMIPayload              bool
+	FetchUserAgent               string
+	PreloadMedia                 bool
+	SignPostedDocuments          bool
+	UpgradeSignURLScheme         bool
+	AllowedFormats               []string
+	CanonicalLinkHeader          bool
+	LastModified                 bool
+	MaxConcurrentFetches         int
+	QueueFetches                 bool
+	ProxyOnTransientSigningError bool
+	PreloadHeroSrcset            bool
+	PreferBOMCharset             bool
+	FetchUnixSocket              string
+	SignatureAlg                 string
+	ErrorOnAmbiguousSignURL      bool
+	DeniedExtensionSrcs          []string
+	AcceptXHTML                  bool
+	MinBodyBytes                 int
+	ValidityURLPath              string
+	LogNoPreloads                bool
+	SecurityHeaders              bool
+	HSTS                         string
+}
+
+type ExtraCert struct {
+	CertFile  string // This must be the full certificate chain.
+	KeyFile   string
+	OCSPCache string // This must differ from that of every other cert.
+	// Of the certs covering a sign URL host, the one with the highest
+	// Priority signs it. CertFile has priority 0.
+	Priority int
 }
 
 type URLSet struct {
-	Fetch *URLPattern
-	Sign  *URLPattern
+	Fetch      *URLPattern
+	Sign       *URLPattern
+	RecordSize int
+	// If positive, the max rate of requests to sign URLs matching this
+	// URLSet, per second, with bursts of up to RateLimitBurst (default: the
+	// rate, rounded up).
+	RateLimit      float64
+	RateLimitBurst int
+	// If set, the network ("tcp4" or "tcp6") over which documents matching
+	// this URLSet are fetched, e.g. to force one address family in a
+	// dual-stack environment. Otherwise, either is used.
+	FetchNetwork string
 }
 
 type URLPattern struct {
@@ -79,6 +195,51 @@ func validateURLPattern(pattern *URLPattern) error {
 	return nil
 }
 
+// The range of MICE record sizes that may be configured. The maximum is the
+// largest supported by Chrome.
+const (
+	MinRecordSize = 1 << 10
+	MaxRecordSize = 128 << 10
+)
+
+// ValidateRecordSize returns an error unless the given MICE record size is a
+// power of two between MinRecordSize and MaxRecordSize.
+func ValidateRecordSize(size int) error {
+	if size < MinRecordSize || size > MaxRecordSize || size&(size-1) != 0 {
+		return errors.Errorf("record size %d must be a power of two between %d and %d", size, MinRecordSize, MaxRecordSize)
+	}
+	return nil
+}
+
+// Returns an error unless the given Domain is either a host (with optional
+// port), or a wildcard of the form *.example.com, which matches a single label
+// in its place, as in certs.
+func validateDomain(domain string) error {
+	if !strings.Contains(domain, "*") {
+		return nil
+	}
+	if !strings.HasPrefix(domain, "*.") || strings.Contains(domain[2:], "*") {
+		return errors.Errorf("Domain %q may only contain a wildcard as its first label", domain)
+	}
+	if !strings.Contains(domain[2:], ".") {
+		return errors.Errorf("Domain %q has too broad a wildcard", domain)
+	}
+	return nil
+}
+
+// DomainMatches returns true if the given URL host matches the Domain of a
+// URLPattern: exactly or, if it's a wildcard like *.example.com, with a single
+// label (e.g. a.example.com, but not example.com or a.b.example.com) in place
+// of the wildcard.
+func DomainMatches(domain, host string) bool {
+	if !strings.HasPrefix(domain, "*.") {
+		return host == domain
+	}
+	suffix := domain[1:]
+	label := strings.TrimSuffix(host, suffix)
+	return len(label) < len(host) && label != "" && !strings.ContainsAny(label, ".:")
+}
+
 func validateSignURLPattern(pattern *URLPattern) error {
 	if pattern == nil {
 		return errors.New("This section must be specified")
@@ -89,6 +250,9 @@ func validateSignURLPattern(pattern *URLPattern) error {
 	if pattern.Domain == "" {
 		return errors.New("Domain must be specified")
 	}
+	if err := validateDomain(pattern.Domain); err != nil {
+		return err
+	}
 	if pattern.DomainRE != "" {
 		return errors.New("DomainRE not allowed here")
 	}
@@ -128,6 +292,9 @@ func validateFetchURLPattern(pattern *URLPattern) error {
 	if pattern.Domain != "" && pattern.DomainRE != "" {
 		return errors.New("Only one of Domain or DomainRE should be specified")
 	}
+	if err := validateDomain(pattern.Domain); err != nil {
+		return err
+	}
 	if pattern.SamePath == nil {
 		// Default SamePath to true.
 		pattern.SamePath = new(bool)
@@ -171,6 +338,30 @@ func ReadConfig(configBytes []byte) (*Config, error) {
 		return nil, errors.Errorf("OCSPCache parent directory must exist: %s", ocspDir)
 	}
 	// TODO(twifkak): Verify OCSPCache is writable by the current user.
+	ocspCaches := map[string]bool{config.OCSPCache: true}
+	for i, extra := range config.ExtraCert {
+		if extra.CertFile == "" || extra.KeyFile == "" || extra.OCSPCache == "" {
+			return nil, errors.Errorf("parsing ExtraCert.%d: must specify CertFile, KeyFile, and OCSPCache", i)
+		}
+		// Otherwise, the certs would overwrite each other's OCSP
+		// responses.
+		if ocspCaches[extra.OCSPCache] {
+			return nil, errors.Errorf("parsing ExtraCert.%d: OCSPCache %s is already in use", i, extra.OCSPCache)
+		}
+		ocspCaches[extra.OCSPCache] = true
+		ocspDir := filepath.Dir(extra.OCSPCache)
+		if stat, err := os.Stat(ocspDir); os.IsNotExist(err) || !stat.Mode().IsDir() {
+			return nil, errors.Errorf("parsing ExtraCert.%d: OCSPCache parent directory must exist: %s", i, ocspDir)
+		}
+	}
+	if _, err := NewIPAllowlist(config.CacheIPAllowlist); err != nil {
+		return nil, errors.Wrap(err, "parsing CacheIPAllowlist")
+	}
+	if config.RecordSize != 0 {
+		if err := ValidateRecordSize(config.RecordSize); err != nil {
+			return nil, errors.Wrap(err, "parsing RecordSize")
+		}
+	}
 	if len(config.URLSet) == 0 {
 		return nil, errors.New("must specify one or more [[URLSet]]")
 	}
@@ -183,6 +374,22 @@ func ReadConfig(configBytes []byte) (*Config, error) {
 		if err := validateSignURLPattern(config.URLSet[i].Sign); err != nil {
 			return nil, errors.Wrapf(err, "parsing URLSet.%d.Sign", i)
 		}
+		// Otherwise, documents fetched from one host could be signed
+		// for another that the wildcard matches.
+		if config.URLSet[i].Fetch != nil && strings.HasPrefix(config.URLSet[i].Sign.Domain, "*.") {
+			return nil, errors.Errorf("parsing URLSet.%d: a wildcard Sign Domain requires omitting Fetch", i)
+		}
+		if config.URLSet[i].RecordSize != 0 {
+			if err := ValidateRecordSize(config.URLSet[i].RecordSize); err != nil {
+				return nil, errors.Wrapf(err, "parsing URLSet.%d.RecordSize", i)
+			}
+		}
+		if config.URLSet[i].RateLimit < 0 || config.URLSet[i].RateLimitBurst < 0 {
+			return nil, errors.Errorf("parsing URLSet.%d: RateLimit and RateLimitBurst must not be negative", i)
+		}
+		if network := config.URLSet[i].FetchNetwork; network != "" && network != "tcp4" && network != "tcp6" {
+			return nil, errors.Errorf("parsing URLSet.%d: FetchNetwork %q is not one of \"tcp4\" or \"tcp6\"", i, network)
+		}
 	}
 	return &config, nil
 }
@@ -98,6 +98,66 @@ func TestInvalidQueryRE(t *testing.T) {
 	`))), "QueryRE must be a valid regexp")
 }
 
+func TestInvalidCacheIPAllowlist(t *testing.T) {
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		CacheIPAllowlist = ["192.0.2.0/33"]
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))), "parsing CacheIPAllowlist")
+}
+
+func TestRecordSize(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		RecordSize = 131072
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, 131072, config.RecordSize)
+
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		RecordSize = 262144
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))), "parsing RecordSize")
+}
+
+func TestURLSetRecordSize(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  RecordSize = 4096
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, 4096, config.URLSet[0].RecordSize)
+
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  RecordSize = 5000
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))), "parsing URLSet.0.RecordSize")
+}
+
 func TestSignMissing(t *testing.T) {
 	msg := errorFrom(ReadConfig([]byte(`
 		CertFile = "cert.pem"
@@ -133,6 +193,154 @@ func TestSignDomainRE(t *testing.T) {
 	`))), "DomainRE not allowed here")
 }
 
+func TestWildcardDomain(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "*.example.com"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, "*.example.com", config.URLSet[0].Sign.Domain)
+
+	for domain, expected := range map[string]string{
+		"*":               `Domain "*" may only contain a wildcard as its first label`,
+		"*.com":           `Domain "*.com" has too broad a wildcard`,
+		"a.*.example.com": `Domain "a.*.example.com" may only contain a wildcard as its first label`,
+		"*a.example.com":  `Domain "*a.example.com" may only contain a wildcard as its first label`,
+		"*.*.example.com": `Domain "*.*.example.com" may only contain a wildcard as its first label`,
+	} {
+		assert.Contains(t, errorFrom(ReadConfig([]byte(`
+			CertFile = "cert.pem"
+			KeyFile = "key.pem"
+			OCSPCache = "/tmp/ocsp"
+			[[URLSet]]
+			  [URLSet.Sign]
+			    Domain = "`+domain+`"
+		`))), expected, domain)
+	}
+
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "*.example.com"
+		  [URLSet.Fetch]
+		    Domain = "origin.example.com"
+	`))), "a wildcard Sign Domain requires omitting Fetch")
+}
+
+func TestDomainMatches(t *testing.T) {
+	assert.True(t, DomainMatches("example.com", "example.com"))
+	assert.False(t, DomainMatches("example.com", "a.example.com"))
+	assert.True(t, DomainMatches("*.example.com", "a.example.com"))
+	assert.True(t, DomainMatches("*.example.com", "b.example.com"))
+	assert.False(t, DomainMatches("*.example.com", "example.com"))
+	assert.False(t, DomainMatches("*.example.com", ".example.com"))
+	assert.False(t, DomainMatches("*.example.com", "a.b.example.com"))
+	assert.False(t, DomainMatches("*.example.com", "example.com.evil.com"))
+	assert.False(t, DomainMatches("*.example.com", "evilexample.com"))
+	assert.False(t, DomainMatches("*.example.com", "a.example.com:8443"))
+	assert.True(t, DomainMatches("*.example.com:8443", "a.example.com:8443"))
+}
+
+func TestURLSetRateLimit(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  RateLimit = 2.5
+		  RateLimitBurst = 10
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, config.URLSet[0].RateLimit)
+	assert.Equal(t, 10, config.URLSet[0].RateLimitBurst)
+
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  RateLimit = -1.0
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))), "RateLimit and RateLimitBurst must not be negative")
+}
+
+func TestExtraCert(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[ExtraCert]]
+		  CertFile = "extra.pem"
+		  KeyFile = "extra-key.pem"
+		  OCSPCache = "/tmp/extra-ocsp"
+		  Priority = 1
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, []ExtraCert{{"extra.pem", "extra-key.pem", "/tmp/extra-ocsp", 1}}, config.ExtraCert)
+
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[ExtraCert]]
+		  CertFile = "extra.pem"
+		  OCSPCache = "/tmp/extra-ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))), "parsing ExtraCert.0: must specify CertFile, KeyFile, and OCSPCache")
+
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[ExtraCert]]
+		  CertFile = "extra.pem"
+		  KeyFile = "extra-key.pem"
+		  OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))), "parsing ExtraCert.0: OCSPCache /tmp/ocsp is already in use")
+}
+
+func TestURLSetFetchNetwork(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  FetchNetwork = "tcp6"
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, "tcp6", config.URLSet[0].FetchNetwork)
+
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  FetchNetwork = "udp"
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))), `FetchNetwork "udp" is not one of`)
+}
+
 func TestSignSamePath(t *testing.T) {
 	assert.Contains(t, errorFrom(ReadConfig([]byte(`
 		CertFile = "cert.pem"
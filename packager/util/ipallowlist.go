@@ -0,0 +1,87 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// IPAllowlist restricts a handler to clients whose IP address falls within
+// one of a set of networks.
+type IPAllowlist struct {
+	nets []*net.IPNet
+}
+
+// NewIPAllowlist parses the given list of IP addresses and CIDR ranges (e.g.
+// "192.0.2.1" or "2001:db8::/32").
+func NewIPAllowlist(entries []string) (*IPAllowlist, error) {
+	this := &IPAllowlist{}
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.Errorf("invalid IP address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			this.nets = append(this.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid CIDR range %q", entry)
+		}
+		this.nets = append(this.nets, ipNet)
+	}
+	return this, nil
+}
+
+// Allows returns true iff the given remote address (as in
+// http.Request.RemoteAddr, i.e. "host:port") is within the allowlist.
+func (this *IPAllowlist) Allows(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range this.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap returns a handler that responds 403 to clients outside the allowlist,
+// and otherwise delegates to the given handler.
+func (this *IPAllowlist) Wrap(handle httprouter.Handle) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if !this.Allows(req.RemoteAddr) {
+			NewHTTPError(http.StatusForbidden, "Disallowed client IP: ", req.RemoteAddr).LogAndRespond(resp)
+			return
+		}
+		handle(resp, req, params)
+	}
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewIPAllowlist(t *testing.T) {
+	_, err := NewIPAllowlist([]string{"192.0.2.1", "198.51.100.0/24", "2001:db8::/32"})
+	assert.NoError(t, err)
+	_, err = NewIPAllowlist([]string{"192.0.2"})
+	assert.EqualError(t, err, `invalid IP address "192.0.2"`)
+	_, err = NewIPAllowlist([]string{"192.0.2.0/33"})
+	assert.Contains(t, err.Error(), `invalid CIDR range "192.0.2.0/33"`)
+}
+
+func TestIPAllowlistAllows(t *testing.T) {
+	allowlist, err := NewIPAllowlist([]string{"192.0.2.1", "198.51.100.0/24", "2001:db8::/32"})
+	require.NoError(t, err)
+	assert.True(t, allowlist.Allows("192.0.2.1:1234"))
+	assert.True(t, allowlist.Allows("198.51.100.7:1234"))
+	assert.True(t, allowlist.Allows("[2001:db8::1]:1234"))
+	assert.False(t, allowlist.Allows("192.0.2.2:1234"))
+	assert.False(t, allowlist.Allows("[2001:db9::1]:1234"))
+	assert.False(t, allowlist.Allows("garbage"))
+}
+
+func TestIPAllowlistWrap(t *testing.T) {
+	allowlist, err := NewIPAllowlist([]string{"192.0.2.1"})
+	require.NoError(t, err)
+	handle := allowlist.Wrap(func(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		resp.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest("GET", "/amppkg/validity", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	handle(rec, req, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	req.RemoteAddr = "203.0.113.5:1234"
+	rec = httptest.NewRecorder()
+	handle(rec, req, nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// KillSwitch disables signing while a given file exists, so that operators can
+// switch to unsigned passthrough during an incident (e.g. with `touch`) without
+// restarting the server.
+type KillSwitch struct {
+	path         string
+	pollInterval time.Duration
+
+	mu        sync.Mutex
+	engaged   bool
+	lastCheck time.Time
+}
+
+// NewKillSwitch returns a KillSwitch that checks for the file at path at most
+// once per pollInterval.
+func NewKillSwitch(path string, pollInterval time.Duration) *KillSwitch {
+	return &KillSwitch{path: path, pollInterval: pollInterval}
+}
+
+// Engaged returns true iff the file existed when last checked.
+func (this *KillSwitch) Engaged() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if now := time.Now(); this.lastCheck.IsZero() || now.Sub(this.lastCheck) >= this.pollInterval {
+		this.lastCheck = now
+		_, err := os.Stat(this.path)
+		engaged := err == nil
+		if engaged != this.engaged {
+			if engaged {
+				log.Printf("Kill switch %s engaged; proxying all documents unsigned.\n", this.path)
+			} else {
+				log.Printf("Kill switch %s disengaged; resuming signing.\n", this.path)
+			}
+			this.engaged = engaged
+		}
+	}
+	return this.engaged
+}
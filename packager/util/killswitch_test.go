@@ -0,0 +1,32 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKillSwitch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "killswitch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "disable-signing")
+
+	killSwitch := NewKillSwitch(path, 0)
+	assert.False(t, killSwitch.Engaged())
+	require.NoError(t, ioutil.WriteFile(path, nil, 0644))
+	assert.True(t, killSwitch.Engaged())
+	require.NoError(t, os.Remove(path))
+	assert.False(t, killSwitch.Engaged())
+
+	// The file isn't re-checked within the poll interval.
+	killSwitch = NewKillSwitch(path, time.Hour)
+	assert.False(t, killSwitch.Engaged())
+	require.NoError(t, ioutil.WriteFile(path, nil, 0644))
+	assert.False(t, killSwitch.Engaged())
+}
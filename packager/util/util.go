@@ -22,13 +22,19 @@ import (
 	"encoding/asn1"
 	"encoding/base64"
 	"encoding/pem"
+	"io/ioutil"
 
 	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/mice"
 	"github.com/pkg/errors"
 )
 
 const CertURLPrefix = "/amppkg/cert"
 
+// The query param by which cert URLs carry a version, if configured (see
+// Config.CertURLVersion).
+const CertURLVersionParam = "v"
+
 // CertName returns the basename for the given cert, as served by this
 // packager's cert cache. Should be stable and unique (e.g.
 // content-addressing). Clients should url.PathEscape this, just in case its
@@ -76,3 +82,34 @@ func CanSignHttpExchanges(cert *x509.Certificate) bool {
 	}
 	return false
 }
+
+// HasSCTs returns true if the given certificate has embedded Signed
+// Certificate Timestamps, which Chrome requires of SXG certs in order to
+// verify their Certificate Transparency. It doesn't verify the SCTs.
+func HasSCTs(cert *x509.Certificate) bool {
+	// https://tools.ietf.org/html/rfc6962#section-3.3
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}) && len(ext.Value) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyMIPayload decodes the given MI-encoded payload, verifying each record
+// against the proof chain rooted at digest (the value of the Digest header),
+// and returns the decoded payload. Per mi-sha256-03, the final record's proof
+// covers a trailing 0 byte in place of the next record's proof, so a payload
+// that was truncated at a record boundary, or extended past its final record,
+// fails to verify.
+func VerifyMIPayload(enc mice.Encoding, encoded []byte, digest string) ([]byte, error) {
+	decoder, err := enc.NewDecoder(bytes.NewReader(encoded), digest, MaxRecordSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading MI header")
+	}
+	decoded, err := ioutil.ReadAll(decoder)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding MI records")
+	}
+	return decoded, nil
+}
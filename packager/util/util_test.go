@@ -1,10 +1,14 @@
 package util_test
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"testing"
 
+	"github.com/WICG/webpackage/go/signedexchange/mice"
 	pkgt "github.com/ampproject/amppackager/packager/testing"
 	"github.com/ampproject/amppackager/packager/util"
 	"github.com/stretchr/testify/assert"
@@ -27,3 +31,47 @@ func TestCanSignHttpExchanges(t *testing.T) {
 	// CA node does not.
 	assert.False(t, util.CanSignHttpExchanges(pkgt.Certs[1]))
 }
+
+func TestVerifyMIPayload(t *testing.T) {
+	// Two full records and a partial final one.
+	payload := bytes.Repeat([]byte("0123456789"), 250)
+	var encoded bytes.Buffer
+	digest, err := mice.Draft03Encoding.Encode(&encoded, payload, 1024)
+	require.NoError(t, err)
+
+	decoded, err := util.VerifyMIPayload(mice.Draft03Encoding, encoded.Bytes(), digest)
+	require.NoError(t, err)
+	assert.Equal(t, payload, decoded)
+
+	// The final record is terminated, so the payload can't be extended.
+	_, err = util.VerifyMIPayload(mice.Draft03Encoding, append(encoded.Bytes(), 'x'), digest)
+	assert.Error(t, err)
+	// Nor truncated at a record boundary, as the preceding record isn't
+	// terminated.
+	_, err = util.VerifyMIPayload(mice.Draft03Encoding, encoded.Bytes()[:8+1024+32+1024], digest)
+	assert.Error(t, err)
+	// Nor altered.
+	corrupted := append([]byte{}, encoded.Bytes()...)
+	corrupted[len(corrupted)-1] ^= 1
+	_, err = util.VerifyMIPayload(mice.Draft03Encoding, corrupted, digest)
+	assert.Error(t, err)
+
+	// A payload that ends on a record boundary terminates its last full
+	// record.
+	encoded.Reset()
+	digest, err = mice.Draft03Encoding.Encode(&encoded, payload[:2048], 1024)
+	require.NoError(t, err)
+	decoded, err = util.VerifyMIPayload(mice.Draft03Encoding, encoded.Bytes(), digest)
+	require.NoError(t, err)
+	assert.Equal(t, payload[:2048], decoded)
+}
+
+func TestHasSCTs(t *testing.T) {
+	// The test cert lacks them.
+	assert.False(t, util.HasSCTs(pkgt.Certs[0]))
+
+	cert := *pkgt.Certs[0]
+	cert.Extensions = append(cert.Extensions, pkix.Extension{
+		Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}, Value: []byte{0x04, 0x02, 0x00, 0x00}})
+	assert.True(t, util.HasSCTs(&cert))
+}
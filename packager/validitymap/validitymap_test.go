@@ -1,9 +1,11 @@
 package validitymap
 
 import (
+	"bytes"
 	"io/ioutil"
 	"testing"
 
+	"github.com/WICG/webpackage/go/signedexchange/cbor"
 	pkgt "github.com/ampproject/amppackager/packager/testing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -22,4 +24,11 @@ func TestValidityMap(t *testing.T) {
 	body, err := ioutil.ReadAll(resp.Body)
 	require.NoError(t, err)
 	assert.Equal(t, []byte("\xA0"), body)
+
+	// The body is a CBOR map with no entries, and nothing after it.
+	reader := bytes.NewReader(body)
+	n, err := cbor.NewDecoder(reader).DecodeMapHeader()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), n)
+	assert.Equal(t, 0, reader.Len())
 }
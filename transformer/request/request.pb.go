@@ -130,10 +130,13 @@ type Request struct {
 	Transformers []string `protobuf:"bytes,3,rep,name=transformers,proto3" json:"transformers,omitempty"`
 	// The version of the transforms to perform (optional). If specified, it must
 	// be a supported version.
-	Version              int64    `protobuf:"varint,8,opt,name=version,proto3" json:"version,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	Version int64 `protobuf:"varint,8,opt,name=version,proto3" json:"version,omitempty"`
+	// Selected response headers of the document (optional), keyed by
+	// canonical name, for use by transformers that depend on them.
+	ResponseHeaders      map[string]string `protobuf:"bytes,9,rep,name=response_headers,json=responseHeaders,proto3" json:"response_headers,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
 }
 
 func (m *Request) Reset()         { *m = Request{} }
@@ -216,6 +219,13 @@ func (m *Request) GetVersion() int64 {
 	return 0
 }
 
+func (m *Request) GetResponseHeaders() map[string]string {
+	if m != nil {
+		return m.ResponseHeaders
+	}
+	return nil
+}
+
 // An inclusive range of version numbers.
 type VersionRange struct {
 	Min                  int64    `protobuf:"varint,1,opt,name=min,proto3" json:"min,omitempty"`
@@ -321,7 +331,24 @@ type Metadata_Preload struct {
 	// full list of potential values is specified in
 	// https://fetch.spec.whatwg.org/#concept-request-destination, though for
 	// the time being only "script" and "style" are allowed.
-	As                   string   `protobuf:"bytes,2,opt,name=as,proto3" json:"as,omitempty"`
+	As string `protobuf:"bytes,2,opt,name=as,proto3" json:"as,omitempty"`
+	// The CORS settings of the element from which the preload was derived,
+	// i.e. the value of its `crossorigin` attribute: "" if absent, else
+	// "anonymous" or "use-credentials". The preload must match these for the
+	// browser to reuse the preloaded response.
+	Crossorigin string `protobuf:"bytes,3,opt,name=crossorigin,proto3" json:"crossorigin,omitempty"`
+	// The media query of the element from which the preload was derived,
+	// i.e. the value of its `media` attribute, if any. The resource is only
+	// used when the media query matches.
+	Media string `protobuf:"bytes,4,opt,name=media,proto3" json:"media,omitempty"`
+	// The image candidates from which the browser selects the image to
+	// preload, i.e. the `srcset` attribute of the image from which the
+	// preload was derived, with absolute URLs, if any. When set, url is the
+	// fallback for browsers that don't support srcset.
+	Imagesrcset string `protobuf:"bytes,5,opt,name=imagesrcset,proto3" json:"imagesrcset,omitempty"`
+	// The `sizes` attribute of the image from which the preload was derived,
+	// if any. Only meaningful alongside imagesrcset.
+	Imagesizes           string   `protobuf:"bytes,6,opt,name=imagesizes,proto3" json:"imagesizes,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -365,8 +392,37 @@ func (m *Metadata_Preload) GetAs() string {
 	return ""
 }
 
+func (m *Metadata_Preload) GetCrossorigin() string {
+	if m != nil {
+		return m.Crossorigin
+	}
+	return ""
+}
+
+func (m *Metadata_Preload) GetMedia() string {
+	if m != nil {
+		return m.Media
+	}
+	return ""
+}
+
+func (m *Metadata_Preload) GetImagesrcset() string {
+	if m != nil {
+		return m.Imagesrcset
+	}
+	return ""
+}
+
+func (m *Metadata_Preload) GetImagesizes() string {
+	if m != nil {
+		return m.Imagesizes
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterType((*Request)(nil), "amp.transform.Request")
+	proto.RegisterMapType((map[string]string)(nil), "amp.transform.Request.ResponseHeadersEntry")
 	proto.RegisterType((*VersionRange)(nil), "amp.transform.VersionRange")
 	proto.RegisterType((*Metadata)(nil), "amp.transform.Metadata")
 	proto.RegisterType((*Metadata_Preload)(nil), "amp.transform.Metadata.Preload")
@@ -377,36 +433,43 @@ func init() {
 func init() { proto.RegisterFile("transformer/request/request.proto", fileDescriptor_762cce2ac5f73405) }
 
 var fileDescriptor_762cce2ac5f73405 = []byte{
-	// 481 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x52, 0x5d, 0x93, 0xd2, 0x30,
-	0x14, 0xdd, 0x12, 0xa4, 0x70, 0x61, 0x31, 0x93, 0xa7, 0x8e, 0x2f, 0x96, 0x3e, 0xd5, 0x71, 0xa6,
-	0xcc, 0xa0, 0x8e, 0x0f, 0x3e, 0x55, 0xe8, 0x2a, 0x4a, 0x0b, 0xd3, 0x85, 0xd5, 0xf1, 0x85, 0xc9,
-	0x96, 0x2c, 0x8b, 0xb6, 0x0d, 0x26, 0x61, 0xdd, 0xbf, 0xe9, 0x3f, 0x72, 0x92, 0x96, 0x5d, 0xd7,
-	0x8f, 0xa7, 0xdc, 0x7b, 0x72, 0x4e, 0x72, 0xe6, 0xde, 0x03, 0x03, 0x25, 0x68, 0x29, 0xaf, 0xb8,
-	0x28, 0x98, 0x18, 0x0a, 0xf6, 0xfd, 0xc0, 0xa4, 0x3a, 0x9e, 0xc1, 0x5e, 0x70, 0xc5, 0xc9, 0x29,
-	0x2d, 0xf6, 0xc1, 0x1d, 0xcd, 0xfb, 0x89, 0xc0, 0x4e, 0x2b, 0x02, 0x21, 0xd0, 0xbc, 0x56, 0x45,
-	0xee, 0x58, 0xae, 0xe5, 0x77, 0x52, 0x53, 0x93, 0x01, 0xf4, 0x36, 0x3c, 0x3b, 0x14, 0xac, 0x54,
-	0xeb, 0x83, 0xc8, 0x9d, 0x86, 0xb9, 0xeb, 0x1e, 0xb1, 0x95, 0xc8, 0x09, 0x06, 0x24, 0xd4, 0x8d,
-	0xd3, 0x34, 0x37, 0xba, 0xd4, 0x48, 0x26, 0xa5, 0xf3, 0xa8, 0x42, 0x32, 0x29, 0xc9, 0x07, 0x78,
-	0x4c, 0xf3, 0x9c, 0xff, 0x60, 0x9b, 0xb5, 0xfe, 0x96, 0x2a, 0xe9, 0xd8, 0x2e, 0xf2, 0xfb, 0xa3,
-	0x41, 0xf0, 0xc0, 0x4f, 0x50, 0x7b, 0x09, 0xde, 0xab, 0x22, 0x3f, 0x33, 0xcc, 0xb4, 0x5f, 0x2b,
-	0xab, 0x56, 0x92, 0x10, 0x5a, 0x19, 0x2f, 0xaf, 0x76, 0x5b, 0xa7, 0xe5, 0x5a, 0x7e, 0x7f, 0xf4,
-	0xec, 0x3f, 0x4f, 0x2c, 0xef, 0x67, 0x21, 0xc7, 0x46, 0x90, 0xd6, 0x42, 0xe2, 0x41, 0xef, 0xb7,
-	0x49, 0x49, 0x07, 0xb9, 0xc8, 0xef, 0xa4, 0x0f, 0x30, 0xe2, 0x80, 0x7d, 0xc3, 0x84, 0xdc, 0xf1,
-	0xd2, 0x69, 0xbb, 0x96, 0x8f, 0xd2, 0x63, 0xeb, 0xad, 0x00, 0xee, 0xed, 0x11, 0x0c, 0xbd, 0x55,
-	0xf2, 0x31, 0x99, 0x7f, 0x4a, 0xd6, 0xe3, 0xf9, 0x24, 0xc2, 0x27, 0xc4, 0x06, 0x14, 0xc6, 0x0b,
-	0x6c, 0x91, 0x2e, 0xd8, 0x61, 0xbc, 0x78, 0x19, 0x4e, 0xce, 0x71, 0x83, 0x9c, 0x42, 0x47, 0x37,
-	0x51, 0x1c, 0x4e, 0x67, 0x18, 0x69, 0x59, 0xf4, 0x79, 0x11, 0xa5, 0xd3, 0x38, 0x4a, 0x96, 0xe1,
-	0x0c, 0x37, 0xbd, 0x77, 0x40, 0xfe, 0xb6, 0xac, 0xdf, 0x98, 0x44, 0x67, 0xe1, 0x6a, 0xb6, 0xc4,
-	0x27, 0xa4, 0x0d, 0xcd, 0x64, 0x9e, 0x44, 0xd8, 0x22, 0x7d, 0x80, 0x8b, 0x70, 0x36, 0x9d, 0x84,
-	0xcb, 0xe9, 0x3c, 0xc1, 0x0d, 0x02, 0xd0, 0x1a, 0xaf, 0xce, 0x97, 0xf3, 0x18, 0x23, 0x6f, 0x04,
-	0xbd, 0x8b, 0xca, 0x6a, 0x4a, 0xcb, 0x2d, 0xd3, 0xeb, 0x28, 0x76, 0xa5, 0x59, 0x2b, 0x4a, 0x75,
-	0x69, 0x10, 0x7a, 0x6b, 0x96, 0xa9, 0x11, 0x7a, 0xeb, 0x29, 0x68, 0xc7, 0x4c, 0xd1, 0x0d, 0x55,
-	0x94, 0xbc, 0x81, 0xf6, 0x5e, 0xb0, 0x9c, 0xd3, 0x8d, 0x74, 0x2c, 0x17, 0xf9, 0xdd, 0xd1, 0xd3,
-	0x3f, 0x46, 0x7c, 0xa4, 0x06, 0x8b, 0x8a, 0x97, 0xde, 0x09, 0x9e, 0x3c, 0x07, 0xbb, 0x06, 0xf5,
-	0x2f, 0x3a, 0x32, 0x55, 0x9c, 0x74, 0x49, 0xfa, 0xd0, 0xa0, 0xb2, 0xce, 0x50, 0x83, 0xca, 0xb7,
-	0xaf, 0xbf, 0xbc, 0xda, 0xee, 0xd4, 0xf5, 0xe1, 0x32, 0xc8, 0x78, 0x31, 0xa4, 0xc5, 0x7e, 0x2f,
-	0xf8, 0x57, 0x96, 0x29, 0x53, 0xd2, 0xec, 0x1b, 0xdd, 0x32, 0x31, 0xfc, 0x47, 0xa6, 0x2f, 0x5b,
-	0x26, 0xcc, 0x2f, 0x7e, 0x05, 0x00, 0x00, 0xff, 0xff, 0x3f, 0x5f, 0xd2, 0x0e, 0xf1, 0x02, 0x00,
-	0x00,
+	// 603 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x53, 0xcd, 0x6e, 0xd3, 0x4c,
+	0x14, 0xad, 0xed, 0x34, 0x3f, 0x37, 0x69, 0x6a, 0x8d, 0xba, 0xb0, 0xba, 0xf8, 0x3e, 0x37, 0xab,
+	0x20, 0x24, 0x57, 0x0a, 0x20, 0x10, 0xac, 0xdc, 0xc6, 0xa5, 0x81, 0xc4, 0x89, 0xa6, 0x49, 0x41,
+	0x6c, 0xa2, 0xa9, 0x33, 0x4d, 0x4d, 0x6d, 0x4f, 0x98, 0x99, 0x94, 0x96, 0xf7, 0xe1, 0xf1, 0x10,
+	0xaf, 0x80, 0xc6, 0x9e, 0xb4, 0x09, 0xb4, 0x2b, 0xdf, 0x73, 0x7c, 0xce, 0xfc, 0x9c, 0xb9, 0x17,
+	0x0e, 0x24, 0x27, 0x99, 0xb8, 0x64, 0x3c, 0xa5, 0xfc, 0x90, 0xd3, 0x6f, 0x4b, 0x2a, 0xe4, 0xea,
+	0xeb, 0x2d, 0x38, 0x93, 0x0c, 0xed, 0x90, 0x74, 0xe1, 0xdd, 0xcb, 0x5a, 0xbf, 0x4a, 0x50, 0xc1,
+	0x85, 0x00, 0x21, 0x28, 0x5d, 0xc9, 0x34, 0x71, 0x0c, 0xd7, 0x68, 0xd7, 0x70, 0x5e, 0xa3, 0x03,
+	0x68, 0xcc, 0x58, 0xb4, 0x4c, 0x69, 0x26, 0xa7, 0x4b, 0x9e, 0x38, 0x66, 0xfe, 0xaf, 0xbe, 0xe2,
+	0x26, 0x3c, 0x41, 0x36, 0x58, 0x5c, 0xde, 0x38, 0xa5, 0xfc, 0x8f, 0x2a, 0x15, 0x13, 0x09, 0xe1,
+	0x6c, 0x17, 0x4c, 0x24, 0x04, 0xfa, 0x00, 0xbb, 0x24, 0x49, 0xd8, 0x77, 0x3a, 0x9b, 0xaa, 0x6d,
+	0x89, 0x14, 0x4e, 0xc5, 0xb5, 0xda, 0xcd, 0xce, 0x81, 0xb7, 0x71, 0x1e, 0x4f, 0x9f, 0xc5, 0x3b,
+	0x95, 0x69, 0x72, 0x92, 0x2b, 0x71, 0x53, 0x3b, 0x0b, 0x28, 0x90, 0x0f, 0xe5, 0x88, 0x65, 0x97,
+	0xf1, 0xdc, 0x29, 0xbb, 0x46, 0xbb, 0xd9, 0x79, 0xf6, 0xc4, 0x12, 0xe3, 0x87, 0x2c, 0xc4, 0x71,
+	0x6e, 0xc0, 0xda, 0x88, 0x5a, 0xd0, 0x58, 0x4b, 0x4a, 0x38, 0x96, 0x6b, 0xb5, 0x6b, 0x78, 0x83,
+	0x43, 0x0e, 0x54, 0x6e, 0x28, 0x17, 0x31, 0xcb, 0x9c, 0xaa, 0x6b, 0xb4, 0x2d, 0xbc, 0x82, 0xe8,
+	0x1c, 0x6c, 0x4e, 0xc5, 0x82, 0x65, 0x82, 0x4e, 0xaf, 0x28, 0x99, 0xa9, 0x15, 0x6a, 0xae, 0xd5,
+	0xae, 0x77, 0x9e, 0x3f, 0x71, 0x14, 0xac, 0xe5, 0xa7, 0x85, 0x3a, 0xc8, 0x24, 0xbf, 0xc3, 0xbb,
+	0x7c, 0x93, 0xdd, 0x3f, 0x82, 0xbd, 0xc7, 0x84, 0x2a, 0xce, 0x6b, 0x7a, 0xa7, 0x9f, 0x45, 0x95,
+	0x68, 0x0f, 0xb6, 0x6f, 0x48, 0xb2, 0xa4, 0xfa, 0x39, 0x0a, 0xf0, 0xd6, 0x7c, 0x63, 0xb4, 0x26,
+	0x00, 0x0f, 0xd1, 0x21, 0x1b, 0x1a, 0x93, 0xf0, 0x63, 0x38, 0xfc, 0x14, 0x4e, 0x8f, 0x87, 0xdd,
+	0xc0, 0xde, 0x42, 0x15, 0xb0, 0xfc, 0xc1, 0xc8, 0x36, 0x50, 0x1d, 0x2a, 0xfe, 0x60, 0xf4, 0xd2,
+	0xef, 0x9e, 0xd9, 0x26, 0xda, 0x81, 0x9a, 0x02, 0xc1, 0xc0, 0xef, 0xf5, 0x6d, 0x4b, 0xd9, 0x82,
+	0xcf, 0xa3, 0x00, 0xf7, 0x06, 0x41, 0x38, 0xf6, 0xfb, 0x76, 0xa9, 0xf5, 0x1e, 0xd0, 0xbf, 0x71,
+	0xaa, 0x35, 0xba, 0xc1, 0x89, 0x3f, 0xe9, 0x8f, 0xed, 0x2d, 0x54, 0x85, 0x52, 0x38, 0x0c, 0x03,
+	0xdb, 0x40, 0x4d, 0x80, 0x73, 0xbf, 0xdf, 0xeb, 0xfa, 0xe3, 0xde, 0x30, 0xb4, 0x4d, 0x04, 0x50,
+	0x3e, 0x9e, 0x9c, 0x8d, 0x87, 0x03, 0xdb, 0x6a, 0x75, 0xa0, 0x71, 0x5e, 0xc4, 0x88, 0x49, 0x36,
+	0xa7, 0xea, 0x6e, 0x69, 0x9c, 0xe5, 0x77, 0xb3, 0xb0, 0x2a, 0x73, 0x86, 0xdc, 0x3a, 0xa6, 0x66,
+	0xc8, 0x6d, 0xeb, 0xb7, 0x01, 0xd5, 0x01, 0x95, 0x64, 0x46, 0x24, 0x41, 0xef, 0xa0, 0xba, 0xe0,
+	0x34, 0x61, 0x64, 0x26, 0x1c, 0x23, 0x0f, 0xfd, 0xff, 0xbf, 0x42, 0x5f, 0x49, 0xbd, 0x51, 0xa1,
+	0xc3, 0xf7, 0x86, 0xfd, 0x9f, 0x06, 0x54, 0x34, 0xab, 0xf6, 0x51, 0x0d, 0xad, 0x53, 0x5d, 0xf2,
+	0x04, 0x35, 0xc1, 0x24, 0x42, 0x47, 0x6a, 0x12, 0x81, 0x5c, 0xa8, 0x47, 0x9c, 0x09, 0xc1, 0x78,
+	0x3c, 0x8f, 0x33, 0xc7, 0x2a, 0x5a, 0x7f, 0x8d, 0x52, 0xef, 0x90, 0xd2, 0x59, 0x4c, 0x74, 0xf3,
+	0x17, 0x40, 0xf9, 0xe2, 0x94, 0xcc, 0xa9, 0xe0, 0x91, 0xa0, 0x52, 0x8f, 0xc1, 0x3a, 0x85, 0xfe,
+	0x03, 0x28, 0x60, 0xfc, 0x83, 0x8a, 0xbc, 0x8d, 0x6b, 0x78, 0x8d, 0x39, 0x7a, 0xfd, 0xe5, 0xd5,
+	0x3c, 0x96, 0x57, 0xcb, 0x0b, 0x2f, 0x62, 0xe9, 0x21, 0x49, 0x17, 0x0b, 0xce, 0xbe, 0xd2, 0x48,
+	0xe6, 0x25, 0x89, 0xae, 0xc9, 0x9c, 0xf2, 0xc3, 0x47, 0x66, 0xfd, 0xa2, 0x9c, 0x0f, 0xf9, 0x8b,
+	0x3f, 0x03, 0x00, 0xf5, 0x61, 0x25, 0x85, 0x09, 0x04, 0x00, 0x00,
 }
@@ -156,6 +156,35 @@ func setDOM(c *transformers.Context, s string) error {
 	return nil
 }
 
+// IsSupportedFormat returns true iff the given format may be declared by an
+// html amp attribute, and so may be listed in Request.AllowedFormats.
+func IsSupportedFormat(format rpb.Request_HtmlFormat) bool {
+	_, ok := ampFormatSuffixes[format]
+	return ok
+}
+
+// DeclaredFormat returns the AMP format declared by the html amp attribute of
+// the given document (e.g. AMP4ADS for <html amp4ads>), or an error if it
+// declares none. If it declares several, the first is returned.
+func DeclaredFormat(s string) (rpb.Request_HtmlFormat, error) {
+	context := &transformers.Context{}
+	if err := setDOM(context, s); err != nil {
+		return rpb.Request_UNKNOWN_CODE, err
+	}
+	for _, attr := range context.DOM.HTMLNode.Attr {
+		if attr.Namespace == "" {
+			if match := ampAttrRE.FindStringSubmatch(attr.Key); match != nil {
+				for format, suffix := range ampFormatSuffixes {
+					if match[1] == suffix {
+						return format, nil
+					}
+				}
+			}
+		}
+	}
+	return rpb.Request_UNKNOWN_CODE, errors.New("html tag is missing an AMP attribute")
+}
+
 // requireAMPAttribute returns an error if the <html> tag doesn't contain an
 // attribute indicating that the document is AMP.
 func requireAMPAttribute(dom *amphtml.DOM, allowedFormats []rpb.Request_HtmlFormat) error {
@@ -172,23 +201,31 @@ func requireAMPAttribute(dom *amphtml.DOM, allowedFormats []rpb.Request_HtmlForm
 }
 
 // extractPreloads returns a list of absolute URLs of the resources to preload,
-// in the order to preload them. It depends on transformers.ReorderHead having
-// run.
+// in the order to preload them, without duplicates. It depends on
+// transformers.ReorderHead having run.
 func extractPreloads(dom *amphtml.DOM) []*rpb.Metadata_Preload {
 	// If you add additional preloads here, verify that they can not be
 	// unintentionally author supplied.
 	preloads := []*rpb.Metadata_Preload{}
+	seen := map[string]bool{}
+	add := func(n *html.Node, url, as string) {
+		if !seen[url] {
+			seen[url] = true
+			media, _ := htmlnode.GetAttributeVal(n, "", "media")
+			preloads = append(preloads, &rpb.Metadata_Preload{Url: url, As: as, Crossorigin: corsSettings(n), Media: strings.TrimSpace(media)})
+		}
+	}
 	for child := dom.HeadNode.FirstChild; child != nil; child = child.NextSibling {
 		switch child.DataAtom {
 		case atom.Script:
 			if src, ok := htmlnode.GetAttributeVal(child, "", "src"); ok {
-				preloads = append(preloads, &rpb.Metadata_Preload{Url: src, As: "script"})
+				add(child, src, "script")
 			}
 		case atom.Link:
 			if rel, ok := htmlnode.GetAttributeVal(child, "", "rel"); ok {
 				if strings.EqualFold(rel, "stylesheet") {
 					if href, ok := htmlnode.GetAttributeVal(child, "", "href"); ok {
-						preloads = append(preloads, &rpb.Metadata_Preload{Url: href, As: "style"})
+						add(child, href, "style")
 					}
 				}
 			}
@@ -200,6 +237,20 @@ func extractPreloads(dom *amphtml.DOM) []*rpb.Metadata_Preload {
 	return preloads
 }
 
+// corsSettings returns the CORS settings of the given element, per its
+// crossorigin attribute: "" if absent, "use-credentials", or otherwise (even
+// if invalid) "anonymous".
+func corsSettings(n *html.Node) string {
+	v, ok := htmlnode.GetAttributeVal(n, "", "crossorigin")
+	if !ok {
+		return ""
+	}
+	if strings.EqualFold(v, "use-credentials") {
+		return "use-credentials"
+	}
+	return "anonymous"
+}
+
 // setBaseURL derives the absolute base URL, and sets it on c.BaseURL. The value
 // is derived using the <base> href in the DOM, if it exists. If the href is
 // relative, it is parsed in the context of the document URL.
@@ -223,7 +274,7 @@ func setBaseURL(c *transformers.Context) {
 //
 // If the requested list of transformers is empty, apply the default.
 func Process(r *rpb.Request) (string, *rpb.Metadata, error) {
-	context := &transformers.Context{}
+	context := &transformers.Context{Request: r}
 	var err error
 
 	err = setDOM(context, r.Html)
@@ -94,6 +94,18 @@ func TestPreloads(t *testing.T) {
 			"<html ⚡><link rel=stylesheet href=foo><script src=bar>",
 			[]*rpb.Metadata_Preload{{Url: "foo", As: "style"}, {Url: "bar", As: "script"}},
 		},
+		{ // duplicates
+			"<html ⚡><link rel=stylesheet href=foo><script src=bar><link rel=stylesheet href=foo><script src=bar>",
+			[]*rpb.Metadata_Preload{{Url: "foo", As: "style"}, {Url: "bar", As: "script"}},
+		},
+		{ // crossorigin
+			"<html ⚡><link rel=stylesheet href=foo crossorigin><script src=bar crossorigin=USE-CREDENTIALS></script><script src=baz crossorigin=bogus></script>",
+			[]*rpb.Metadata_Preload{{Url: "foo", As: "style", Crossorigin: "anonymous"}, {Url: "bar", As: "script", Crossorigin: "use-credentials"}, {Url: "baz", As: "script", Crossorigin: "anonymous"}},
+		},
+		{ // media
+			`<html ⚡><link rel=stylesheet href=foo media=" (min-width: 600px) "><link rel=stylesheet href=bar>`,
+			[]*rpb.Metadata_Preload{{Url: "foo", As: "style", Media: "(min-width: 600px)"}, {Url: "bar", As: "style"}},
+		},
 		{
 			manyScriptsHTML.String(),
 			manyScriptsPreloads,
@@ -174,6 +186,25 @@ func TestCustom(t *testing.T) {
 	}
 }
 
+func TestResponseHeaders(t *testing.T) {
+	// A custom transformer may vary on the upstream response headers.
+	var variant string
+	transformerFunctionMap["variant"] = func(e *transformers.Context) error {
+		variant = e.Request.GetResponseHeaders()["X-Variant"]
+		return nil
+	}
+	defer delete(transformerFunctionMap, "variant")
+
+	r := rpb.Request{Html: "<html ⚡><lemur>", Config: rpb.Request_CUSTOM, Transformers: []string{"variant"},
+		ResponseHeaders: map[string]string{"X-Variant": "b"}}
+	if _, _, err := Process(&r); err != nil {
+		t.Fatalf("Process(%v) unexpectedly failed %v", r, err)
+	}
+	if variant != "b" {
+		t.Errorf("X-Variant response header = %q, want %q", variant, "b")
+	}
+}
+
 func TestCustomFail(t *testing.T) {
 	r := rpb.Request{Html: "<html ⚡><lemur>", Config: rpb.Request_CUSTOM, Transformers: []string{"does_not_exist"}}
 	if html, _, err := Process(&r); err == nil {
@@ -297,6 +328,31 @@ func TestRequireAMPAttribute(t *testing.T) {
 	}
 }
 
+func TestDeclaredFormat(t *testing.T) {
+	tests := []struct {
+		html          string
+		expected      rpb.Request_HtmlFormat
+		expectedError bool
+	}{
+		{"<html ⚡><head></head><body></body></html>", rpb.Request_AMP, false},
+		{"<html amp><head></head><body></body></html>", rpb.Request_AMP, false},
+		{"<HTML AMP4ADS><HEAD></HEAD><BODY></BODY></HTML>", rpb.Request_AMP4ADS, false},
+		{"<html ⚡4email><head></head><body></body></html>", rpb.Request_AMP4EMAIL, false},
+		{"<html lang=en amp4ads amp4email><head></head><body></body></html>", rpb.Request_AMP4ADS, false},
+		{"<html amp4><head></head><body></body></html>", rpb.Request_UNKNOWN_CODE, true},
+		{"<html><head></head><body></body></html>", rpb.Request_UNKNOWN_CODE, true},
+	}
+	for _, test := range tests {
+		format, err := DeclaredFormat(test.html)
+		if (err != nil) != test.expectedError {
+			t.Errorf("%s: DeclaredFormat() has error=%#v want=%t", test.html, err, test.expectedError)
+		}
+		if format != test.expected {
+			t.Errorf("%s: DeclaredFormat()=%s want=%s", test.html, format, test.expected)
+		}
+	}
+}
+
 func TestBaseURL(t *testing.T) {
 	docURL := "http://example.com/a/page.html"
 	tests := []struct {